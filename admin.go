@@ -0,0 +1,223 @@
+package gostorm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// driverStatus is a driver in the body of GET /v1/drivers
+type driverStatus struct {
+	Index             int         `json:"index"`
+	Name              string      `json:"name"`
+	State             DriverState `json:"state"`
+	Healthy           bool        `json:"healthy"`
+	Calls             uint64      `json:"calls"`
+	Errors            uint64      `json:"errors"`
+	ConsecutiveErrors uint64      `json:"consecutive_errors"`
+	LastError         string      `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time  `json:"last_error_at,omitempty"`
+	LastSuccessAt     *time.Time  `json:"last_success_at,omitempty"`
+	InFlight          int64       `json:"in_flight"`
+	LatencyMS         latencyMS   `json:"latency_ms"`
+	Capabilities      []string    `json:"capabilities"`
+}
+
+// latencyMS are a driver's latency percentiles in milliseconds
+type latencyMS struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// driversResponse is the body of GET /v1/drivers
+type driversResponse struct {
+	Drivers []driverStatus `json:"drivers"`
+}
+
+// tenantStatus is a tenant in the body of GET /v1/tenants
+type tenantStatus struct {
+	Name        string   `json:"name"`
+	Prefix      string   `json:"prefix"`
+	Drivers     []string `json:"drivers"`
+	ReadPolicy  string   `json:"read_policy"`
+	WritePolicy string   `json:"write_policy"`
+	Keys        int64    `json:"keys"`
+	Bytes       int64    `json:"bytes"`
+	Requests    uint64   `json:"requests"`
+	Throttled   uint64   `json:"throttled"`
+	OverQuota   uint64   `json:"over_quota"`
+	Quota       quota    `json:"quota"`
+}
+
+// quota is a tenant's Quota, zero meaning no cap
+type quota struct {
+	MaxKeys  int64   `json:"max_keys"`
+	MaxBytes int64   `json:"max_bytes"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+}
+
+// tenantsResponse is the body of GET /v1/tenants
+type tenantsResponse struct {
+	Tenants []tenantStatus `json:"tenants"`
+}
+
+// driverValue is a driver's answer in the body of GET /v1/inspect/{key}
+type driverValue struct {
+	Index int        `json:"index"`
+	Name  string     `json:"name"`
+	Value *string    `json:"value,omitempty"`
+	Error *errorBody `json:"error,omitempty"`
+}
+
+// inspectResponse is the body of GET /v1/inspect/{key}. Consistent means
+// every driver had the same value, or none had the key.
+type inspectResponse struct {
+	Key        string        `json:"key"`
+	Consistent bool          `json:"consistent"`
+	Drivers    []driverValue `json:"drivers"`
+}
+
+// timePtr leaves zero times out of the JSON
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func toDriverStatus(s DriverStatus) driverStatus {
+	return driverStatus{
+		Index:             s.Index,
+		Name:              s.Name,
+		State:             s.State,
+		Healthy:           s.Healthy(),
+		Calls:             s.Calls,
+		Errors:            s.Errors,
+		ConsecutiveErrors: s.ConsecutiveErrors,
+		LastError:         s.LastError,
+		LastErrorAt:       timePtr(s.LastErrorAt),
+		LastSuccessAt:     timePtr(s.LastSuccessAt),
+		InFlight:          s.InFlight,
+		LatencyMS:         latencyMS{P50: ms(s.Latency.P50), P90: ms(s.Latency.P90), P99: ms(s.Latency.P99)},
+		Capabilities:      s.Capabilities,
+	}
+}
+
+func (srv *server) driversHandler(w http.ResponseWriter, r *http.Request) {
+	resp := driversResponse{Drivers: []driverStatus{}}
+	for _, s := range srv.gs.Drivers() {
+		resp.Drivers = append(resp.Drivers, toDriverStatus(s))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// tenantsHandler says how much each tenant uses, with the drivers and
+// policies it ends up with
+func (srv *server) tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := tenantsResponse{Tenants: []tenantStatus{}}
+	for _, s := range srv.gs.Tenants() {
+		t := srv.gs.tenants[s.Name]
+
+		drivers := []string{}
+		for _, b := range t.only(srv.gs.drivers) {
+			drivers = append(drivers, b.status.Name)
+		}
+
+		resp.Tenants = append(resp.Tenants, tenantStatus{
+			Name:        s.Name,
+			Prefix:      s.Prefix,
+			Drivers:     drivers,
+			ReadPolicy:  t.readPolicy(srv.gs.readPolicy).String(),
+			WritePolicy: t.writePolicy(srv.gs.writePolicy).String(),
+			Keys:        s.Keys,
+			Bytes:       s.Bytes,
+			Requests:    s.Requests,
+			Throttled:   s.Throttled,
+			OverQuota:   s.OverQuota,
+			Quota:       quota{MaxKeys: s.Quota.MaxKeys, MaxBytes: s.Quota.MaxBytes, Rate: s.Quota.Rate, Burst: s.Quota.burst()},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// putDriverHandler changes a driver's state, from {"state": "disabled"}
+func (srv *server) putDriverHandler(w http.ResponseWriter, r *http.Request) {
+	index, _ := strconv.Atoi(mux.Vars(r)["index"])
+
+	req := struct {
+		State string `json:"state"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_json", err)
+		return
+	}
+
+	state, err := ParseDriverState(req.State)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_state", err)
+		return
+	}
+
+	err = srv.gs.SetDriverState(index, state)
+	srv.log(r).Debug("set driver state", "index", index, "state", state, "err", err)
+
+	if err == ErrNoSuchDriver {
+		writeError(w, http.StatusNotFound, "no_such_driver", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toDriverStatus(srv.gs.Drivers()[index]))
+}
+
+func (srv *server) inspectHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	values := srv.gs.inspect(originOf(r), key, srv.timeout(r))
+
+	resp := inspectResponse{Key: key, Consistent: true, Drivers: []driverValue{}}
+	var first *DriverValue
+
+	for i, v := range values {
+		dv := driverValue{Index: v.Index, Name: v.Name}
+
+		switch {
+		case v.Err == nil:
+			dv.Value = &values[i].Value
+		case errors.Is(v.Err, ErrNotFound):
+			// A miss is an answer too, it gets compared like a value
+		default:
+			_, code := statusFor(v.Err)
+			dv.Error = &errorBody{Code: code, Message: v.Err.Error()}
+		}
+
+		// Drivers that failed can't be told apart, they're left out
+		if dv.Error == nil {
+			if first == nil {
+				first = &values[i]
+			} else if (first.Err == nil) != (v.Err == nil) || first.Value != v.Value {
+				resp.Consistent = false
+			}
+		}
+
+		resp.Drivers = append(resp.Drivers, dv)
+	}
+
+	srv.log(r).Debug("inspect", "key", key, "consistent", resp.Consistent)
+
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,403 @@
+package gostorm
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxKeyLength matches memcached's limit, the strictest of our drivers
+	maxKeyLength = 250
+
+	// maxValueSize caps the body of a PUT
+	maxValueSize = 1 << 20
+
+	// maxBatchSize caps the body of a batch call and the number of keys in it
+	maxBatchSize = 16 << 20
+	maxBatchKeys = 1000
+)
+
+var (
+	errBadKey       = errors.New("key must be 1-250 printable characters, no spaces")
+	errMissingValue = errors.New("missing value")
+	errTooManyKeys  = errors.New("too many keys in one batch")
+	errBadTTL       = errors.New("ttl must be a duration like 30s, or milliseconds")
+)
+
+// apiError is the JSON body of every /v1 error response
+type apiError struct {
+	Error errorBody `json:"error"`
+}
+
+// errorBody describes an error, on its own or for a key in a batch
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// mgetRequest is the body of POST /v1/mget
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// msetRequest is the body of POST /v1/mset
+type msetRequest struct {
+	Values map[string]string `json:"values"`
+}
+
+// batchResponse is what batch calls return, errors being per key
+type batchResponse struct {
+	Values map[string]string    `json:"values,omitempty"`
+	Errors map[string]errorBody `json:"errors,omitempty"`
+}
+
+// listResponse is the body of GET /v1/keys
+type listResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// ttlResponse is the body of GET /v1/ttl/{key}, TTLMillis being -1 for a
+// key that doesn't expire
+type ttlResponse struct {
+	Key       string `json:"key"`
+	TTLMillis int64  `json:"ttl_ms"`
+}
+
+// keyMeta is what /v1 returns about a key when asked for JSON
+type keyMeta struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Size  int     `json:"size"`
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON error with a status code matching err
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	writeJSON(w, status, apiError{Error: errorBody{Code: code, Message: err.Error()}})
+}
+
+// statusFor picks a status code and an error code for an error from Gostorm
+func statusFor(err error) (int, string) {
+	switch {
+	case IsNotFound(err):
+		return http.StatusNotFound, "not_found"
+	case IsTimeout(err):
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, ErrNoDrivers):
+		return http.StatusServiceUnavailable, "no_drivers"
+	case errors.Is(err, ErrShutdown):
+		return http.StatusServiceUnavailable, "shutting_down"
+	case errors.Is(err, ErrUnsupported):
+		return http.StatusNotImplemented, "unsupported"
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, "quota_exceeded"
+	}
+	return http.StatusBadGateway, "driver_error"
+}
+
+// writeGostormError writes an error from Gostorm
+func writeGostormError(w http.ResponseWriter, err error) {
+	status, code := statusFor(err)
+	writeError(w, status, code, err)
+}
+
+// wantsJSON tells whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// validKey checks a key against what every driver can store
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keyFromRequest returns the {key} route var, writing a 400 if it's no good
+func keyFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := mux.Vars(r)["key"]
+	if !validKey(key) {
+		writeError(w, http.StatusBadRequest, "bad_key", errBadKey)
+		return "", false
+	}
+	return key, true
+}
+
+// ttlFromRequest reads the ttl query parameter, a duration ("30s") or plain
+// milliseconds ("30000"), writing a 400 if it's no good. It's 0 if missing.
+func ttlFromRequest(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	param := r.URL.Query().Get("ttl")
+	if len(param) == 0 {
+		return 0, true
+	}
+
+	ttl, err := time.ParseDuration(param)
+	if err != nil {
+		ms, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_ttl", errBadTTL)
+			return 0, false
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+
+	if ttl < 0 {
+		writeError(w, http.StatusBadRequest, "bad_ttl", errBadTTL)
+		return 0, false
+	}
+
+	return ttl, true
+}
+
+func (srv *server) getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	value, err := srv.gs.get(originOf(r), key, srv.timeout(r))
+	srv.log(r).Debug("keys", "method", r.Method, "key", key, "err", err)
+
+	if err != nil {
+		if r.Method == "HEAD" {
+			status, _ := statusFor(err)
+			w.WriteHeader(status)
+			return
+		}
+		writeGostormError(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		meta := keyMeta{Key: key, Size: len(value)}
+		if r.Method != "HEAD" {
+			meta.Value = &value
+		}
+		writeJSON(w, http.StatusOK, meta)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method != "HEAD" {
+		w.Write([]byte(value))
+	}
+}
+
+func (srv *server) putKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ttl, ok := ttlFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", err)
+		return
+	}
+
+	value := string(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Value *string `json:"value"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_json", err)
+			return
+		}
+		if req.Value == nil {
+			writeError(w, http.StatusBadRequest, "missing_value", errMissingValue)
+			return
+		}
+		value = *req.Value
+	}
+
+	err = srv.gs.setWithTTL(originOf(r), key, value, ttl, srv.timeout(r))
+	srv.log(r).Debug("keys", "method", r.Method, "key", key, "err", err)
+
+	if err != nil {
+		writeGostormError(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, keyMeta{Key: key, Size: len(value)})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) deleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := srv.gs.delete(originOf(r), key, srv.timeout(r))
+	srv.log(r).Debug("keys", "method", r.Method, "key", key, "err", err)
+
+	if err != nil {
+		writeGostormError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) getTTLHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ttl, err := srv.gs.ttl(originOf(r), key, srv.timeout(r))
+	srv.log(r).Debug("ttl", "method", r.Method, "key", key, "err", err)
+
+	if err != nil {
+		writeGostormError(w, err)
+		return
+	}
+
+	resp := ttlResponse{Key: key, TTLMillis: -1}
+	if ttl != NoExpiry {
+		resp.TTLMillis = int64(ttl / time.Millisecond)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// putTTLHandler changes the TTL of an existing key, no ttl meaning never
+func (srv *server) putTTLHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	ttl, ok := ttlFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := srv.gs.expire(originOf(r), key, ttl, srv.timeout(r))
+	srv.log(r).Debug("ttl", "method", r.Method, "key", key, "err", err)
+
+	if err != nil {
+		writeGostormError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// batchErrors turns per-key errors into their JSON form
+func batchErrors(errs map[string]error) map[string]errorBody {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	bodies := make(map[string]errorBody, len(errs))
+	for key, err := range errs {
+		_, code := statusFor(err)
+		bodies[key] = errorBody{Code: code, Message: err.Error()}
+	}
+	return bodies
+}
+
+// readBatch decodes a batch request body into v, writing a 400 if it's no good
+func readBatch(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_json", err)
+		return false
+	}
+	return true
+}
+
+func (srv *server) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	keys, err := srv.gs.list(originOf(r), prefix, srv.timeout(r))
+	srv.log(r).Debug("list", "prefix", prefix, "keys", len(keys), "err", err)
+
+	if err != nil {
+		writeGostormError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listResponse{Keys: keys})
+}
+
+func (srv *server) mgetHandler(w http.ResponseWriter, r *http.Request) {
+	req := mgetRequest{}
+	if !readBatch(w, r, &req) {
+		return
+	}
+
+	if len(req.Keys) > maxBatchKeys {
+		writeError(w, http.StatusBadRequest, "too_many_keys", errTooManyKeys)
+		return
+	}
+
+	for _, key := range req.Keys {
+		if !validKey(key) {
+			writeError(w, http.StatusBadRequest, "bad_key", errBadKey)
+			return
+		}
+	}
+
+	values, errs := srv.gs.getMulti(originOf(r), req.Keys, srv.timeout(r))
+	srv.log(r).Debug("mget", "keys", len(req.Keys), "errors", len(errs))
+
+	writeJSON(w, http.StatusOK, batchResponse{Values: values, Errors: batchErrors(errs)})
+}
+
+func (srv *server) msetHandler(w http.ResponseWriter, r *http.Request) {
+	req := msetRequest{}
+	if !readBatch(w, r, &req) {
+		return
+	}
+
+	if len(req.Values) > maxBatchKeys {
+		writeError(w, http.StatusBadRequest, "too_many_keys", errTooManyKeys)
+		return
+	}
+
+	for key := range req.Values {
+		if !validKey(key) {
+			writeError(w, http.StatusBadRequest, "bad_key", errBadKey)
+			return
+		}
+	}
+
+	errs := srv.gs.setMulti(originOf(r), req.Values, srv.timeout(r))
+	srv.log(r).Debug("mset", "keys", len(req.Values), "errors", len(errs))
+
+	writeJSON(w, http.StatusOK, batchResponse{Errors: batchErrors(errs)})
+}
@@ -0,0 +1,355 @@
+// Package auth puts authentication and per key prefix permissions in front
+// of gostorm's HTTP API. Requests carry a static token, an HMAC signature
+// or a JWT, see FromFile for how they're set up.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/wmgaca/gostorm"
+)
+
+// Perm is what a Grant allows
+type Perm int
+
+// Permissions, Admin being the drivers, inspect, tenants, status and metrics
+const (
+	Read Perm = 1 << iota
+	Write
+	Admin
+)
+
+func (p Perm) String() string {
+	switch p {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Admin:
+		return "admin"
+	}
+	return fmt.Sprintf("perm(%d)", int(p))
+}
+
+// Grant allows Perm on the keys starting with Prefix, every key if it's
+// empty
+type Grant struct {
+	Prefix string
+	Perm   Perm
+}
+
+// Principal is who a request comes from and what they may do. A Tenant
+// keeps them to that tenant's keys, the Grants' prefixes being of keys as
+// the tenant sees them.
+type Principal struct {
+	Name   string
+	Grants []Grant
+	Tenant string
+}
+
+// Can tells whether p may do perm on key
+func (p *Principal) Can(perm Perm, key string) bool {
+	for _, g := range p.Grants {
+		if g.Perm == perm && strings.HasPrefix(key, g.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// ContextWithPrincipal returns ctx carrying p, Handler passes it on this
+// way for handlers that check keys it can't see, like gRPC's
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the Principal a request was let in as, if
+// it went through Handler
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// ParseScopes reads scopes like "read:app/", "write:app/" and "admin". No
+// prefix, as in "read", means every key.
+func ParseScopes(scopes []string) ([]Grant, error) {
+	grants := []Grant{}
+
+	for _, scope := range scopes {
+		name, prefix, _ := strings.Cut(scope, ":")
+
+		var perm Perm
+		switch name {
+		case "read":
+			perm = Read
+		case "write":
+			perm = Write
+		case "admin":
+			perm = Admin
+			if len(prefix) > 0 {
+				return nil, fmt.Errorf("auth: admin takes no prefix, got %q", scope)
+			}
+		default:
+			return nil, fmt.Errorf("auth: bad scope %q", scope)
+		}
+
+		grants = append(grants, Grant{Prefix: prefix, Perm: perm})
+	}
+
+	return grants, nil
+}
+
+// Errors authenticators return
+var (
+	// ErrNoCredentials means the request carries no credentials of the
+	// authenticator's kind, another one may know what to do with it
+	ErrNoCredentials = errors.New("auth: no credentials")
+
+	// ErrBadCredentials means the credentials are wrong, expired or unknown
+	ErrBadCredentials = errors.New("auth: bad credentials")
+)
+
+// Authenticator tells who a request comes from
+type Authenticator interface {
+	// Authenticate returns the request's principal, ErrNoCredentials if
+	// it has no credentials this Authenticator understands, or an error
+	// wrapping ErrBadCredentials
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticators tries each in turn, the first one finding credentials it
+// understands decides
+type Authenticators []Authenticator
+
+// Authenticate implements Authenticator
+func (as Authenticators) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range as {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// maxBody caps the bodies read to check signatures and batch keys, the
+// API's own limits are tighter
+const maxBody = 16 << 20
+
+// need is a permission a request needs, on a key or, for a list, on every
+// key under a prefix
+type need struct {
+	perm   Perm
+	key    string
+	prefix bool
+}
+
+// public are the routes anyone may call, for probes
+var public = map[string]bool{
+	"/":        true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// grpcService is where gostorm's gRPC calls go
+const grpcService = "/gostorm.v1.Gostorm/"
+
+// isGRPC tells whether r is a call to gostorm's gRPC service
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") &&
+		strings.HasPrefix(r.URL.Path, grpcService)
+}
+
+// needs works out what a request to gostorm's API needs. known is false
+// for requests it doesn't recognize, they only need to be authenticated.
+func needs(r *http.Request, body []byte) (ns []need, known bool, err error) {
+	path := r.URL.Path
+
+	if isGRPC(r) {
+		// gRPC keys are in protobuf bodies, the gRPC frontend checks each
+		// call's against the principal it finds in the context
+		return nil, true, nil
+	}
+
+	route, key, _ := strings.Cut(strings.TrimPrefix(path, "/v1/"), "/")
+	if !strings.HasPrefix(path, "/v1/") {
+		route, key = path, ""
+	}
+
+	switch {
+	case route == "keys" && len(key) > 0:
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return []need{{perm: Read, key: key}}, true, nil
+		}
+		return []need{{perm: Write, key: key}}, true, nil
+	case route == "keys":
+		return []need{{perm: Read, key: r.URL.Query().Get("prefix"), prefix: true}}, true, nil
+	case route == "ttl":
+		if r.Method == "GET" {
+			return []need{{perm: Read, key: key}}, true, nil
+		}
+		return []need{{perm: Write, key: key}}, true, nil
+	case route == "mget":
+		req := struct {
+			Keys []string `json:"keys"`
+		}{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, true, err
+		}
+		for _, key := range req.Keys {
+			ns = append(ns, need{perm: Read, key: key})
+		}
+		return ns, true, nil
+	case route == "mset":
+		req := struct {
+			Values map[string]json.RawMessage `json:"values"`
+		}{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, true, err
+		}
+		for key := range req.Values {
+			ns = append(ns, need{perm: Write, key: key})
+		}
+		return ns, true, nil
+	case route == "drivers" || route == "inspect" || route == "tenants" || path == "/status" || path == "/metrics":
+		return []need{{perm: Admin}}, true, nil
+	case strings.HasPrefix(path, "/get/"):
+		return []need{{perm: Read, key: strings.TrimSuffix(strings.TrimPrefix(path, "/get/"), "/")}}, true, nil
+	case path == "/set/":
+		if err := r.ParseForm(); err != nil {
+			return nil, true, err
+		}
+		return []need{{perm: Write, key: r.PostForm.Get("key")}}, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// allowed tells whether p has everything ns needs, saying what's missing
+// if not
+func allowed(p *Principal, ns []need) (bool, string) {
+	for _, n := range ns {
+		// A grant covering a prefix covers every key under it, so lists
+		// check the same way
+		if !p.Can(n.perm, n.key) {
+			if n.perm == Admin {
+				return false, "admin needed"
+			}
+			if n.prefix {
+				return false, fmt.Sprintf("%s needed on every key under %q", n.perm, n.key)
+			}
+			return false, fmt.Sprintf("%s needed on %q", n.perm, n.key)
+		}
+	}
+	return true, ""
+}
+
+// needsBody tells whether the body has to be read to check the request,
+// it's put back for the handler
+func needsBody(r *http.Request) bool {
+	if isGRPC(r) {
+		return false
+	}
+	return r.URL.Path == "/v1/mget" || r.URL.Path == "/v1/mset" ||
+		strings.HasPrefix(r.Header.Get("Authorization"), hmacScheme+" ")
+}
+
+// errorBody matches the API's errors
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	body := errorBody{}
+	body.Error.Code = code
+	body.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gostorm"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Handler checks every request to next is allowed, answering 401 without
+// credentials, or with bad ones, and 403 when the principal lacks a
+// permission. Only /, /healthz and /readyz are open to anyone. The tenant
+// header is the principal's, whatever the request said.
+func Handler(next http.Handler, a Authenticator, logger *slog.Logger) http.Handler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the credentials say which tenant a request is for
+		r.Header.Del(gostorm.TenantHeader)
+
+		if public[r.URL.Path] && (r.Method == "GET" || r.Method == "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log := logger.With("method", r.Method, "path", r.URL.Path)
+
+		var body []byte
+		if needsBody(r) {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_body", err.Error())
+				return
+			}
+			if len(body) > maxBody {
+				writeError(w, http.StatusRequestEntityTooLarge, "too_large", "body too large")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		p, err := a.Authenticate(r)
+		if err != nil {
+			log.Info("unauthenticated", "err", err)
+			writeError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+			return
+		}
+
+		if len(p.Tenant) > 0 {
+			r.Header.Set(gostorm.TenantHeader, p.Tenant)
+		}
+
+		ns, known, err := needs(r, body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		if known {
+			if ok, why := allowed(p, ns); !ok {
+				log.Info("forbidden", "principal", p.Name, "why", why)
+				writeError(w, http.StatusForbidden, "forbidden", why)
+				return
+			}
+		}
+
+		log.Debug("allowed", "principal", p.Name)
+		next.ServeHTTP(w, r.WithContext(ContextWithPrincipal(r.Context(), p)))
+	})
+}
@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   []Grant
+		err    bool
+	}{
+		{nil, []Grant{}, false},
+		{[]string{"read"}, []Grant{{"", Read}}, false},
+		{[]string{"read:app/", "write:app/", "admin"}, []Grant{{"app/", Read}, {"app/", Write}, {"", Admin}}, false},
+		{[]string{"admin:app/"}, nil, true},
+		{[]string{"delete:app/"}, nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseScopes(test.scopes)
+		if (err != nil) != test.err {
+			t.Errorf("%v: err %v, want error %v", test.scopes, err, test.err)
+			continue
+		}
+		if !test.err && !equalGrants(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.scopes, got, test.want)
+		}
+	}
+}
+
+func equalGrants(a, b []Grant) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHMAC(t *testing.T) {
+	secret := []byte("secret")
+	p := &Principal{Name: "batch"}
+
+	tests := []struct {
+		name string
+		// skew is how far the server's clock is ahead of the client's
+		skew    time.Duration
+		prepare func(r *http.Request)
+		err     error
+	}{
+		{"signed", 0, nil, nil},
+		{"within skew", MaxSkew - time.Minute, nil, nil},
+		{"behind within skew", -MaxSkew + time.Minute, nil, nil},
+		{"too old", MaxSkew + time.Minute, nil, ErrBadCredentials},
+		{"from the future", -MaxSkew - time.Minute, nil, ErrBadCredentials},
+		{"other body", 0, func(r *http.Request) {
+			r.Body = http.NoBody
+		}, ErrBadCredentials},
+		{"other path", 0, func(r *http.Request) {
+			r.RequestURI = "/v1/keys/b"
+		}, ErrBadCredentials},
+		{"unknown key", 0, func(r *http.Request) {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "batch-1", "batch-2", 1))
+		}, ErrBadCredentials},
+		{"bad timestamp", 0, func(r *http.Request) {
+			r.Header.Set("Authorization", hmacScheme+" Credential=batch-1, Timestamp=now, Signature=00")
+		}, ErrBadCredentials},
+		{"no signature", 0, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer token")
+		}, ErrNoCredentials},
+	}
+
+	for _, test := range tests {
+		h := NewHMAC()
+		h.Add("batch-1", secret, p)
+		h.now = func() time.Time { return time.Now().Add(test.skew) }
+
+		body := []byte(`{"value":"v"}`)
+		r := httptest.NewRequest("PUT", "/v1/keys/a", strings.NewReader(string(body)))
+		Sign(r, body, "batch-1", secret)
+		if test.prepare != nil {
+			test.prepare(r)
+		}
+
+		got, err := h.Authenticate(r)
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		case test.err == nil && got != p:
+			t.Errorf("%s: got principal %v", test.name, got)
+		}
+	}
+}
+
+// jwtKeys are the keys JWTs are signed with in tests, and a JWKS of their
+// public halves
+type jwtKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	jwks string
+}
+
+func newJWTKeys(t *testing.T) *jwtKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": enc(rsaKey.N.Bytes()), "e": enc(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": enc(ecKey.X.FillBytes(make([]byte, 32))), "y": enc(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": "x", "e": "x"},
+		},
+	}
+	data, _ := json.Marshal(jwks)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtKeys{rsa: rsaKey, ec: ecKey, jwks: path}
+}
+
+// sign makes a JWT, alg picking which key signs it
+func (k *jwtKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc(header) + "." + enc(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		// The old trick: the RSA public key as an HMAC secret
+		mac := hmac.New(sha256.New, k.rsa.N.Bytes())
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+
+	return signed + "." + enc(sig)
+}
+
+func TestJWT(t *testing.T) {
+	keys := newJWTKeys(t)
+
+	j, err := NewJWT(keys.jwks, "https://sso", "gostorm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	j.now = func() time.Time { return now }
+
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub":   "app",
+			"iss":   "https://sso",
+			"aud":   []string{"other", "gostorm"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "read:app/ write:app/ email",
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		ok     bool
+		tenant string
+	}{
+		{"rs256", keys.sign(t, "RS256", "rsa", valid(nil)), true, ""},
+		{"es256", keys.sign(t, "ES256", "ec", valid(nil)), true, ""},
+		{"tenant", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"tenant": "search"})), true, "search"},
+		{"one audience", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"aud": "gostorm"})), true, ""},
+		{"exp within leeway", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"exp": now.Add(-Leeway / 2).Unix()})), true, ""},
+		{"alg none", keys.sign(t, "none", "rsa", valid(nil)), false, ""},
+		{"hs256 with the rsa key", keys.sign(t, "HS256", "rsa", valid(nil)), false, ""},
+		{"es256 with the rsa key", keys.sign(t, "ES256", "rsa", valid(nil)), false, ""},
+		{"rs256 with the ec key", keys.sign(t, "RS256", "ec", valid(nil)), false, ""},
+		{"unknown kid", keys.sign(t, "RS256", "other", valid(nil)), false, ""},
+		{"encryption key", keys.sign(t, "RS256", "enc", valid(nil)), false, ""},
+		{"no kid with several keys", keys.sign(t, "RS256", "", valid(nil)), false, ""},
+		{"expired", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"exp": now.Add(-2 * Leeway).Unix()})), false, ""},
+		{"no exp", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"exp": nil})), false, ""},
+		{"not valid yet", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"nbf": now.Add(2 * Leeway).Unix()})), false, ""},
+		{"other issuer", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"iss": "https://evil"})), false, ""},
+		{"other audience", keys.sign(t, "RS256", "rsa", valid(map[string]interface{}{"aud": "other"})), false, ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/v1/keys/app/a", nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+
+		p, err := j.Authenticate(r)
+		if !test.ok {
+			if !errors.Is(err, ErrBadCredentials) {
+				t.Errorf("%s: got %v, want ErrBadCredentials", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if p.Name != "app" || p.Tenant != test.tenant || !p.Can(Read, "app/a") || !p.Can(Write, "app/a") || p.Can(Read, "other") {
+			t.Errorf("%s: got %+v", test.name, p)
+		}
+	}
+
+	// A tampered payload keeps the signature of the original
+	token := keys.sign(t, "RS256", "rsa", valid(nil))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(valid(map[string]interface{}{"scope": "admin"}))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+
+	r := httptest.NewRequest("GET", "/v1/drivers", nil)
+	r.Header.Set("Authorization", "Bearer "+strings.Join(parts, "."))
+	if _, err := j.Authenticate(r); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("tampered payload: got %v, want ErrBadCredentials", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tokens := NewTokens()
+	tokens.Add("app", &Principal{Name: "app", Grants: []Grant{{"app/", Read}}})
+	tokens.Add("search", &Principal{Name: "search", Grants: []Grant{{"", Read}, {"", Write}}, Tenant: "search"})
+	tokens.Add("admin", &Principal{Name: "admin", Grants: []Grant{{"", Admin}}})
+
+	var tenant string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header.Get(gostorm.TenantHeader)
+	})
+	h := Handler(next, tokens, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+		// header is the tenant the request asks for
+		header string
+		status int
+		tenant string
+	}{
+		{"public", "GET", "/healthz", "", "", "", 200, ""},
+		{"no credentials", "GET", "/v1/keys/app/a", "", "", "", 401, ""},
+		{"unknown token", "GET", "/v1/keys/app/a", "", "nope", "", 401, ""},
+		{"read", "GET", "/v1/keys/app/a", "", "app", "", 200, ""},
+		{"read elsewhere", "GET", "/v1/keys/other", "", "app", "", 403, ""},
+		{"write without a grant", "PUT", "/v1/keys/app/a", "", "app", "", 403, ""},
+		{"list under the prefix", "GET", "/v1/keys?prefix=app/x", "", "app", "", 200, ""},
+		{"list everything", "GET", "/v1/keys", "", "app", "", 403, ""},
+		{"mget", "POST", "/v1/mget", `{"keys": ["app/a", "app/b"]}`, "app", "", 200, ""},
+		{"mget elsewhere", "POST", "/v1/mget", `{"keys": ["app/a", "b"]}`, "app", "", 403, ""},
+		{"mget bad body", "POST", "/v1/mget", `{`, "app", "", 400, ""},
+		{"admin route", "GET", "/v1/drivers", "", "app", "", 403, ""},
+		{"admin", "GET", "/v1/drivers", "", "admin", "", 200, ""},
+		{"tenant from the credentials", "GET", "/v1/keys/a", "", "search", "", 200, "search"},
+		{"tenant header overridden", "GET", "/v1/keys/a", "", "search", "other", 200, "search"},
+		{"tenant header dropped", "GET", "/v1/keys/app/a", "", "app", "search", 200, ""},
+	}
+
+	for _, test := range tests {
+		tenant = ""
+
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if len(test.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if len(test.header) > 0 {
+			r.Header.Set(gostorm.TenantHeader, test.header)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		if tenant != test.tenant {
+			t.Errorf("%s: the handler saw tenant %q, want %q", test.name, tenant, test.tenant)
+		}
+	}
+}
+
+func TestHandlerGRPC(t *testing.T) {
+	tokens := NewTokens()
+	tokens.Add("app", &Principal{Name: "app", Grants: []Grant{{"app/", Read}}})
+
+	var principal *Principal
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFromContext(r.Context())
+	})
+	h := Handler(next, tokens, nil)
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		// The gRPC frontend checks the keys, with the principal passed on
+		{"call", "/gostorm.v1.Gostorm/Get", "app", 200},
+		{"no credentials", "/gostorm.v1.Gostorm/Get", "", 401},
+		// Looking like gRPC doesn't get past the checks elsewhere
+		{"admin route", "/metrics", "app", 403},
+		{"key route", "/v1/keys/other", "app", 403},
+	}
+
+	for _, test := range tests {
+		principal = nil
+
+		r := httptest.NewRequest("POST", test.path, strings.NewReader("\x00\x00\x00\x00\x00"))
+		r.ProtoMajor = 2
+		r.Header.Set("Content-Type", "application/grpc")
+		if len(test.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		if (w.Code == 200) != (principal != nil && principal.Name == "app") {
+			t.Errorf("%s: the handler saw principal %v", test.name, principal)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// config is the file FromFile reads
+type config struct {
+	Tokens []struct {
+		Name   string   `json:"name"`
+		Token  string   `json:"token"`
+		SHA256 string   `json:"sha256"`
+		Scopes []string `json:"scopes"`
+		Tenant string   `json:"tenant"`
+	} `json:"tokens"`
+
+	HMAC []struct {
+		Name   string   `json:"name"`
+		KeyID  string   `json:"key_id"`
+		Secret string   `json:"secret"`
+		Scopes []string `json:"scopes"`
+		Tenant string   `json:"tenant"`
+	} `json:"hmac"`
+
+	Certs []struct {
+		CommonName string   `json:"common_name"`
+		Scopes     []string `json:"scopes"`
+		Tenant     string   `json:"tenant"`
+	} `json:"certs"`
+
+	JWT *struct {
+		JWKS     string `json:"jwks"`
+		Issuer   string `json:"issuer"`
+		Audience string `json:"audience"`
+	} `json:"jwt"`
+}
+
+// FromFile sets up authentication from a JSON file like
+//
+//	{
+//	  "tokens": [{"name": "app", "token": "...", "scopes": ["read:app/", "write:app/"]},
+//	             {"name": "search", "token": "...", "scopes": ["read", "write"], "tenant": "search"}],
+//	  "hmac": [{"name": "batch", "key_id": "batch-1", "secret": "...", "scopes": ["read"]}],
+//	  "jwt": {"jwks": "/etc/gostorm/jwks.json", "issuer": "https://sso", "audience": "gostorm"},
+//	  "certs": [{"common_name": "worker", "scopes": ["read"]}]
+//	}
+//
+// where a token may be given by its "sha256" instead, and every section is
+// optional. Credentials with a "tenant", JWTs with a tenant claim, only get
+// to that tenant's keys, their scopes being about its keys as it sees
+// them. Certificates are checked by the listener, see tlsconfig.Server,
+// and only looked at when there are no other credentials.
+func FromFile(path string) (Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("auth: %s: %s", path, err)
+	}
+
+	var as Authenticators
+
+	if len(cfg.Tokens) > 0 {
+		tokens := NewTokens()
+		for _, t := range cfg.Tokens {
+			grants, err := ParseScopes(t.Scopes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: token %q: %w", path, t.Name, err)
+			}
+			p := &Principal{Name: t.Name, Grants: grants, Tenant: t.Tenant}
+
+			switch {
+			case len(t.SHA256) > 0:
+				if err := tokens.AddHash(t.SHA256, p); err != nil {
+					return nil, fmt.Errorf("%s: token %q: %w", path, t.Name, err)
+				}
+			case len(t.Token) > 0:
+				tokens.Add(t.Token, p)
+			default:
+				return nil, fmt.Errorf("auth: %s: token %q has no token or sha256", path, t.Name)
+			}
+		}
+		as = append(as, tokens)
+	}
+
+	if len(cfg.HMAC) > 0 {
+		h := NewHMAC()
+		for _, k := range cfg.HMAC {
+			grants, err := ParseScopes(k.Scopes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: hmac %q: %w", path, k.Name, err)
+			}
+			if len(k.KeyID) == 0 || len(k.Secret) == 0 {
+				return nil, fmt.Errorf("auth: %s: hmac %q needs a key_id and a secret", path, k.Name)
+			}
+			h.Add(k.KeyID, []byte(k.Secret), &Principal{Name: k.Name, Grants: grants, Tenant: k.Tenant})
+		}
+		as = append(as, h)
+	}
+
+	if cfg.JWT != nil {
+		j, err := NewJWT(cfg.JWT.JWKS, cfg.JWT.Issuer, cfg.JWT.Audience)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, j)
+	}
+
+	if len(cfg.Certs) > 0 {
+		certs := NewClientCerts()
+		for _, c := range cfg.Certs {
+			grants, err := ParseScopes(c.Scopes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: cert %q: %w", path, c.CommonName, err)
+			}
+			certs.Add(c.CommonName, &Principal{Name: c.CommonName, Grants: grants, Tenant: c.Tenant})
+		}
+		as = append(as, certs)
+	}
+
+	if len(as) == 0 {
+		return nil, errors.New("auth: " + path + ": no tokens, hmac keys, jwt or certs")
+	}
+
+	return as, nil
+}
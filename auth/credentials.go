@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tokens authenticates static API tokens, sent as "Authorization: Bearer
+// <token>" or as the password of basic auth, so URLs like
+// "http://:<token>@host:8080" work as they are
+type Tokens struct {
+	// byHash keeps the tokens' SHA-256, so they needn't be kept at all
+	byHash map[[sha256.Size]byte]*Principal
+}
+
+// NewTokens returns an empty Tokens, see Add
+func NewTokens() *Tokens {
+	return &Tokens{byHash: make(map[[sha256.Size]byte]*Principal)}
+}
+
+// Add lets requests with token in as p
+func (t *Tokens) Add(token string, p *Principal) {
+	t.byHash[sha256.Sum256([]byte(token))] = p
+}
+
+// AddHash is Add for a token known only by its SHA-256, in hex
+func (t *Tokens) AddHash(hash string, p *Principal) error {
+	var sum [sha256.Size]byte
+	if n, err := hex.Decode(sum[:], []byte(hash)); err != nil || n != len(sum) {
+		return fmt.Errorf("auth: bad sha256 %q", hash)
+	}
+	t.byHash[sum] = p
+	return nil
+}
+
+// token returns the token of a request, if it has one
+func token(r *http.Request) (string, bool) {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, true
+	}
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") && len(token) > 0 && !looksLikeJWT(token) {
+		return token, true
+	}
+	return "", false
+}
+
+// Authenticate implements Authenticator
+func (t *Tokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := token(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	// The lookup is by hash, so its timing gives nothing away about tokens
+	if p, ok := t.byHash[sha256.Sum256([]byte(token))]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("%w: unknown token", ErrBadCredentials)
+}
+
+// hmacScheme is the Authorization scheme of HMAC signed requests
+const hmacScheme = "GOSTORM-HMAC-SHA256"
+
+// MaxSkew is how far from the server's clock a signed request's timestamp
+// may be. A signature can be replayed within it.
+const MaxSkew = 5 * time.Minute
+
+// HMAC authenticates requests signed with a shared secret, see Sign
+type HMAC struct {
+	keys map[string]hmacKey
+	now  func() time.Time
+}
+
+type hmacKey struct {
+	secret    []byte
+	principal *Principal
+}
+
+// NewHMAC returns an empty HMAC, see Add
+func NewHMAC() *HMAC {
+	return &HMAC{keys: make(map[string]hmacKey), now: time.Now}
+}
+
+// Add lets requests signed with secret under keyID in as p
+func (h *HMAC) Add(keyID string, secret []byte, p *Principal) {
+	h.keys[keyID] = hmacKey{secret: secret, principal: p}
+}
+
+// signature is the hex HMAC-SHA256 of the method, the request URI, the
+// timestamp and the SHA-256 of the body, a line each
+func signature(secret []byte, method, uri, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, method+"\n"+uri+"\n"+timestamp+"\n"+hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign signs r, whose body is body, with secret under keyID, setting
+// "Authorization: GOSTORM-HMAC-SHA256 Credential=<key id>,
+// Timestamp=<unix seconds>, Signature=<hex>"
+func Sign(r *http.Request, body []byte, keyID string, secret []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signature(secret, r.Method, r.URL.RequestURI(), timestamp, body)
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Timestamp=%s, Signature=%s", hmacScheme, keyID, timestamp, sig))
+}
+
+// Authenticate implements Authenticator, Handler having read the body so
+// it can be hashed
+func (h *HMAC) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != hmacScheme {
+		return nil, ErrNoCredentials
+	}
+
+	fields := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		fields[k] = v
+	}
+
+	key, ok := h.keys[fields["Credential"]]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrBadCredentials, fields["Credential"])
+	}
+
+	unix, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad timestamp", ErrBadCredentials)
+	}
+	if skew := h.now().Sub(time.Unix(unix, 0)); skew > MaxSkew || skew < -MaxSkew {
+		return nil, fmt.Errorf("%w: timestamp off by %s", ErrBadCredentials, skew.Round(time.Second))
+	}
+
+	var body []byte
+	if r.Body != nil {
+		// Handler put it in memory, it's read again from there
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	uri := r.RequestURI
+	if len(uri) == 0 {
+		uri = r.URL.RequestURI()
+	}
+
+	want := signature(key.secret, r.Method, uri, fields["Timestamp"], body)
+	if !hmac.Equal([]byte(want), []byte(fields["Signature"])) {
+		return nil, fmt.Errorf("%w: bad signature", ErrBadCredentials)
+	}
+
+	return key.principal, nil
+}
+
+// ClientCerts authenticates requests by the client certificate they came
+// with, once the listener verified it, going by its subject's common name
+type ClientCerts struct {
+	byName map[string]*Principal
+}
+
+// NewClientCerts returns an empty ClientCerts, see Add
+func NewClientCerts() *ClientCerts {
+	return &ClientCerts{byName: make(map[string]*Principal)}
+}
+
+// Add lets requests with a certificate for commonName in as p
+func (c *ClientCerts) Add(commonName string, p *Principal) {
+	c.byName[commonName] = p
+}
+
+// Authenticate implements Authenticator, certificates it doesn't know
+// leave it to the others
+func (c *ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	if p, ok := c.byName[r.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+		return p, nil
+	}
+	return nil, ErrNoCredentials
+}
@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Leeway is how much clock skew exp and nbf allow for
+const Leeway = time.Minute
+
+// JWT authenticates "Authorization: Bearer <jwt>" against the keys of a
+// JWKS. The token must expire, the principal is its sub and its scope
+// claim, space separated, or scp, a list, holds the scopes. A tenant claim
+// keeps it to that tenant's keys.
+type JWT struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// jwk is the bits of a JSON Web Key RSA and EC keys need
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewJWT returns a JWT checking tokens against the keys in the JWKS at
+// path. Tokens must come from issuer and be meant for audience, unless
+// they're empty.
+func NewJWT(path, issuer, audience string) (*JWT, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("auth: %s: %s", path, err)
+	}
+
+	j := &JWT{keys: make(map[string]crypto.PublicKey), issuer: issuer, audience: audience, now: time.Now}
+	for _, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("auth: %s: key %q: %s", path, k.Kid, err)
+		}
+		j.keys[k.Kid] = key
+	}
+
+	if len(j.keys) == 0 {
+		return nil, fmt.Errorf("auth: %s: no signing keys", path)
+	}
+
+	return j, nil
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// looksLikeJWT tells JWTs from static tokens, so Tokens leaves them be
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// claims are the claims JWT looks at
+type claims struct {
+	Sub    string          `json:"sub"`
+	Iss    string          `json:"iss"`
+	Aud    json.RawMessage `json:"aud"`
+	Exp    *int64          `json:"exp"`
+	Nbf    *int64          `json:"nbf"`
+	Scope  string          `json:"scope"`
+	Scp    []string        `json:"scp"`
+	Tenant string          `json:"tenant"`
+}
+
+// hasAudience tells whether aud, a string or a list, has audience
+func (c claims) hasAudience(audience string) bool {
+	var one string
+	if json.Unmarshal(c.Aud, &one) == nil {
+		return one == audience
+	}
+
+	var many []string
+	json.Unmarshal(c.Aud, &many)
+	for _, aud := range many {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks sig is key's signature of signed by alg
+func verify(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return fmt.Errorf("alg %q with an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return fmt.Errorf("alg %q with an EC key", alg)
+		}
+
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+// Authenticate implements Authenticator
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || !looksLikeJWT(token) {
+		return nil, ErrNoCredentials
+	}
+
+	p, err := j.parse(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: jwt: %s", ErrBadCredentials, err)
+	}
+	return p, nil
+}
+
+func (j *JWT) parse(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	data, err := b64(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	key, ok := j.keys[header.Kid]
+	if len(header.Kid) == 0 && len(j.keys) == 1 {
+		for _, key = range j.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+
+	sig, err := b64(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var c claims
+	if data, err = b64(parts[1]); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+
+	now := j.now()
+	if c.Exp == nil {
+		return nil, errors.New("no exp")
+	}
+	if now.After(time.Unix(*c.Exp, 0).Add(Leeway)) {
+		return nil, errors.New("expired")
+	}
+	if c.Nbf != nil && now.Before(time.Unix(*c.Nbf, 0).Add(-Leeway)) {
+		return nil, errors.New("not valid yet")
+	}
+	if len(j.issuer) > 0 && c.Iss != j.issuer {
+		return nil, fmt.Errorf("issuer %q", c.Iss)
+	}
+	if len(j.audience) > 0 && !c.hasAudience(j.audience) {
+		return nil, errors.New("not meant for us")
+	}
+
+	scopes := c.Scp
+	if len(c.Scope) > 0 {
+		scopes = strings.Fields(c.Scope)
+	}
+
+	// Scopes meant for other services are none of our business
+	var ours []string
+	for _, scope := range scopes {
+		if _, err := ParseScopes([]string{scope}); err == nil {
+			ours = append(ours, scope)
+		}
+	}
+	grants, _ := ParseScopes(ours)
+
+	return &Principal{Name: c.Sub, Grants: grants, Tenant: c.Tenant}, nil
+}
@@ -0,0 +1,216 @@
+package gostorm
+
+import (
+	"strconv"
+	"time"
+)
+
+// batch is how a batch operation calls a driver: all keys at once if
+// batched says it can, one key at a time with single otherwise
+type batch struct {
+	batched func(Driver) bool
+	all     func(Driver) (map[string]string, map[string]error)
+	single  func(key string) func(Driver, chan string, chan error)
+}
+
+// keyOutcome is what a single driver made of one key of a batch
+type keyOutcome struct {
+	backend *backend
+	key     string
+	ret     string
+	err     *DriverError
+}
+
+// tally is how a key of a batch is doing
+type tally struct {
+	values   []string
+	multiErr *MultiError
+	answered map[*backend]bool
+	decided  bool
+}
+
+// anyBatched tells whether any of targets can take a batch in one call
+func anyBatched(targets []*backend, batched func(Driver) bool) bool {
+	for _, b := range targets {
+		if batched(b.driver) {
+			return true
+		}
+	}
+	return false
+}
+
+// fanOutBatch is fanOut for many keys at once. Drivers that can take the
+// batch get a single call, the others a call a key, and every key needs as
+// many successes as policy requires, just like on its own. It returns the
+// values agreed on and an error, a *MultiError when drivers failed, for
+// every key that didn't make it.
+func (gs *Gostorm) fanOutBatch(parent scope, op Op, policy Consistency, keys []string, call batch, timeout time.Duration) (map[string]string, map[string]error) {
+	values := make(map[string]string)
+	errs := make(map[string]error)
+
+	fail := func(err error) (map[string]string, map[string]error) {
+		for _, key := range keys {
+			errs[key] = err
+		}
+		return values, errs
+	}
+
+	targets := parent.tenant.only(gs.targets(op))
+	if len(targets) == 0 {
+		return fail(ErrNoDrivers)
+	}
+
+	calls := 0
+	for _, b := range targets {
+		if call.batched(b.driver) {
+			calls++
+		} else {
+			calls += len(keys)
+		}
+	}
+	if err := gs.enter(calls); err != nil {
+		return fail(err)
+	}
+
+	required := policy.required(len(targets))
+	outChan := make(chan keyOutcome, len(targets)*len(keys))
+	deadline := gs.clock.Now().Add(timeout)
+
+	for _, b := range targets {
+		if call.batched(b.driver) {
+			go func(b *backend) {
+				defer gs.pending.Done()
+				gs.doBatch(parent, b, op, keys, call, deadline, outChan)
+			}(b)
+			continue
+		}
+
+		for _, key := range keys {
+			go func(b *backend, key string) {
+				defer gs.pending.Done()
+
+				single := make(chan outcome, 1)
+				gs.do(parent, b, op, call.single(key), deadline, single)
+				out := <-single
+				outChan <- keyOutcome{backend: b, key: key, ret: out.ret, err: out.err}
+			}(b, key)
+		}
+	}
+
+	tallies := make(map[string]*tally)
+	for _, key := range keys {
+		tallies[key] = &tally{multiErr: &MultiError{}, answered: make(map[*backend]bool)}
+	}
+
+	left := len(tallies)
+	timeoutChan := gs.clock.After(timeout)
+
+	for left > 0 {
+		select {
+		case out := <-outChan:
+			t := tallies[out.key]
+			if t.decided {
+				continue
+			}
+			t.answered[out.backend] = true
+
+			if out.err != nil {
+				t.multiErr.Errors = append(t.multiErr.Errors, out.err)
+				if len(t.multiErr.Errors) > len(targets)-required {
+					errs[out.key] = t.multiErr
+					t.decided = true
+					left--
+				}
+				continue
+			}
+
+			t.values = append(t.values, out.ret)
+			if len(t.values) == 1 && op.read() {
+				if m, ok := gs.metrics.(ReadMetrics); ok {
+					m.ReadWon(out.backend.status.Name, op)
+				}
+			}
+			if len(t.values) == required {
+				values[out.key] = majority(t.values)
+				t.decided = true
+				left--
+			}
+		case <-timeoutChan:
+			// Whoever hasn't answered for a key by now timed out on it
+			for key, t := range tallies {
+				if t.decided {
+					continue
+				}
+				for _, b := range targets {
+					if !t.answered[b] {
+						t.multiErr.Errors = append(t.multiErr.Errors, b.err(op, ErrTimeout))
+					}
+				}
+				errs[key] = t.multiErr
+			}
+			left = 0
+		}
+	}
+
+	return values, errs
+}
+
+// doBatch makes a single batch call to a driver, without retries, telling
+// outChan what came of every key
+func (gs *Gostorm) doBatch(parent scope, b *backend, op Op, keys []string, call batch, deadline time.Time, outChan chan keyOutcome) {
+	if b.timeout > 0 {
+		if budget := gs.clock.Now().Add(b.timeout); budget.Before(deadline) {
+			deadline = budget
+		}
+	}
+
+	span, drv := gs.startCall(parent, b, op, 1)
+	span.SetAttr("batch.keys", strconv.Itoa(len(keys)))
+	if !call.batched(drv) {
+		drv = b.driver
+	}
+
+	type result struct {
+		values map[string]string
+		errs   map[string]error
+	}
+	resChan := make(chan result, 1)
+
+	start := gs.clock.Now()
+	b.started()
+	go func() {
+		defer b.finished()
+		values, errs := call.all(drv)
+		resChan <- result{values, errs}
+	}()
+
+	var (
+		res result
+		err error
+	)
+	select {
+	case res = <-resChan:
+	case <-gs.clock.After(deadline.Sub(start)):
+		err = ErrTimeout
+	}
+
+	elapsed := gs.clock.Now().Sub(start)
+	gs.metrics.ObserveDriver(driverName(b.driver), op, elapsed, err)
+	b.observe(err, elapsed, gs.clock.Now())
+	span.End(err)
+
+	if err != nil {
+		parent.log.Debug("driver failed", "driver", b.status.Name, "op", op, "keys", len(keys), "err", err)
+	}
+
+	for _, key := range keys {
+		out := keyOutcome{backend: b, key: key, ret: res.values[key]}
+		switch {
+		case err != nil:
+			out.err = b.err(op, err)
+		case res.errs[key] != nil:
+			out.err = b.err(op, res.errs[key])
+		}
+		outChan <- out
+	}
+}
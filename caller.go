@@ -0,0 +1,53 @@
+package gostorm
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// errNotInstrumented means CallerFor got a request Instrument never saw, so
+// there's no telling its tenant
+var errNotInstrumented = errors.New("gostorm: request not served through Instrument")
+
+// Caller runs operations for a request served through Instrument, as part of
+// its trace and on behalf of its tenant, like the HTTP API does
+type Caller struct {
+	gs *Gostorm
+	o  origin
+}
+
+// CallerFor returns the Caller for r. It fails with ErrUnknownTenant or
+// ErrThrottled when r's tenant can't have it.
+func (gs *Gostorm) CallerFor(r *http.Request) (*Caller, error) {
+	o, ok := context.Get(r, originKey{}).(origin)
+	if !ok {
+		return nil, errNotInstrumented
+	}
+	if err, _ := context.Get(r, admissionKey{}).(error); err != nil {
+		return nil, err
+	}
+	return &Caller{gs: gs, o: o}, nil
+}
+
+// Get is GetWithTimeout for the call
+func (c *Caller) Get(key string, timeout time.Duration) (string, error) {
+	return c.gs.get(c.o, key, timeout)
+}
+
+// SetWithTTL is SetWithTTLTimeout for the call, a ttl of 0 never expires
+func (c *Caller) SetWithTTL(key, value string, ttl, timeout time.Duration) error {
+	return c.gs.setWithTTL(c.o, key, value, ttl, timeout)
+}
+
+// Delete is DeleteWithTimeout for the call
+func (c *Caller) Delete(key string, timeout time.Duration) error {
+	return c.gs.delete(c.o, key, timeout)
+}
+
+// Watch is Watch for the call, kept to its tenant's keys
+func (c *Caller) Watch(prefix string) *Watcher {
+	return c.gs.watches.add(c.o.tenant, prefix)
+}
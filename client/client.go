@@ -0,0 +1,794 @@
+// Package client talks to gostorm servers over their HTTP API. It keeps
+// connections alive, retries what's worth retrying and fails over from one
+// server to the next.
+//
+// Errors from the server come back as *Error, which errors.Is matches
+// against gostorm.ErrNotFound and friends, so gostorm.IsNotFound works on
+// them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/auth"
+)
+
+// DefaultTimeout is the budget of a call whose context has no deadline
+const DefaultTimeout = 5 * time.Second
+
+const (
+	// defaultCooldown is how long a failed server is tried last
+	defaultCooldown = 5 * time.Second
+
+	maxIdleConnsPerHost = 32
+	idleConnTimeout     = 90 * time.Second
+
+	// maxBatchKeys matches what the server takes in one batch call
+	maxBatchKeys = 1000
+)
+
+// ErrNoServers means New was given no servers
+var ErrNoServers = errors.New("client: no servers")
+
+// Error is an error response from a server
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is matches the error against gostorm.ErrNotFound, ErrTimeout,
+// ErrNoDrivers, ErrShutdown, ErrUnsupported, ErrQuotaExceeded and
+// ErrUnknownTenant
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case "not_found":
+		return target == gostorm.ErrNotFound
+	case "timeout":
+		return target == gostorm.ErrTimeout
+	case "no_drivers":
+		return target == gostorm.ErrNoDrivers
+	case "shutting_down":
+		return target == gostorm.ErrShutdown
+	case "unsupported":
+		return target == gostorm.ErrUnsupported
+	case "quota_exceeded":
+		return target == gostorm.ErrQuotaExceeded
+	case "unknown_tenant":
+		return target == gostorm.ErrUnknownTenant
+	}
+	return false
+}
+
+// codeFor guesses the error code of a response that didn't say
+func codeFor(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return "timeout"
+	case http.StatusServiceUnavailable:
+		return "no_drivers"
+	case http.StatusNotImplemented:
+		return "unsupported"
+	case http.StatusInsufficientStorage:
+		return "quota_exceeded"
+	}
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// statusFor is the status code matching an error code from a batch call
+func statusFor(code string) int {
+	switch code {
+	case "not_found":
+		return http.StatusNotFound
+	case "timeout":
+		return http.StatusGatewayTimeout
+	case "no_drivers", "shutting_down":
+		return http.StatusServiceUnavailable
+	case "unsupported":
+		return http.StatusNotImplemented
+	case "quota_exceeded":
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusBadGateway
+}
+
+// errorFor reads an error response, the server wraps errors in a JSON
+// envelope but whatever is in front of it might not
+func errorFor(status int, body []byte) *Error {
+	envelope := struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Error.Code) == 0 {
+		return &Error{StatusCode: status, Code: codeFor(status), Message: strings.TrimSpace(string(body))}
+	}
+
+	return &Error{StatusCode: status, Code: envelope.Error.Code, Message: envelope.Error.Message}
+}
+
+// Client for a set of gostorm servers, safe for concurrent use
+type Client struct {
+	servers  []*server
+	http     *http.Client
+	timeout  time.Duration
+	retry    gostorm.RetryPolicy
+	cooldown time.Duration
+
+	tls *tls.Config
+
+	// token or HMAC key, see WithToken and WithHMAC
+	token  string
+	keyID  string
+	secret []byte
+
+	// tenant is the namespace calls are for, see WithTenant
+	tenant string
+
+	// noBatch is set once the servers turn out not to have batch endpoints
+	noBatch int32
+}
+
+// server is one of the servers, downUntil being when it may be tried first
+// again, in unix nanoseconds
+type server struct {
+	base      *url.URL
+	downUntil int64
+}
+
+// Option configures a Client, pass them to New
+type Option func(*Client)
+
+// WithTimeout sets the budget of calls whose context has no deadline
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetry sets how failed calls are retried, MaxAttempts counting rounds
+// through the whole server list. By default connection errors and 502, 503
+// and 504 responses are retried, set Retryable to change that.
+func WithRetry(policy gostorm.RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithCooldown sets how long a server that failed is tried after the others
+func WithCooldown(cooldown time.Duration) Option {
+	return func(c *Client) {
+		c.cooldown = cooldown
+	}
+}
+
+// WithHTTPClient sets the http.Client used, e.g. for custom TLS settings
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithTLS sets the TLS config of https servers, e.g. for a private CA or
+// a client certificate, see tlsconfig.FromQuery. WithHTTPClient overrides it.
+func WithTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tls = config
+	}
+}
+
+// WithToken sends token with every call, "Authorization: Bearer <token>".
+// A token works as the password of a server URL too, "http://:<token>@host".
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHMAC signs every call with secret under keyID, see auth.Sign
+func WithHMAC(keyID string, secret []byte) Option {
+	return func(c *Client) {
+		c.keyID = keyID
+		c.secret = secret
+	}
+}
+
+// WithTenant makes every call for tenant, its keys being those of the
+// tenant's namespace. A server with auth decides the tenant itself, from
+// the credentials.
+func WithTenant(tenant string) Option {
+	return func(c *Client) {
+		c.tenant = tenant
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan makes calls made with ctx part of the trace sc, the
+// server being told in the traceparent header
+func ContextWithSpan(ctx context.Context, sc gostorm.SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// New returns a Client for servers like "http://gostorm-1:8080", tried in
+// that order
+func New(servers []string, opts ...Option) (*Client, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	c := &Client{
+		timeout:  DefaultTimeout,
+		retry:    gostorm.DefaultRetryPolicy,
+		cooldown: defaultCooldown,
+	}
+
+	for _, s := range servers {
+		base, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if base.Scheme != "http" && base.Scheme != "https" {
+			return nil, fmt.Errorf("client: bad scheme %q in %q", base.Scheme, s)
+		}
+
+		base.RawQuery = ""
+		base.Path = strings.TrimSuffix(base.Path, "/")
+		base.RawPath = ""
+		c.servers = append(c.servers, &server{base: base})
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.http == nil {
+		c.http = &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			IdleConnTimeout:     idleConnTimeout,
+			TLSClientConfig:     c.tls,
+			ForceAttemptHTTP2:   true,
+		}}
+	}
+
+	return c, nil
+}
+
+// Close closes idle connections, the Client can still be used afterwards
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// ordered returns the servers in the order to try them: the ones that
+// haven't failed lately first
+func (c *Client) ordered() []*server {
+	now := time.Now().UnixNano()
+
+	up := make([]*server, 0, len(c.servers))
+	var down []*server
+
+	for _, s := range c.servers {
+		if atomic.LoadInt64(&s.downUntil) > now {
+			down = append(down, s)
+		} else {
+			up = append(up, s)
+		}
+	}
+
+	return append(up, down...)
+}
+
+// retryable tells whether err is worth trying another server for
+func (c *Client) retryable(err error) bool {
+	if c.retry.Retryable != nil {
+		return c.retry.Retryable(err)
+	}
+
+	var cerr *Error
+	if errors.As(err, &cerr) {
+		switch cerr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var uerr *url.Error
+	return gostorm.IsTransient(err) || errors.As(err, &uerr)
+}
+
+// request is a call to make, to whichever server
+type request struct {
+	method      string
+	path        string
+	rawPath     string
+	query       url.Values
+	body        []byte
+	contentType string
+}
+
+// do makes the call, going through the servers until one answers or the
+// retry policy gives up
+func (c *Client) do(ctx context.Context, req request) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	rounds := max(c.retry.MaxAttempts, 1)
+
+	var lastErr error
+	for round := 1; round <= rounds; round++ {
+		for _, s := range c.ordered() {
+			data, err := c.send(ctx, s, req)
+			if err == nil {
+				atomic.StoreInt64(&s.downUntil, 0)
+				return data, nil
+			}
+
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !c.retryable(err) {
+				return nil, err
+			}
+
+			atomic.StoreInt64(&s.downUntil, time.Now().Add(c.cooldown).UnixNano())
+			lastErr = err
+		}
+
+		if round == rounds {
+			break
+		}
+
+		select {
+		case <-time.After(c.retry.Backoff(round)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, lastErr
+}
+
+// send makes the call to a single server
+func (c *Client) send(ctx context.Context, s *server, req request) ([]byte, error) {
+	u := *s.base
+	u.Path += req.path
+	if len(req.rawPath) > 0 {
+		u.RawPath = s.base.EscapedPath() + req.rawPath
+	}
+	if req.query != nil {
+		u.RawQuery = req.query.Encode()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, req.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.contentType) > 0 {
+		hreq.Header.Set("Content-Type", req.contentType)
+	}
+
+	switch {
+	case len(c.keyID) > 0:
+		auth.Sign(hreq, req.body, c.keyID, c.secret)
+	case len(c.token) > 0:
+		hreq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	if len(c.tenant) > 0 {
+		hreq.Header.Set(gostorm.TenantHeader, c.tenant)
+	}
+
+	if sc, ok := ctx.Value(spanKey{}).(gostorm.SpanContext); ok && sc.IsValid() {
+		hreq.Header.Set(gostorm.TraceparentHeader, sc.Traceparent())
+	}
+
+	// Let the server know how long we'll wait, so it doesn't try for longer
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := max(time.Until(deadline).Milliseconds(), 1)
+		hreq.Header.Set(gostorm.TimeoutHeader, strconv.FormatInt(ms, 10))
+	}
+
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		return nil, errorFor(resp.StatusCode, data)
+	}
+
+	return data, nil
+}
+
+// keyRequest is a call on a single key, escaped so any key survives the trip
+func keyRequest(method, key string) request {
+	return request{method: method, path: "/v1/keys/" + key, rawPath: "/v1/keys/" + url.PathEscape(key)}
+}
+
+// Get gets the value of key
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	data, err := c.do(ctx, keyRequest("GET", key))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Set sets key to value
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	req := keyRequest("PUT", key)
+	req.body = []byte(value)
+	req.contentType = "application/octet-stream"
+
+	_, err := c.do(ctx, req)
+	return err
+}
+
+// Delete deletes key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, keyRequest("DELETE", key))
+	return err
+}
+
+// List returns the keys starting with prefix
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	data, err := c.do(ctx, request{method: "GET", path: "/v1/keys", query: url.Values{"prefix": {prefix}}})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Keys []string `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Keys, nil
+}
+
+// batchResponse is what batch calls return
+type batchResponse struct {
+	Values map[string]string `json:"values"`
+	Errors map[string]struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// batch posts a batch call, telling whether the servers have the endpoint
+func (c *Client) batch(ctx context.Context, path string, v interface{}) (*batchResponse, bool, error) {
+	if atomic.LoadInt32(&c.noBatch) == 1 {
+		return nil, false, nil
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, true, err
+	}
+
+	data, err := c.do(ctx, request{method: "POST", path: path, body: body, contentType: "application/json"})
+
+	var cerr *Error
+	if errors.As(err, &cerr) && (cerr.StatusCode == http.StatusNotFound || cerr.StatusCode == http.StatusMethodNotAllowed) {
+		// No batch endpoints there, don't bother asking again
+		atomic.StoreInt32(&c.noBatch, 1)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	resp := &batchResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, true, err
+	}
+
+	return resp, true, nil
+}
+
+// GetMulti gets many keys, in as few round trips as the servers allow. It
+// returns the values found and an error for every key that wasn't.
+func (c *Client) GetMulti(ctx context.Context, keys []string) (map[string]string, map[string]error) {
+	values := make(map[string]string)
+	errs := make(map[string]error)
+
+	for start := 0; start < len(keys); start += maxBatchKeys {
+		chunk := keys[start:min(start+maxBatchKeys, len(keys))]
+
+		resp, ok, err := c.batch(ctx, "/v1/mget", map[string][]string{"keys": chunk})
+		if !ok {
+			// One at a time then, this chunk and the rest
+			for _, key := range keys[start:] {
+				if value, err := c.Get(ctx, key); err != nil {
+					errs[key] = err
+				} else {
+					values[key] = value
+				}
+			}
+			break
+		}
+
+		if err != nil {
+			for _, key := range chunk {
+				errs[key] = err
+			}
+			continue
+		}
+
+		for key, value := range resp.Values {
+			values[key] = value
+		}
+		for key, e := range resp.Errors {
+			errs[key] = &Error{StatusCode: statusFor(e.Code), Code: e.Code, Message: e.Message}
+		}
+	}
+
+	return values, errs
+}
+
+// SetMulti sets many keys, in as few round trips as the servers allow. It
+// returns an error for every key that couldn't be set.
+func (c *Client) SetMulti(ctx context.Context, values map[string]string) map[string]error {
+	errs := make(map[string]error)
+
+	chunk := make(map[string]string)
+	flush := func() {
+		defer func() { chunk = make(map[string]string) }()
+
+		resp, ok, err := c.batch(ctx, "/v1/mset", map[string]map[string]string{"values": chunk})
+		if !ok {
+			for key, value := range chunk {
+				if err := c.Set(ctx, key, value); err != nil {
+					errs[key] = err
+				}
+			}
+			return
+		}
+
+		if err != nil {
+			for key := range chunk {
+				errs[key] = err
+			}
+			return
+		}
+
+		for key, e := range resp.Errors {
+			errs[key] = &Error{StatusCode: statusFor(e.Code), Code: e.Code, Message: e.Message}
+		}
+	}
+
+	for key, value := range values {
+		chunk[key] = value
+		if len(chunk) == maxBatchKeys {
+			flush()
+		}
+	}
+	if len(chunk) > 0 {
+		flush()
+	}
+
+	return errs
+}
+
+// SetWithTTL sets key to value, expiring after ttl
+func (c *Client) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	req := keyRequest("PUT", key)
+	req.body = []byte(value)
+	req.contentType = "application/octet-stream"
+	req.query = url.Values{"ttl": {ttl.String()}}
+
+	_, err := c.do(ctx, req)
+	return err
+}
+
+// ttlRequest is a call on the TTL of a key
+func ttlRequest(method, key string) request {
+	return request{method: method, path: "/v1/ttl/" + key, rawPath: "/v1/ttl/" + url.PathEscape(key)}
+}
+
+// TTL returns how long key has left, gostorm.NoExpiry if it doesn't expire
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	data, err := c.do(ctx, ttlRequest("GET", key))
+	if err != nil {
+		return 0, err
+	}
+
+	resp := struct {
+		TTLMillis int64 `json:"ttl_ms"`
+	}{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	if resp.TTLMillis < 0 {
+		return gostorm.NoExpiry, nil
+	}
+	return time.Duration(resp.TTLMillis) * time.Millisecond, nil
+}
+
+// Expire changes the TTL of an existing key, zero meaning never
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	req := ttlRequest("PUT", key)
+	req.query = url.Values{"ttl": {ttl.String()}}
+
+	_, err := c.do(ctx, req)
+	return err
+}
+
+// Driver is how one of a server's drivers is doing
+type Driver struct {
+	Index             int                 `json:"index"`
+	Name              string              `json:"name"`
+	State             gostorm.DriverState `json:"state"`
+	Healthy           bool                `json:"healthy"`
+	Calls             uint64              `json:"calls"`
+	Errors            uint64              `json:"errors"`
+	ConsecutiveErrors uint64              `json:"consecutive_errors"`
+	LastError         string              `json:"last_error"`
+	LastErrorAt       time.Time           `json:"last_error_at"`
+	LastSuccessAt     time.Time           `json:"last_success_at"`
+	InFlight          int64               `json:"in_flight"`
+	LatencyMS         struct {
+		P50 float64 `json:"p50"`
+		P90 float64 `json:"p90"`
+		P99 float64 `json:"p99"`
+	} `json:"latency_ms"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Drivers returns how the drivers of the first server to answer are doing.
+// With several servers, give each its own Client to see them all.
+func (c *Client) Drivers(ctx context.Context) ([]Driver, error) {
+	data, err := c.do(ctx, request{method: "GET", path: "/v1/drivers"})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Drivers []Driver `json:"drivers"`
+	}{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Drivers, nil
+}
+
+// SetDriverState changes which calls the driver at index gets
+func (c *Client) SetDriverState(ctx context.Context, index int, state gostorm.DriverState) (*Driver, error) {
+	body, err := json.Marshal(map[string]gostorm.DriverState{"state": state})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.do(ctx, request{
+		method:      "PUT",
+		path:        "/v1/drivers/" + strconv.Itoa(index),
+		body:        body,
+		contentType: "application/json",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	drv := &Driver{}
+	if err := json.Unmarshal(data, drv); err != nil {
+		return nil, err
+	}
+
+	return drv, nil
+}
+
+// DriverValue is what a single driver has for a key. Neither Value nor
+// Error is set if the driver doesn't have it.
+type DriverValue struct {
+	Index int     `json:"index"`
+	Name  string  `json:"name"`
+	Value *string `json:"value"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Inspection is what every driver has for a key
+type Inspection struct {
+	Key        string        `json:"key"`
+	Consistent bool          `json:"consistent"`
+	Drivers    []DriverValue `json:"drivers"`
+}
+
+// Inspect asks every driver of the server for key on its own, to see
+// whether they agree
+func (c *Client) Inspect(ctx context.Context, key string) (*Inspection, error) {
+	data, err := c.do(ctx, request{method: "GET", path: "/v1/inspect/" + key, rawPath: "/v1/inspect/" + url.PathEscape(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Inspection{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Tenant is how much a tenant of a server uses
+type Tenant struct {
+	Name        string   `json:"name"`
+	Prefix      string   `json:"prefix"`
+	Drivers     []string `json:"drivers"`
+	ReadPolicy  string   `json:"read_policy"`
+	WritePolicy string   `json:"write_policy"`
+	Keys        int64    `json:"keys"`
+	Bytes       int64    `json:"bytes"`
+	Requests    uint64   `json:"requests"`
+	Throttled   uint64   `json:"throttled"`
+	OverQuota   uint64   `json:"over_quota"`
+	Quota       struct {
+		MaxKeys  int64   `json:"max_keys"`
+		MaxBytes int64   `json:"max_bytes"`
+		Rate     float64 `json:"rate"`
+		Burst    int     `json:"burst"`
+	} `json:"quota"`
+}
+
+// Tenants returns how much each tenant of the first server to answer uses.
+// Every server counts on its own, give each its own Client to add them up.
+func (c *Client) Tenants(ctx context.Context) ([]Tenant, error) {
+	data, err := c.do(ctx, request{method: "GET", path: "/v1/tenants"})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Tenants []Tenant `json:"tenants"`
+	}{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Tenants, nil
+}
@@ -0,0 +1,294 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/auth"
+)
+
+// stubServer answers every request with handler, counting them by path
+type stubServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func serve(t *testing.T, handler http.HandlerFunc) *stubServer {
+	t.Helper()
+
+	s := &stubServer{calls: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls[r.URL.Path]++
+		s.mu.Unlock()
+
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+// status answers every request with code and body
+func status(code int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	}
+}
+
+func newClient(t *testing.T, servers []string, opts ...Option) *Client {
+	t.Helper()
+
+	c, err := New(servers, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFailover(t *testing.T) {
+	down := serve(t, status(http.StatusServiceUnavailable, ""))
+	up := serve(t, status(http.StatusOK, "v"))
+
+	c := newClient(t, []string{down.URL, up.URL}, WithRetry(gostorm.RetryPolicy{MaxAttempts: 1}), WithCooldown(time.Hour))
+
+	for i := 0; i < 3; i++ {
+		if value, err := c.Get(context.Background(), "k"); err != nil || value != "v" {
+			t.Fatalf("got %q, %v", value, err)
+		}
+	}
+
+	// Cooling down, it's tried after the one that works
+	if n := down.count("/v1/keys/k"); n != 1 {
+		t.Errorf("the failed server got %d calls, want 1", n)
+	}
+	if n := up.count("/v1/keys/k"); n != 3 {
+		t.Errorf("the working server got %d calls, want 3", n)
+	}
+}
+
+func TestCooldownEnds(t *testing.T) {
+	var failing sync.Mutex
+	broken := true
+	flaky := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		failing.Lock()
+		defer failing.Unlock()
+
+		if broken {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "flaky")
+	})
+	other := serve(t, status(http.StatusOK, "other"))
+
+	c := newClient(t, []string{flaky.URL, other.URL}, WithRetry(gostorm.RetryPolicy{MaxAttempts: 1}), WithCooldown(20*time.Millisecond))
+
+	if value, _ := c.Get(context.Background(), "k"); value != "other" {
+		t.Fatalf("got %q from a broken first server, want other", value)
+	}
+
+	failing.Lock()
+	broken = false
+	failing.Unlock()
+
+	if value, _ := c.Get(context.Background(), "k"); value != "other" {
+		t.Errorf("got %q while cooling down, want other", value)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if value, _ := c.Get(context.Background(), "k"); value != "flaky" {
+		t.Errorf("got %q after the cooldown, want flaky", value)
+	}
+}
+
+func TestNoFailoverOnClientErrors(t *testing.T) {
+	missing := serve(t, status(http.StatusNotFound, ""))
+	other := serve(t, status(http.StatusOK, "v"))
+
+	c := newClient(t, []string{missing.URL, other.URL})
+
+	if _, err := c.Get(context.Background(), "k"); !errors.Is(err, gostorm.ErrNotFound) {
+		t.Errorf("got %v, want not found", err)
+	}
+	if n := other.count("/v1/keys/k"); n != 0 {
+		t.Errorf("a 404 was failed over, the other server got %d calls", n)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		is     error
+	}{
+		{"404", http.StatusNotFound, "", gostorm.ErrNotFound},
+		{"404 in an envelope", http.StatusNotFound, `{"error": {"code": "not_found", "message": "not found"}}`, gostorm.ErrNotFound},
+		{"504", http.StatusGatewayTimeout, "upstream timed out", gostorm.ErrTimeout},
+		{"507", http.StatusInsufficientStorage, "", gostorm.ErrQuotaExceeded},
+		{"507 in an envelope", http.StatusInsufficientStorage, `{"error": {"code": "quota_exceeded", "message": "quota"}}`, gostorm.ErrQuotaExceeded},
+		{"501", http.StatusNotImplemented, "", gostorm.ErrUnsupported},
+		{"unknown tenant", http.StatusForbidden, `{"error": {"code": "unknown_tenant", "message": "who"}}`, gostorm.ErrUnknownTenant},
+		{"500", http.StatusInternalServerError, "oops", nil},
+	}
+
+	known := []error{gostorm.ErrNotFound, gostorm.ErrTimeout, gostorm.ErrQuotaExceeded, gostorm.ErrUnsupported, gostorm.ErrUnknownTenant}
+
+	for _, test := range tests {
+		s := serve(t, status(test.status, test.body))
+		c := newClient(t, []string{s.URL}, WithRetry(gostorm.RetryPolicy{MaxAttempts: 1}))
+
+		_, err := c.Get(context.Background(), "k")
+
+		var cerr *Error
+		if !errors.As(err, &cerr) || cerr.StatusCode != test.status {
+			t.Errorf("%s: got %v, want an *Error with status %d", test.name, err, test.status)
+			continue
+		}
+		for _, target := range known {
+			if want := target == test.is; errors.Is(err, target) != want {
+				t.Errorf("%s: errors.Is(%v, %v) is %v", test.name, err, target, !want)
+			}
+		}
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	hmac := auth.NewHMAC()
+	hmac.Add("edge", []byte("secret"), &auth.Principal{Name: "edge"})
+
+	var body []byte
+	s := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := hmac.Authenticate(r); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	c := newClient(t, []string{s.URL}, WithHMAC("edge", []byte("secret")))
+	if err := c.Set(context.Background(), "a/b c", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "v" {
+		t.Errorf("the server got %q", body)
+	}
+
+	c = newClient(t, []string{s.URL}, WithHMAC("edge", []byte("wrong")))
+	var cerr *Error
+	if err := c.Set(context.Background(), "k", "v"); !errors.As(err, &cerr) || cerr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a bad signature got %v, want a 401", err)
+	}
+}
+
+// keysOnly serves single keys from values but has no batch endpoints
+func keysOnly(values map[string]string) http.HandlerFunc {
+	var mu sync.Mutex
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key, ok := strings.CutPrefix(r.URL.Path, "/v1/keys/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			value, ok := values[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, value)
+		case "PUT":
+			data, _ := io.ReadAll(r.Body)
+			values[key] = string(data)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	values := map[string]string{"a": "1"}
+	s := serve(t, keysOnly(values))
+	c := newClient(t, []string{s.URL})
+
+	if errs := c.SetMulti(context.Background(), map[string]string{"b": "2", "c": "3"}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, errs := c.GetMulti(context.Background(), []string{"a", "b", "c", "d"})
+		if len(got) != 3 || got["a"] != "1" || got["b"] != "2" || got["c"] != "3" {
+			t.Errorf("got %v", got)
+		}
+		if len(errs) != 1 || !errors.Is(errs["d"], gostorm.ErrNotFound) {
+			t.Errorf("got errors %v, want d not found", errs)
+		}
+	}
+
+	// Asked once, the missing endpoint isn't asked for again
+	if n := s.count("/v1/mset") + s.count("/v1/mget"); n != 1 {
+		t.Errorf("the batch endpoints got %d calls, want 1", n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/mget":
+			io.WriteString(w, `{"values": {"a": "1"}, "errors": {"b": {"code": "not_found"}, "c": {"code": "timeout"}}}`)
+		case "/v1/mset":
+			io.WriteString(w, `{"errors": {"k0": {"code": "quota_exceeded"}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	c := newClient(t, []string{s.URL})
+
+	values, errs := c.GetMulti(context.Background(), []string{"a", "b", "c"})
+	if len(values) != 1 || values["a"] != "1" {
+		t.Errorf("got %v", values)
+	}
+	if !errors.Is(errs["b"], gostorm.ErrNotFound) || !errors.Is(errs["c"], gostorm.ErrTimeout) {
+		t.Errorf("got errors %v", errs)
+	}
+
+	// Too many for one call, it's split up
+	many := make(map[string]string)
+	for i := 0; i < maxBatchKeys+1; i++ {
+		many[fmt.Sprintf("k%d", i)] = "v"
+	}
+	setErrs := c.SetMulti(context.Background(), many)
+	if !errors.Is(setErrs["k0"], gostorm.ErrQuotaExceeded) {
+		t.Errorf("got errors %v, want k0 over quota", setErrs)
+	}
+	if n := s.count("/v1/mset"); n != 2 {
+		t.Errorf("%d batch calls, want 2", n)
+	}
+	if s.count("/v1/keys/a") != 0 {
+		t.Error("fell back to single keys")
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 )
 
 const disapprovalLook string = "ಠ_ಠ"
 
 func ExitWithErr(err error) {
-	log.Fatal(err)
-	os.Exit(-1)
+	slog.Error("exiting", "err", err)
+	os.Exit(1)
 }
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/auth"
+	"github.com/wmgaca/gostorm/drivers/disk"
+	"github.com/wmgaca/gostorm/drivers/fs"
+	"github.com/wmgaca/gostorm/drivers/mem"
+	"github.com/wmgaca/gostorm/drivers/redis"
+	"github.com/wmgaca/gostorm/drivers/upstream"
+	"github.com/wmgaca/gostorm/frontends/grpc"
+	"github.com/wmgaca/gostorm/frontends/memcached"
+	"github.com/wmgaca/gostorm/frontends/resp"
+	"github.com/wmgaca/gostorm/prometheus"
+	"github.com/wmgaca/gostorm/tlsconfig"
+	"github.com/wmgaca/gostorm/trace"
+)
+
+// driverOptionsFromEnv reads a driver's settings from the environment:
+// per-op retry policies from <PREFIX>_RETRY_GET / _SET / _DELETE, falling
+// back to <PREFIX>_RETRY and then DefaultRetryPolicy, and its timeout from
+// <PREFIX>_TIMEOUT
+func driverOptionsFromEnv(prefix string, timeout time.Duration) []gostorm.DriverOption {
+	opts := []gostorm.DriverOption{
+		gostorm.WithDriverTimeout(durationFromEnv(prefix+"_TIMEOUT", timeout)),
+	}
+
+	for _, op := range []gostorm.Op{gostorm.OpGet, gostorm.OpSet, gostorm.OpDelete} {
+		policy := gostorm.DefaultRetryPolicy
+
+		spec := os.Getenv(prefix + "_RETRY_" + strings.ToUpper(string(op)))
+		if len(spec) == 0 {
+			spec = os.Getenv(prefix + "_RETRY")
+		}
+
+		if len(spec) > 0 {
+			var err error
+			policy, err = gostorm.ParseRetryPolicy(spec)
+			if err != nil {
+				ExitWithErr(err)
+			}
+		}
+
+		opts = append(opts, gostorm.WithRetry(op, policy))
+	}
+
+	return opts
+}
+
+// withMiddlewareFromEnv wraps drv in the middleware listed in
+// <PREFIX>_MIDDLEWARE, metrics and trace going to metrics and tracer
+func withMiddlewareFromEnv(drv gostorm.Driver, prefix string, metrics gostorm.Metrics, tracer gostorm.Tracer) gostorm.Driver {
+	spec := os.Getenv(prefix + "_MIDDLEWARE")
+	if len(spec) == 0 {
+		return drv
+	}
+
+	mws, err := gostorm.ParseMiddleware(spec, slog.Default(), metrics, tracer)
+	if err != nil {
+		ExitWithErr(fmt.Errorf("%s_MIDDLEWARE: %s", prefix, err))
+	}
+
+	return gostorm.Chain(drv, mws...)
+}
+
+// consistencyFromEnv reads "one", "quorum" or "all" from the env var name
+func consistencyFromEnv(name string) gostorm.Consistency {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return gostorm.One
+	}
+
+	c, err := gostorm.ParseConsistency(value)
+	if err != nil {
+		ExitWithErr(fmt.Errorf("%s: %s", name, err))
+	}
+
+	return c
+}
+
+// durationFromEnv reads a duration like "500ms" from the env var name
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		ExitWithErr(fmt.Errorf("%s: %s", name, err))
+	}
+
+	return d
+}
+
+// loggerFromEnv sets up JSON logging at LOG_LEVEL, debug if DEBUG is set,
+// in LOG_FORMAT and with keys hashed if LOG_KEYS is "hash"
+func loggerFromEnv(debug bool) *slog.Logger {
+	cfg := gostorm.LogConfig{Level: slog.LevelInfo}
+
+	if value := os.Getenv("LOG_LEVEL"); len(value) > 0 {
+		level, err := gostorm.ParseLogLevel(value)
+		if err != nil {
+			ExitWithErr(fmt.Errorf("LOG_LEVEL: %s", err))
+		}
+		cfg.Level = level
+	}
+	if debug {
+		cfg.Level = slog.LevelDebug
+	}
+
+	switch os.Getenv("LOG_FORMAT") {
+	case "", "json":
+	case "text":
+		cfg.Text = true
+	default:
+		ExitWithErr(errors.New("LOG_FORMAT: want json or text"))
+	}
+
+	switch os.Getenv("LOG_KEYS") {
+	case "", "plain":
+	case "hash":
+		cfg.HashKeys = true
+	default:
+		ExitWithErr(errors.New("LOG_KEYS: want plain or hash"))
+	}
+
+	return gostorm.NewLogger(os.Stderr, cfg)
+}
+
+// tlsFromEnv makes server serve TLS with the key pair in TLS_CERT and
+// TLS_KEY, if they're set, asking for client certificates as
+// TLS_CLIENT_AUTH says and checking them against TLS_CLIENT_CA
+func tlsFromEnv(server *http.Server) *tlsconfig.Reloader {
+	certFile := os.Getenv("TLS_CERT")
+	if len(certFile) == 0 {
+		return nil
+	}
+
+	clientCA := os.Getenv("TLS_CLIENT_CA")
+
+	clientAuth := tls.NoClientCert
+	if len(clientCA) > 0 {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if value := os.Getenv("TLS_CLIENT_AUTH"); len(value) > 0 {
+		var err error
+		if clientAuth, err = tlsconfig.ParseClientAuth(value); err != nil {
+			ExitWithErr(fmt.Errorf("TLS_CLIENT_AUTH: %s", err))
+		}
+	}
+
+	config, reloader, err := tlsconfig.Server(certFile, os.Getenv("TLS_KEY"), clientCA, clientAuth)
+	if err != nil {
+		ExitWithErr(err)
+	}
+
+	// gRPC wants HTTP/2, which TLS negotiates
+	server.TLSConfig = config
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(false)
+
+	slog.Info("serving TLS", "cert", certFile, "client_auth", clientAuth.String())
+
+	return reloader
+}
+
+// shutdown stops taking requests, lets the ones in progress finish and
+// then shuts gs down, flushing traces and closing the drivers, all within
+// timeout
+func shutdown(gs *gostorm.Gostorm, server *http.Server, frontends []io.Closer, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// The frontends wait for the commands they're running on their own
+	var wg sync.WaitGroup
+	for _, frontend := range frontends {
+		wg.Add(1)
+		go func(frontend io.Closer) {
+			defer wg.Done()
+			frontend.Close()
+		}(frontend)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("http server didn't shut down cleanly", "err", err)
+	}
+	wg.Wait()
+
+	if err := gs.Shutdown(time.Until(deadline)); err != nil {
+		slog.Warn("gostorm didn't shut down cleanly", "err", err)
+	}
+}
+
+func main() {
+	debug := len(os.Getenv("DEBUG")) > 0
+
+	// Everything logs through it, the log package and drivers included
+	logger := loggerFromEnv(debug)
+	slog.SetDefault(logger)
+
+	logger.Info("starting gostorm", "debug", debug)
+
+	registry := prometheus.NewRegistry()
+
+	opts := []gostorm.Option{
+		gostorm.WithDebug(debug),
+		gostorm.WithLogger(logger),
+		gostorm.WithMetrics(registry),
+		gostorm.WithTimeout(durationFromEnv("GOSTORM_TIMEOUT", gostorm.DefaultTimeout)),
+		gostorm.WithReadPolicy(consistencyFromEnv("GOSTORM_READ_POLICY")),
+		gostorm.WithWritePolicy(consistencyFromEnv("GOSTORM_WRITE_POLICY")),
+	}
+
+	// Left nil without TRACE_URL, so the trace middleware can tell
+	var tracer gostorm.Tracer
+
+	traceConnString := os.Getenv("TRACE_URL")
+	if len(traceConnString) > 0 {
+		t, err := trace.FromURL(traceConnString)
+		if err != nil {
+			ExitWithErr(fmt.Errorf("TRACE_URL: %s", err))
+		}
+		tracer = t
+		opts = append(opts, gostorm.WithTracer(tracer))
+	}
+
+	tenantsConfig := os.Getenv("TENANTS_CONFIG")
+	if len(tenantsConfig) > 0 {
+		tenants, err := gostorm.LoadTenants(tenantsConfig)
+		if err != nil {
+			ExitWithErr(fmt.Errorf("TENANTS_CONFIG: %s", err))
+		}
+		for _, t := range tenants {
+			opts = append(opts, gostorm.WithTenant(t))
+		}
+		logger.Info("tenants loaded", "count", len(tenants))
+
+		// Without credentials the tenant is whatever the client says, or
+		// nothing, which is every tenant's keys. The memcached and redis
+		// frontends, which have no credentials, are kept out by auth.
+		if len(os.Getenv("AUTH_CONFIG")) == 0 {
+			ExitWithErr(errors.New("TENANTS_CONFIG needs AUTH_CONFIG, to tell which tenant a request is for"))
+		}
+	}
+
+	// The memcached and redis frontends can't check credentials, they'd
+	// give anyone every key
+	if len(os.Getenv("AUTH_CONFIG")) > 0 && (len(os.Getenv("MEMCACHED_LISTEN")) > 0 || len(os.Getenv("REDIS_LISTEN")) > 0) {
+		ExitWithErr(errors.New("AUTH_CONFIG can't go with MEMCACHED_LISTEN or REDIS_LISTEN, they have no auth"))
+	}
+
+	memConnString := os.Getenv("MEM_URL")
+	if len(memConnString) > 0 {
+		memDriver, err := mem.New(memConnString)
+		if err != nil {
+			ExitWithErr(err)
+		}
+		opts = append(opts, gostorm.WithDriver(withMiddlewareFromEnv(memDriver, "MEM", registry, tracer), driverOptionsFromEnv("MEM", 0)...))
+	}
+
+	diskConnString := os.Getenv("DISK_URL")
+	if len(diskConnString) > 0 {
+		diskDriver, err := disk.New(diskConnString)
+		if err != nil {
+			ExitWithErr(err)
+		}
+		opts = append(opts, gostorm.WithDriver(withMiddlewareFromEnv(diskDriver, "DISK", registry, tracer), driverOptionsFromEnv("DISK", 0)...))
+	}
+
+	fsConnString := os.Getenv("FS_URL")
+	if len(fsConnString) > 0 {
+		fsDriver, err := fs.New(fsConnString)
+		if err != nil {
+			ExitWithErr(err)
+		}
+		opts = append(opts, gostorm.WithDriver(withMiddlewareFromEnv(fsDriver, "FS", registry, tracer), driverOptionsFromEnv("FS", 0)...))
+	}
+
+	upstreamConnString := os.Getenv("UPSTREAM_URL")
+	if len(upstreamConnString) > 0 {
+		upstreamDriver, err := upstream.New(upstreamConnString)
+		if err != nil {
+			ExitWithErr(err)
+		}
+		opts = append(opts, gostorm.WithDriver(withMiddlewareFromEnv(upstreamDriver, "UPSTREAM", registry, tracer), driverOptionsFromEnv("UPSTREAM", 0)...))
+	}
+
+	redisConnString := os.Getenv("REDISTOGO_URL")
+	if len(redisConnString) == 0 {
+		logger.Info("no REDISTOGO_URL, running without redis")
+	} else {
+		redisDriver, err := redis.New(redisConnString)
+		if err == nil {
+			opts = append(opts, gostorm.WithDriver(withMiddlewareFromEnv(redisDriver, "REDIS", registry, tracer), driverOptionsFromEnv("REDIS", 0)...))
+		}
+	}
+
+	// memcachedConnString := os.Getenv("MEMCACHED_CONN_STRING")
+	// if len(memcachedConnString) == 0 {
+	// 	log.Println("Missing MEMCACHED_CONN_STRING env var, are we?")
+	// } else {
+	// 	memcachedDriver, err := memcache.New(memcachedConnString)
+	// 	if err == nil {
+	// 		opts = append(opts, gostorm.WithDriver(withMiddlewareFromEnv(memcachedDriver, "MEMCACHED", registry, tracer), driverOptionsFromEnv("MEMCACHED", 20*time.Millisecond)...))
+	// 	}
+	// }
+
+	gs := gostorm.New(opts...)
+
+	if len(tenantsConfig) > 0 {
+		// Keys written before we started count against quotas too
+		go func() {
+			if err := gs.CountUsage(durationFromEnv("TENANTS_COUNT_TIMEOUT", time.Minute)); err != nil {
+				logger.Warn("couldn't count every tenant's keys", "err", err)
+				return
+			}
+			logger.Info("counted tenants' keys")
+		}()
+	}
+
+	// MySQL
+	// mySqlConnString := os.Getenv("MYSQL_CONN_STRING")
+	// if len(mySqlConnString) == 0 {
+	// 	// return nil, errors.New("Missing MYSQL_CONN_STRING env var, are we?")
+	// }
+
+	var frontends []io.Closer
+
+	memcachedAddr := os.Getenv("MEMCACHED_LISTEN")
+	if len(memcachedAddr) > 0 {
+		logger.Info("running memcached frontend", "addr", memcachedAddr)
+		memcachedServer := memcached.NewServer(gs)
+		frontends = append(frontends, memcachedServer)
+		go func() {
+			if err := memcachedServer.ListenAndServe(memcachedAddr); err != memcached.ErrServerClosed {
+				ExitWithErr(err)
+			}
+		}()
+	}
+
+	redisAddr := os.Getenv("REDIS_LISTEN")
+	if len(redisAddr) > 0 {
+		logger.Info("running redis frontend", "addr", redisAddr)
+		redisServer := resp.NewServer(gs)
+		frontends = append(frontends, redisServer)
+		go func() {
+			if err := redisServer.ListenAndServe(redisAddr); err != resp.ErrServerClosed {
+				ExitWithErr(err)
+			}
+		}()
+	}
+
+	shutdownTimeout := durationFromEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	ServerAddr := ":" + os.Getenv("PORT")
+	logger.Info("running server", "addr", ServerAddr)
+
+	// gRPC shares the port, over HTTP/2 with or without TLS
+	apiHandler := gostorm.NewHandler(gs)
+	grpcHandler := grpc.NewHandler(gs)
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if grpc.IsGRPC(r) {
+			grpcHandler.ServeHTTP(w, r)
+			return
+		}
+		apiHandler.ServeHTTP(w, r)
+	}))
+	mux.Handle("/metrics", registry.Handler(gs))
+	// http.HandleFunc("/", homeHandler)
+
+	var handler http.Handler = mux
+
+	authConfig := os.Getenv("AUTH_CONFIG")
+	if len(authConfig) > 0 {
+		authenticator, err := auth.FromFile(authConfig)
+		if err != nil {
+			ExitWithErr(fmt.Errorf("AUTH_CONFIG: %s", err))
+		}
+		handler = auth.Handler(handler, authenticator, logger)
+		logger.Info("requests need credentials", "config", authConfig)
+	} else {
+		logger.Warn("no AUTH_CONFIG, anyone reaching the port can read and write every key")
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	server := &http.Server{Addr: ServerAddr, Handler: handler, Protocols: protocols}
+	// Watch streams would otherwise keep Shutdown waiting till the deadline
+	server.RegisterOnShutdown(gs.StopWatchers)
+
+	reloader := tlsFromEnv(server)
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			ExitWithErr(err)
+		}
+	}()
+
+	// Certificates are reloaded when they change, SIGHUP doesn't wait
+	if reloader != nil {
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		go func() {
+			for range hups {
+				if err := reloader.Reload(); err != nil {
+					logger.Error("keeping the old certificates", "err", err)
+				} else {
+					logger.Info("reloaded certificates")
+				}
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
+
+	// Asking twice means now
+	go func() {
+		<-signals
+		logger.Warn("exiting without waiting")
+		os.Exit(1)
+	}()
+
+	shutdown(gs, server, frontends, shutdownTimeout)
+	logger.Info("shut down")
+}
@@ -0,0 +1,459 @@
+// gostormctl talks to a gostorm server from the command line, run it
+// without arguments for help.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/client"
+	"github.com/wmgaca/gostorm/tlsconfig"
+)
+
+const usage = `Usage: gostormctl [flags] <command> [args]
+
+Commands:
+  get <key>                  print a value
+  set [-ttl 30s] <key> <value>
+                             set a value, "-" reads it from stdin
+  delete <key>               delete a key
+  ttl <key>                  print how long a key has left
+  expire <key> <ttl>         change a key's TTL, 0 means never
+  scan [prefix]              list keys
+  drivers                    show the drivers and how they're doing
+  driver <index> <state>     set a driver's state: active, writeonly or disabled
+  tenants                    show the tenants and how much they use
+  dump [-ttl] [prefix]       write keys and values to stdout, as JSON lines
+  restore                    read what dump wrote from stdin
+  check [prefix]             compare what every driver has for each key
+
+Flags:
+`
+
+// batchSize is how many keys dump and restore move per call
+const batchSize = 500
+
+// checkConcurrency is how many keys check inspects at once
+const checkConcurrency = 8
+
+// record is a line of a dump
+type record struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	TTLMillis int64  `json:"ttl_ms,omitempty"`
+}
+
+// fail prints err and exits
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "gostormctl: %s\n", err)
+	os.Exit(1)
+}
+
+// usageError prints how to use the tool and exits
+func usageError(msg string) {
+	fmt.Fprintf(os.Stderr, "gostormctl: %s\n\n", msg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// args checks a command got between min and max arguments
+func args(cmd string, got []string, min, max int) []string {
+	if len(got) < min || len(got) > max {
+		usageError("wrong number of arguments for " + cmd)
+	}
+	return got
+}
+
+func main() {
+	servers := flag.String("server", envOr("GOSTORM_SERVER", "http://localhost:8080"),
+		"server URL, several comma separated to fail over, $GOSTORM_SERVER")
+	timeout := flag.Duration("timeout", 5*time.Second, "budget of a single call")
+	token := flag.String("token", os.Getenv("GOSTORM_TOKEN"), "API token, $GOSTORM_TOKEN")
+	ca := flag.String("ca", "", "CA certificates to check https servers against, the system's by default")
+	cert := flag.String("cert", "", "client certificate, for servers that want one")
+	key := flag.String("key", "", "client certificate's key")
+	tenant := flag.String("tenant", os.Getenv("GOSTORM_TENANT"), "tenant whose keys to work on, $GOSTORM_TENANT")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig, err := tlsconfig.FromQuery(url.Values{"ca": {*ca}, "cert": {*cert}, "key": {*key}})
+	if err != nil {
+		fail(err)
+	}
+
+	c, err := client.New(strings.Split(*servers, ","),
+		client.WithTimeout(*timeout),
+		client.WithToken(*token),
+		client.WithTLS(tlsConfig),
+		client.WithTenant(*tenant),
+	)
+	if err != nil {
+		fail(err)
+	}
+
+	ctx := context.Background()
+	cmd, rest := flag.Arg(0), flag.Args()[1:]
+
+	switch cmd {
+	case "get":
+		a := args(cmd, rest, 1, 1)
+		value, err := c.Get(ctx, a[0])
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(value)
+	case "set":
+		set(ctx, c, rest)
+	case "delete":
+		a := args(cmd, rest, 1, 1)
+		if err := c.Delete(ctx, a[0]); err != nil {
+			fail(err)
+		}
+	case "ttl":
+		a := args(cmd, rest, 1, 1)
+		ttl, err := c.TTL(ctx, a[0])
+		if err != nil {
+			fail(err)
+		}
+		if ttl == gostorm.NoExpiry {
+			fmt.Println("never")
+		} else {
+			fmt.Println(ttl)
+		}
+	case "expire":
+		a := args(cmd, rest, 2, 2)
+		ttl, err := time.ParseDuration(a[1])
+		if err != nil {
+			usageError(err.Error())
+		}
+		if err := c.Expire(ctx, a[0], ttl); err != nil {
+			fail(err)
+		}
+	case "scan":
+		a := args(cmd, rest, 0, 1)
+		keys, err := c.List(ctx, strings.Join(a, ""))
+		if err != nil {
+			fail(err)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+	case "drivers":
+		args(cmd, rest, 0, 0)
+		drivers, err := c.Drivers(ctx)
+		if err != nil {
+			fail(err)
+		}
+		printDrivers(drivers)
+	case "driver":
+		a := args(cmd, rest, 2, 2)
+		index, err := strconv.Atoi(a[0])
+		if err != nil {
+			usageError("bad driver index " + a[0])
+		}
+		state, err := gostorm.ParseDriverState(a[1])
+		if err != nil {
+			usageError(err.Error())
+		}
+		drv, err := c.SetDriverState(ctx, index, state)
+		if err != nil {
+			fail(err)
+		}
+		printDrivers([]client.Driver{*drv})
+	case "tenants":
+		args(cmd, rest, 0, 0)
+		tenants, err := c.Tenants(ctx)
+		if err != nil {
+			fail(err)
+		}
+		printTenants(tenants)
+	case "dump":
+		dump(ctx, c, rest)
+	case "restore":
+		args(cmd, rest, 0, 0)
+		restore(ctx, c, os.Stdin)
+	case "check":
+		a := args(cmd, rest, 0, 1)
+		check(ctx, c, strings.Join(a, ""))
+	default:
+		usageError("unknown command " + cmd)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
+
+func set(ctx context.Context, c *client.Client, rest []string) {
+	flags := flag.NewFlagSet("set", flag.ExitOnError)
+	ttl := flags.Duration("ttl", 0, "expire the key after this long")
+	flags.Parse(rest)
+
+	a := args("set", flags.Args(), 2, 2)
+	key, value := a[0], a[1]
+
+	if value == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fail(err)
+		}
+		value = string(data)
+	}
+
+	var err error
+	if *ttl > 0 {
+		err = c.SetWithTTL(ctx, key, value, *ttl)
+	} else {
+		err = c.Set(ctx, key, value)
+	}
+
+	if err != nil {
+		fail(err)
+	}
+}
+
+func printDrivers(drivers []client.Driver) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tNAME\tSTATE\tHEALTH\tCALLS\tERRORS\tP50/P99 MS\tLAST ERROR")
+
+	for _, d := range drivers {
+		health := "ok"
+		if !d.Healthy {
+			health = fmt.Sprintf("failing (%d in a row)", d.ConsecutiveErrors)
+		}
+
+		lastErr := "-"
+		if len(d.LastError) > 0 {
+			lastErr = fmt.Sprintf("%s ago: %s", time.Since(d.LastErrorAt).Round(time.Second), d.LastError)
+		}
+
+		latency := fmt.Sprintf("%.1f/%.1f", d.LatencyMS.P50, d.LatencyMS.P99)
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", d.Index, d.Name, d.State, health, d.Calls, d.Errors, latency, lastErr)
+	}
+
+	w.Flush()
+}
+
+func printTenants(tenants []client.Tenant) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPREFIX\tDRIVERS\tREAD/WRITE\tKEYS\tBYTES\tREQUESTS\tTHROTTLED\tOVER QUOTA")
+
+	// of is usage out of a quota, if there's one
+	of := func(n, max int64) string {
+		if max <= 0 {
+			return strconv.FormatInt(n, 10)
+		}
+		return fmt.Sprintf("%d/%d", n, max)
+	}
+
+	for _, t := range tenants {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/%s\t%s\t%s\t%d\t%d\t%d\n", t.Name, t.Prefix, strings.Join(t.Drivers, ","),
+			t.ReadPolicy, t.WritePolicy, of(t.Keys, t.Quota.MaxKeys), of(t.Bytes, t.Quota.MaxBytes), t.Requests, t.Throttled, t.OverQuota)
+	}
+
+	w.Flush()
+}
+
+// dump writes every key under the prefix to stdout, one JSON record a line
+func dump(ctx context.Context, c *client.Client, rest []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	withTTL := flags.Bool("ttl", false, "keep the keys' TTLs, one more call per key")
+	flags.Parse(rest)
+
+	a := args("dump", flags.Args(), 0, 1)
+
+	keys, err := c.List(ctx, strings.Join(a, ""))
+	if err != nil {
+		fail(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	failed := 0
+
+	for start := 0; start < len(keys); start += batchSize {
+		chunk := keys[start:min(start+batchSize, len(keys))]
+
+		values, errs := c.GetMulti(ctx, chunk)
+		for key, err := range errs {
+			// Gone since it was listed, that's fine
+			if !gostorm.IsNotFound(err) {
+				fmt.Fprintf(os.Stderr, "gostormctl: %s: %s\n", key, err)
+				failed++
+			}
+		}
+
+		for _, key := range chunk {
+			value, ok := values[key]
+			if !ok {
+				continue
+			}
+
+			rec := record{Key: key, Value: value}
+			if *withTTL {
+				ttl, err := c.TTL(ctx, key)
+				if err != nil && !gostorm.IsNotFound(err) {
+					fmt.Fprintf(os.Stderr, "gostormctl: ttl %s: %s\n", key, err)
+				}
+				if err == nil && ttl != gostorm.NoExpiry {
+					rec.TTLMillis = max(int64(ttl/time.Millisecond), 1)
+				}
+			}
+
+			if err := enc.Encode(rec); err != nil {
+				fail(err)
+			}
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		fail(err)
+	}
+
+	if failed > 0 {
+		fail(fmt.Errorf("%d keys couldn't be dumped", failed))
+	}
+}
+
+// restore sets every record read from r, in batches, those with a TTL one
+// by one
+func restore(ctx context.Context, c *client.Client, r io.Reader) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	batch := make(map[string]string)
+	restored, failed := 0, 0
+
+	flush := func() {
+		for key, err := range c.SetMulti(ctx, batch) {
+			fmt.Fprintf(os.Stderr, "gostormctl: %s: %s\n", key, err)
+			failed++
+		}
+		restored += len(batch)
+		batch = make(map[string]string)
+	}
+
+	for {
+		rec := record{}
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(err)
+		}
+
+		if rec.TTLMillis > 0 {
+			if err := c.SetWithTTL(ctx, rec.Key, rec.Value, time.Duration(rec.TTLMillis)*time.Millisecond); err != nil {
+				fmt.Fprintf(os.Stderr, "gostormctl: %s: %s\n", rec.Key, err)
+				failed++
+			}
+			restored++
+			continue
+		}
+
+		batch[rec.Key] = rec.Value
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	flush()
+
+	fmt.Fprintf(os.Stderr, "restored %d keys\n", restored-failed)
+	if failed > 0 {
+		fail(fmt.Errorf("%d keys couldn't be restored", failed))
+	}
+}
+
+// check inspects every key under the prefix, printing those the drivers
+// disagree on. It exits with 1 if there are any.
+func check(ctx context.Context, c *client.Client, prefix string) {
+	keys, err := c.List(ctx, prefix)
+	if err != nil {
+		fail(err)
+	}
+
+	keyChan := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	inconsistent, failed := 0, 0
+
+	for i := 0; i < checkConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyChan {
+				inspection, err := c.Inspect(ctx, key)
+
+				mu.Lock()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "gostormctl: %s: %s\n", key, err)
+					failed++
+				} else if !inspection.Consistent {
+					inconsistent++
+					printInspection(inspection)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		keyChan <- key
+	}
+	close(keyChan)
+	wg.Wait()
+
+	fmt.Printf("checked %d keys: %d inconsistent, %d failed\n", len(keys), inconsistent, failed)
+	if inconsistent > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printInspection(inspection *client.Inspection) {
+	fmt.Printf("%s\n", inspection.Key)
+	for _, d := range inspection.Drivers {
+		switch {
+		case d.Error != nil:
+			fmt.Printf("  %d %s: error: %s\n", d.Index, d.Name, d.Error.Message)
+		case d.Value == nil:
+			fmt.Printf("  %d %s: missing\n", d.Index, d.Name)
+		default:
+			fmt.Printf("  %d %s: %s\n", d.Index, d.Name, abbreviate(*d.Value))
+		}
+	}
+}
+
+// abbreviate shortens long values, quoting them
+func abbreviate(value string) string {
+	const maxLen = 60
+	if len(value) > maxLen {
+		return fmt.Sprintf("%q... (%d bytes)", value[:maxLen], len(value))
+	}
+	return strconv.Quote(value)
+}
@@ -1,4 +1,9 @@
-package main
+package gostorm
+
+import "time"
+
+// NoExpiry is the TTL of a key that lives forever
+const NoExpiry time.Duration = -1
 
 // Driver describes the interface for Gostorm's datasource driver
 type Driver interface {
@@ -8,4 +13,44 @@ type Driver interface {
 
 	// Set value from datastore
 	Set(string, string, chan string, chan error)
+
+	// Delete value from datastore, deleting a missing key isn't an error
+	Delete(string, chan string, chan error)
+}
+
+// Lister is implemented by drivers that can list the keys they hold
+type Lister interface {
+
+	// List keys starting with prefix, in no particular order
+	List(string, chan []string, chan error)
+}
+
+// Expirer is implemented by drivers whose keys can expire
+type Expirer interface {
+
+	// SetWithTTL sets a value that expires after the TTL, zero meaning never
+	SetWithTTL(string, string, time.Duration, chan string, chan error)
+
+	// Expire changes the TTL of an existing key, zero meaning never
+	Expire(string, time.Duration, chan string, chan error)
+
+	// TTL returns how long a key has left, NoExpiry if it lives forever
+	TTL(string, chan time.Duration, chan error)
+}
+
+// BatchGetter is implemented by drivers that can get many keys in a single
+// call, GetMulti makes one call to them instead of one a key
+type BatchGetter interface {
+
+	// GetMulti returns the values found and an error for every key that
+	// went wrong, keys in neither map weren't found
+	GetMulti([]string) (map[string]string, map[string]error)
+}
+
+// BatchSetter is implemented by drivers that can set many keys in a single
+// call, SetMulti makes one call to them instead of one a key
+type BatchSetter interface {
+
+	// SetMulti returns an error for every key that couldn't be set
+	SetMulti(map[string]string) map[string]error
 }
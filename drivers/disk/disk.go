@@ -0,0 +1,488 @@
+// Package disk is an embedded, persistent Gostorm driver: an append-only
+// log on disk with an in-memory index of where every key lives. The log
+// gets compacted once it's mostly garbage, and a torn write at its tail is
+// cut off on startup.
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+const (
+	logName     = "data.log"
+	compactName = "data.log.compact"
+
+	// headerSize is crc32 + kind + key length + value length
+	headerSize = 4 + 1 + 4 + 4
+
+	kindSet    = byte(1)
+	kindDelete = byte(2)
+
+	// maxRecordPart caps key and value sizes, anything bigger is corruption
+	maxRecordPart = 64 << 20
+)
+
+// ErrClosed is returned once the driver's been closed
+var ErrClosed = errors.New("disk: driver closed")
+
+// Config describes a disk.Driver
+type Config struct {
+	// Dir holds the log
+	Dir string
+
+	// Sync fsyncs every write, or leaves it to the OS if false
+	Sync bool
+
+	// CompactEvery is how often to check whether compaction is due, zero
+	// turns it off
+	CompactEvery time.Duration
+
+	// CompactRatio is the fraction of dead bytes that triggers compaction
+	CompactRatio float64
+}
+
+// DefaultConfig is what New starts from
+var DefaultConfig = Config{
+	Sync:         true,
+	CompactEvery: 10 * time.Minute,
+	CompactRatio: 0.5,
+}
+
+// logFile is what the driver needs of the log, an *os.File but for tests
+type logFile interface {
+	io.ReaderAt
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// location is where a value lives in the log
+type location struct {
+	offset int64
+	size   int64
+}
+
+// Driver for Gostorm
+type Driver struct {
+	cfg Config
+
+	mu     sync.RWMutex
+	file   logFile
+	size   int64
+	dead   int64
+	index  map[string]location
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a new disk.Driver for a conn string like
+// "disk:///var/lib/gostorm?sync=true&compact=10m&ratio=0.5"
+func New(connString string) (*Driver, error) {
+	diskURL, err := url.Parse(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if diskURL.Scheme != "disk" || len(diskURL.Path) == 0 {
+		return nil, fmt.Errorf("disk: bad conn string %q", connString)
+	}
+
+	cfg := DefaultConfig
+	cfg.Dir = diskURL.Path
+	query := diskURL.Query()
+
+	if sync := query.Get("sync"); len(sync) > 0 {
+		if cfg.Sync, err = strconv.ParseBool(sync); err != nil {
+			return nil, fmt.Errorf("disk: %s", err)
+		}
+	}
+
+	if compact := query.Get("compact"); len(compact) > 0 {
+		if cfg.CompactEvery, err = time.ParseDuration(compact); err != nil {
+			return nil, fmt.Errorf("disk: %s", err)
+		}
+	}
+
+	if ratio := query.Get("ratio"); len(ratio) > 0 {
+		if cfg.CompactRatio, err = strconv.ParseFloat(ratio, 64); err != nil {
+			return nil, fmt.Errorf("disk: %s", err)
+		}
+	}
+
+	return NewWithConfig(cfg)
+}
+
+// NewWithConfig opens, or creates, the log in cfg.Dir
+func NewWithConfig(cfg Config) (*Driver, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// A leftover from a compaction that didn't finish, the log is still good
+	os.Remove(filepath.Join(cfg.Dir, compactName))
+
+	file, err := os.OpenFile(filepath.Join(cfg.Dir, logName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	drv := &Driver{
+		cfg:   cfg,
+		file:  file,
+		index: make(map[string]location),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if err := drv.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	slog.Info("disk: opened", "keys", len(drv.index), "dir", cfg.Dir)
+
+	go drv.compactLoop()
+
+	return drv, nil
+}
+
+// recover rebuilds the index from the log, cutting off a torn tail
+func (drv *Driver) recover() error {
+	r := bufio.NewReader(io.NewSectionReader(drv.file, 0, 1<<62))
+	offset := int64(0)
+
+	for {
+		kind, key, value, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			slog.Warn("disk: truncating log", "offset", offset, "err", err)
+			if err := drv.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		size := int64(headerSize + len(key) + len(value))
+		drv.apply(kind, key, offset+int64(headerSize+len(key)), int64(len(value)), size)
+		offset += size
+	}
+
+	drv.size = offset
+	_, err := drv.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// apply updates the index with a record of size bytes whose value sits at
+// valueOffset
+func (drv *Driver) apply(kind byte, key string, valueOffset, valueSize, size int64) {
+	if old, ok := drv.index[key]; ok {
+		drv.dead += headerSize + int64(len(key)) + old.size
+	}
+
+	switch kind {
+	case kindSet:
+		drv.index[key] = location{offset: valueOffset, size: valueSize}
+	case kindDelete:
+		delete(drv.index, key)
+		drv.dead += size
+	}
+}
+
+// readRecord reads the next record, io.EOF meaning a clean end of the log
+func readRecord(r io.Reader) (byte, string, string, error) {
+	header := make([]byte, headerSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return 0, "", "", io.EOF
+		}
+		return 0, "", "", fmt.Errorf("short header: %s", err)
+	}
+
+	kind := header[4]
+	keyLen := binary.BigEndian.Uint32(header[5:9])
+	valueLen := binary.BigEndian.Uint32(header[9:13])
+
+	if (kind != kindSet && kind != kindDelete) || keyLen > maxRecordPart || valueLen > maxRecordPart {
+		return 0, "", "", errors.New("bad header")
+	}
+
+	body := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", "", fmt.Errorf("short body: %s", err)
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) {
+		return 0, "", "", errors.New("checksum mismatch")
+	}
+
+	return kind, string(body[:keyLen]), string(body[keyLen:]), nil
+}
+
+// encodeRecord returns the bytes of a record
+func encodeRecord(kind byte, key, value string) []byte {
+	buf := make([]byte, headerSize+len(key)+len(value))
+	buf[4] = kind
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(value)))
+	copy(buf[headerSize:], key)
+	copy(buf[headerSize+len(key):], value)
+	binary.BigEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// append writes a record to the end of the log and indexes it
+func (drv *Driver) append(kind byte, key, value string) error {
+	if len(key) > maxRecordPart || len(value) > maxRecordPart {
+		return errors.New("disk: key or value too large")
+	}
+
+	record := encodeRecord(kind, key, value)
+
+	drv.mu.Lock()
+	defer drv.mu.Unlock()
+
+	if drv.closed {
+		return ErrClosed
+	}
+
+	if _, err := drv.file.Write(record); err != nil {
+		drv.rollback()
+		return err
+	}
+
+	if drv.cfg.Sync {
+		if err := drv.file.Sync(); err != nil {
+			// The record isn't indexed, the next one must land where it did
+			drv.rollback()
+			return err
+		}
+	}
+
+	drv.apply(kind, key, drv.size+int64(headerSize+len(key)), int64(len(value)), int64(len(record)))
+	drv.size += int64(len(record))
+
+	return nil
+}
+
+// rollback cuts the log back to the last indexed record, so a failed write
+// doesn't leave half a record for the next one to land after
+func (drv *Driver) rollback() {
+	drv.file.Truncate(drv.size)
+	drv.file.Seek(drv.size, io.SeekStart)
+}
+
+// Name of the driver
+func (drv *Driver) Name() string {
+	return "disk"
+}
+
+// Get gets data ;)
+func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
+	drv.mu.RLock()
+	defer drv.mu.RUnlock()
+
+	if drv.closed {
+		errChan <- ErrClosed
+		return
+	}
+
+	loc, ok := drv.index[key]
+	if !ok {
+		errChan <- gostorm.ErrNotFound
+		return
+	}
+
+	buf := make([]byte, loc.size)
+	if _, err := drv.file.ReadAt(buf, loc.offset); err != nil {
+		errChan <- err
+		return
+	}
+
+	retChan <- string(buf)
+}
+
+// Set sets data :)
+func (drv *Driver) Set(key, value string, retChan chan string, errChan chan error) {
+	if err := drv.append(kindSet, key, value); err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// Delete deletes data :(
+func (drv *Driver) Delete(key string, retChan chan string, errChan chan error) {
+	drv.mu.RLock()
+	_, ok := drv.index[key]
+	drv.mu.RUnlock()
+
+	// Nothing to tombstone
+	if !ok {
+		retChan <- ""
+		return
+	}
+
+	if err := drv.append(kindDelete, key, ""); err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// List lists keys starting with prefix
+func (drv *Driver) List(prefix string, retChan chan []string, errChan chan error) {
+	drv.mu.RLock()
+	defer drv.mu.RUnlock()
+
+	keys := []string{}
+	for key := range drv.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	retChan <- keys
+}
+
+// compactLoop compacts the log whenever it's mostly garbage
+func (drv *Driver) compactLoop() {
+	defer close(drv.done)
+
+	if drv.cfg.CompactEvery <= 0 {
+		<-drv.stop
+		return
+	}
+
+	ticker := time.NewTicker(drv.cfg.CompactEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			drv.mu.RLock()
+			due := drv.size > 0 && float64(drv.dead)/float64(drv.size) >= drv.cfg.CompactRatio
+			drv.mu.RUnlock()
+
+			if due {
+				if err := drv.Compact(); err != nil {
+					slog.Error("disk: compaction failed", "err", err)
+				}
+			}
+		case <-drv.stop:
+			return
+		}
+	}
+}
+
+// Compact rewrites the log with live keys only. Writes wait meanwhile.
+func (drv *Driver) Compact() error {
+	drv.mu.Lock()
+	defer drv.mu.Unlock()
+
+	if drv.closed {
+		return ErrClosed
+	}
+
+	path := filepath.Join(drv.cfg.Dir, compactName)
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	index := make(map[string]location, len(drv.index))
+	offset := int64(0)
+
+	for key, loc := range drv.index {
+		buf := make([]byte, loc.size)
+		if _, err = drv.file.ReadAt(buf, loc.offset); err != nil {
+			break
+		}
+
+		record := encodeRecord(kindSet, key, string(buf))
+		if _, err = w.Write(record); err != nil {
+			break
+		}
+
+		index[key] = location{offset: offset + int64(headerSize+len(key)), size: loc.size}
+		offset += int64(len(record))
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := os.Rename(path, filepath.Join(drv.cfg.Dir, logName)); err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+	syncDir(drv.cfg.Dir)
+
+	drv.file.Close()
+	drv.file = out
+	drv.index = index
+	drv.size = offset
+	drv.dead = 0
+
+	_, err = drv.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close stops compaction and closes the log
+func (drv *Driver) Close() error {
+	drv.mu.Lock()
+	if drv.closed {
+		drv.mu.Unlock()
+		return nil
+	}
+	drv.closed = true
+	drv.mu.Unlock()
+
+	close(drv.stop)
+	<-drv.done
+
+	drv.mu.Lock()
+	defer drv.mu.Unlock()
+
+	return drv.file.Close()
+}
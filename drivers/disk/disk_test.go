@@ -0,0 +1,250 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/wmgaca/gostorm"
+)
+
+func open(t *testing.T, dir string) *Driver {
+	t.Helper()
+
+	cfg := DefaultConfig
+	cfg.Dir = dir
+	cfg.CompactEvery = 0
+	drv, err := NewWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv
+}
+
+func get(drv *Driver, key string) (string, error) {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Get(key, retChan, errChan)
+	select {
+	case v := <-retChan:
+		return v, nil
+	case err := <-errChan:
+		return "", err
+	}
+}
+
+func set(t *testing.T, drv *Driver, key, value string) {
+	t.Helper()
+
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Set(key, value, retChan, errChan)
+	select {
+	case <-retChan:
+	case err := <-errChan:
+		t.Fatal(err)
+	}
+}
+
+func del(t *testing.T, drv *Driver, key string) {
+	t.Helper()
+
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Delete(key, retChan, errChan)
+	select {
+	case <-retChan:
+	case err := <-errChan:
+		t.Fatal(err)
+	}
+}
+
+// contents returns every key and its value
+func contents(t *testing.T, drv *Driver) map[string]string {
+	t.Helper()
+
+	retChan, errChan := make(chan []string, 1), make(chan error, 1)
+	drv.List("", retChan, errChan)
+
+	var keys []string
+	select {
+	case keys = <-retChan:
+	case err := <-errChan:
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+
+	values := make(map[string]string)
+	for _, key := range keys {
+		v, err := get(drv, key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		values[key] = v
+	}
+	return values
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	good := encodeRecord(kindSet, "a", "1")
+	last := encodeRecord(kindSet, "b", "2")
+
+	flipped := append([]byte(nil), last...)
+	flipped[len(flipped)-1] ^= 0xff
+
+	badKind := append([]byte(nil), last...)
+	badKind[4] = 9
+
+	tests := []struct {
+		name string
+		tail []byte
+		want map[string]string
+	}{
+		{"clean", last, map[string]string{"a": "1", "b": "2"}},
+		{"torn header", last[:headerSize-3], map[string]string{"a": "1"}},
+		{"torn body", last[:len(last)-1], map[string]string{"a": "1"}},
+		{"checksum mismatch", flipped, map[string]string{"a": "1"}},
+		{"bad kind", badKind, map[string]string{"a": "1"}},
+		{"garbage", []byte("\x00\x00\x00\x00\x01\xff\xff\xff\xff"), map[string]string{"a": "1"}},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		data := append(append([]byte(nil), good...), test.tail...)
+		if err := os.WriteFile(filepath.Join(dir, logName), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		drv := open(t, dir)
+		if got := contents(t, drv); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+
+		// Writes after the recovery land after the last good record and
+		// survive a restart
+		set(t, drv, "c", "3")
+		drv.Close()
+
+		drv = open(t, dir)
+		got := contents(t, drv)
+		drv.Close()
+		if got["c"] != "3" || got["a"] != "1" {
+			t.Errorf("%s: after a write and a restart got %v", test.name, got)
+		}
+	}
+}
+
+// syncFailing is a log whose syncs fail while fail is set
+type syncFailing struct {
+	*os.File
+	fail bool
+}
+
+func (f *syncFailing) Sync() error {
+	if f.fail {
+		return errors.New("sync failed")
+	}
+	return f.File.Sync()
+}
+
+func TestSyncFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	drv := open(t, dir)
+	set(t, drv, "a", "1")
+
+	log := &syncFailing{File: drv.file.(*os.File), fail: true}
+	drv.file = log
+
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Set("b", "2", retChan, errChan)
+	select {
+	case <-retChan:
+		t.Fatal("a write whose sync failed succeeded")
+	case <-errChan:
+	}
+
+	log.fail = false
+	set(t, drv, "c", "3")
+
+	want := map[string]string{"a": "1", "c": "3"}
+	if got := contents(t, drv); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	drv.Close()
+
+	drv = open(t, dir)
+	defer drv.Close()
+
+	if got := contents(t, drv); !reflect.DeepEqual(got, want) {
+		t.Errorf("after a restart got %v, want %v", got, want)
+	}
+}
+
+func TestRecoverDeletesAndOverwrites(t *testing.T) {
+	dir := t.TempDir()
+
+	drv := open(t, dir)
+	set(t, drv, "a", "1")
+	set(t, drv, "b", "2")
+	set(t, drv, "a", "3")
+	del(t, drv, "b")
+	drv.Close()
+
+	drv = open(t, dir)
+	defer drv.Close()
+
+	if got, want := contents(t, drv), map[string]string{"a": "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := get(drv, "b"); err != gostorm.ErrNotFound {
+		t.Errorf("deleted key: got %v, want ErrNotFound", err)
+	}
+	if drv.dead == 0 {
+		t.Error("the overwritten and deleted records aren't counted as dead")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	drv := open(t, dir)
+	for i := 0; i < 10; i++ {
+		set(t, drv, "a", string(rune('0'+i)))
+	}
+	set(t, drv, "b", "x")
+	set(t, drv, "c", "y")
+	del(t, drv, "c")
+
+	before := drv.size
+	if err := drv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if drv.size >= before || drv.dead != 0 {
+		t.Errorf("size %d, dead %d after compacting %d bytes", drv.size, drv.dead, before)
+	}
+
+	want := map[string]string{"a": "9", "b": "x"}
+	if got := contents(t, drv); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	set(t, drv, "d", "z")
+	drv.Close()
+
+	drv = open(t, dir)
+	defer drv.Close()
+
+	want["d"] = "z"
+	if got := contents(t, drv); !reflect.DeepEqual(got, want) {
+		t.Errorf("after a restart got %v, want %v", got, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, connString := range []string{"disk://", "file:///tmp/x", "disk:///tmp/x?sync=maybe", "disk:///tmp/x?compact=often"} {
+		if _, err := New(connString); err == nil {
+			t.Errorf("%s: no error", connString)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package fs is a Gostorm driver keeping every key in a file of its own
+// under a directory, so the data can live on NFS or a local disk and be
+// looked at with ordinary tools.
+package fs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/wmgaca/gostorm"
+)
+
+const (
+	// tmpDir holds files being written, it starts with a dot so it can't
+	// clash with an encoded key
+	tmpDir = ".tmp"
+
+	// maxNameLength keeps encoded names under common filesystem limits
+	maxNameLength = 255
+
+	maxFanOut = 4
+)
+
+// ErrKeyTooLong is returned for keys whose encoded name won't fit in a file name
+var ErrKeyTooLong = errors.New("fs: key too long once encoded")
+
+// Driver for Gostorm
+type Driver struct {
+	dir    string
+	fanOut int
+}
+
+// New returns a new fs.Driver for a conn string like
+// "file:///srv/gostorm?fanout=2", fanout being the number of levels of
+// hashed subdirectories (0-4) spreading keys out
+func New(connString string) (*Driver, error) {
+	fsURL, err := url.Parse(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsURL.Scheme != "file" || len(fsURL.Path) == 0 {
+		return nil, fmt.Errorf("fs: bad conn string %q", connString)
+	}
+
+	fanOut := 0
+	if s := fsURL.Query().Get("fanout"); len(s) > 0 {
+		if fanOut, err = strconv.Atoi(s); err != nil || fanOut < 0 || fanOut > maxFanOut {
+			return nil, fmt.Errorf("fs: fanout must be 0-%d", maxFanOut)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(fsURL.Path, tmpDir), 0755); err != nil {
+		return nil, err
+	}
+
+	return &Driver{dir: fsURL.Path, fanOut: fanOut}, nil
+}
+
+// encodeKey turns a key into a file name: anything but letters, digits,
+// '-' and '_' becomes %XX, and so does a leading '.', so there's no way to
+// end up with "..", hidden files or a path separator
+func encodeKey(key string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		safe := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || (c == '.' && i > 0)
+
+		if safe {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// decodeKey undoes encodeKey
+func decodeKey(name string) (string, error) {
+	return url.PathUnescape(name)
+}
+
+// path returns where key lives
+func (drv *Driver) path(key string) (string, error) {
+	name := encodeKey(key)
+	if len(name) > maxNameLength {
+		return "", ErrKeyTooLong
+	}
+
+	parts := []string{drv.dir}
+
+	if drv.fanOut > 0 {
+		sum := sha1.Sum([]byte(key))
+		hash := hex.EncodeToString(sum[:])
+		for i := 0; i < drv.fanOut; i++ {
+			parts = append(parts, hash[2*i:2*i+2])
+		}
+	}
+
+	return filepath.Join(append(parts, name)...), nil
+}
+
+// Name of the driver
+func (drv *Driver) Name() string {
+	return "fs"
+}
+
+// Get gets data ;)
+func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
+	path, err := drv.path(key)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = gostorm.ErrNotFound
+	}
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- string(data)
+	}
+}
+
+// Set writes a temp file and renames it into place, so readers never see
+// half a value
+func (drv *Driver) Set(key, value string, retChan chan string, errChan chan error) {
+	if err := drv.write(key, value); err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+func (drv *Driver) write(key, value string) error {
+	path, err := drv.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(drv.dir, tmpDir), "set-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(value)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Delete deletes data :(
+func (drv *Driver) Delete(key string, retChan chan string, errChan chan error) {
+	path, err := drv.path(key)
+	if err == nil {
+		err = os.Remove(path)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// List lists keys starting with prefix, walking the whole directory
+func (drv *Driver) List(prefix string, retChan chan []string, errChan chan error) {
+	keys := []string{}
+
+	err := filepath.Walk(drv.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() && path != drv.dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		key, err := decodeKey(info.Name())
+		if err == nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- keys
+	}
+}
@@ -0,0 +1,254 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/wmgaca/gostorm"
+)
+
+func open(t *testing.T, fanOut string) *Driver {
+	t.Helper()
+
+	drv, err := New("file://" + t.TempDir() + "?fanout=" + fanOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv
+}
+
+func get(drv *Driver, key string) (string, error) {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Get(key, retChan, errChan)
+	select {
+	case v := <-retChan:
+		return v, nil
+	case err := <-errChan:
+		return "", err
+	}
+}
+
+func set(drv *Driver, key, value string) error {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Set(key, value, retChan, errChan)
+	select {
+	case <-retChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+func del(drv *Driver, key string) error {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Delete(key, retChan, errChan)
+	select {
+	case <-retChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+func list(t *testing.T, drv *Driver, prefix string) []string {
+	t.Helper()
+
+	retChan, errChan := make(chan []string, 1), make(chan error, 1)
+	drv.List(prefix, retChan, errChan)
+	select {
+	case keys := <-retChan:
+		sort.Strings(keys)
+		return keys
+	case err := <-errChan:
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func TestEncodeKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		name string
+	}{
+		{"plain-key_1", "plain-key_1"},
+		{"a.b", "a.b"},
+		{".hidden", "%2Ehidden"},
+		{"..", "%2E."},
+		{"a/b", "a%2Fb"},
+		{"../../etc/passwd", "%2E.%2F..%2Fetc%2Fpasswd"},
+		{`a\b`, "a%5Cb"},
+		{"a b", "a%20b"},
+		{"100%", "100%25"},
+		{"a\x00b", "a%00b"},
+		{"zażółć", "za%C5%BC%C3%B3%C5%82%C4%87"},
+	}
+
+	for _, test := range tests {
+		name := encodeKey(test.key)
+		if name != test.name {
+			t.Errorf("%q: encoded to %q, want %q", test.key, name, test.name)
+		}
+		if key, err := decodeKey(name); err != nil || key != test.key {
+			t.Errorf("%q: decoded back to %q, %v", test.key, key, err)
+		}
+	}
+}
+
+func TestSetGetDelete(t *testing.T) {
+	for _, fanOut := range []string{"0", "2"} {
+		drv := open(t, fanOut)
+
+		for _, key := range []string{"a", "a/b", ".hidden", "zażółć"} {
+			if err := set(drv, key, "1"); err != nil {
+				t.Fatalf("fanout %s: %q: %v", fanOut, key, err)
+			}
+			if err := set(drv, key, "2"); err != nil {
+				t.Fatalf("fanout %s: %q: %v", fanOut, key, err)
+			}
+			if v, err := get(drv, key); err != nil || v != "2" {
+				t.Errorf("fanout %s: %q: got %q, %v", fanOut, key, v, err)
+			}
+
+			if err := del(drv, key); err != nil {
+				t.Errorf("fanout %s: %q: %v", fanOut, key, err)
+			}
+			if _, err := get(drv, key); err != gostorm.ErrNotFound {
+				t.Errorf("fanout %s: %q: after a delete got %v, want ErrNotFound", fanOut, key, err)
+			}
+			if err := del(drv, key); err != nil {
+				t.Errorf("fanout %s: %q: deleting a missing key: %v", fanOut, key, err)
+			}
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	for _, fanOut := range []int{0, 1, 4} {
+		drv := open(t, string(rune('0'+fanOut)))
+
+		if err := set(drv, "a/b", "v"); err != nil {
+			t.Fatal(err)
+		}
+
+		path, _ := drv.path("a/b")
+		rel, _ := filepath.Rel(drv.dir, path)
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) != fanOut+1 || parts[fanOut] != "a%2Fb" {
+			t.Errorf("fanout %d: stored at %s", fanOut, rel)
+		}
+		for _, dir := range parts[:fanOut] {
+			if len(dir) != 2 {
+				t.Errorf("fanout %d: subdirectory %q isn't two hex digits", fanOut, dir)
+			}
+		}
+
+		if data, err := os.ReadFile(path); err != nil || string(data) != "v" {
+			t.Errorf("fanout %d: the file has %q, %v", fanOut, data, err)
+		}
+	}
+}
+
+func TestWriteLeavesNoTempFiles(t *testing.T) {
+	drv := open(t, "1")
+
+	for _, key := range []string{"a", "b", "a"} {
+		if err := set(drv, key, strings.Repeat("v", 1<<16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Too long a key fails before a temp file is made, one that can't be
+	// renamed into place has its temp file removed
+	set(drv, strings.Repeat("k", maxNameLength+1), "v")
+	os.MkdirAll(filepath.Join(drv.dir, "dir"), 0755)
+	drv.fanOut = 0
+	if err := set(drv, "dir", "v"); err == nil {
+		t.Error("renaming over a directory succeeded")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(drv.dir, tmpDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d temp files left behind", len(entries))
+	}
+}
+
+func TestList(t *testing.T) {
+	drv := open(t, "2")
+
+	for _, key := range []string{"app/1", "app/2", "apple", "other", ".dot"} {
+		if err := set(drv, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither files being written nor hidden ones are keys
+	os.WriteFile(filepath.Join(drv.dir, tmpDir, "set-123"), []byte("v"), 0644)
+	os.WriteFile(filepath.Join(drv.dir, ".DS_Store"), []byte("v"), 0644)
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{".dot", "app/1", "app/2", "apple", "other"}},
+		{"app", []string{"app/1", "app/2", "apple"}},
+		{"app/", []string{"app/1", "app/2"}},
+		{".", []string{".dot"}},
+		{"none", []string{}},
+	}
+
+	for _, test := range tests {
+		if got := list(t, drv, test.prefix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	drv := open(t, "0")
+
+	tests := []struct {
+		key string
+		err error
+	}{
+		{strings.Repeat("k", maxNameLength), nil},
+		{strings.Repeat("k", maxNameLength+1), ErrKeyTooLong},
+		// Fine as a key, three times as long once encoded
+		{strings.Repeat("/", 100), ErrKeyTooLong},
+	}
+
+	for _, test := range tests {
+		if err := set(drv, test.key, "v"); err != test.err {
+			t.Errorf("%d byte key: got %v, want %v", len(test.key), err, test.err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		connString string
+		err        bool
+	}{
+		{"file://" + dir, false},
+		{"file://" + dir + "?fanout=4", false},
+		{"disk://" + dir, true},
+		{"file://", true},
+		{"file://" + dir + "?fanout=5", true},
+		{"file://" + dir + "?fanout=-1", true},
+		{"file://" + dir + "?fanout=two", true},
+	}
+
+	for _, test := range tests {
+		if _, err := New(test.connString); (err != nil) != test.err {
+			t.Errorf("%s: err %v, want error %v", test.connString, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+// Package mem is an in-process Gostorm driver: a bounded, sharded cache with
+// TTLs and a choice of eviction policies. It makes a good near cache in
+// front of the network drivers, and a handy backend for tests.
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+// entryOverhead is roughly what an entry costs on top of its key and value
+const entryOverhead = 64
+
+// Errors a write can fail with
+var (
+	// ErrTooLarge is returned for values that can never fit in a shard
+	ErrTooLarge = errors.New("mem: value too large")
+
+	// ErrRejected means the policy found a new key not worth what it would
+	// have to evict, tinylfu turns keys down until they're popular enough
+	ErrRejected = errors.New("mem: rejected by the admission policy")
+)
+
+// Config describes a mem.Driver
+type Config struct {
+	// Size is the upper bound of memory used, in bytes
+	Size int64
+
+	// Policy picks what gets evicted: "lru", "lfu", "arc" or "tinylfu"
+	Policy string
+
+	// TTL is the default lifetime of a key, zero means forever
+	TTL time.Duration
+
+	// Shards is the number of independently locked partitions
+	Shards int
+}
+
+// DefaultConfig is what New starts from
+var DefaultConfig = Config{
+	Size:   64 << 20,
+	Policy: "lru",
+	Shards: 16,
+}
+
+// Stats are the driver's counters
+type Stats struct {
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	Expired    uint64
+	Rejections uint64
+	Entries    int
+	Bytes      int64
+}
+
+// Driver for Gostorm
+type Driver struct {
+	shards []*shard
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// New returns a new mem.Driver for a conn string like
+// "mem://?size=64MB&policy=lru&ttl=10m&shards=16", every param optional
+func New(connString string) (*Driver, error) {
+	memURL, err := url.Parse(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if memURL.Scheme != "mem" {
+		return nil, fmt.Errorf("mem: bad scheme %q", memURL.Scheme)
+	}
+
+	cfg := DefaultConfig
+	query := memURL.Query()
+
+	if size := query.Get("size"); len(size) > 0 {
+		if cfg.Size, err = ParseSize(size); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy := query.Get("policy"); len(policy) > 0 {
+		cfg.Policy = policy
+	}
+
+	if ttl := query.Get("ttl"); len(ttl) > 0 {
+		if cfg.TTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("mem: %s", err)
+		}
+	}
+
+	if shards := query.Get("shards"); len(shards) > 0 {
+		if cfg.Shards, err = strconv.Atoi(shards); err != nil {
+			return nil, fmt.Errorf("mem: %s", err)
+		}
+	}
+
+	return NewWithConfig(cfg)
+}
+
+// NewWithConfig returns a new mem.Driver
+func NewWithConfig(cfg Config) (*Driver, error) {
+	if cfg.Shards <= 0 {
+		return nil, errors.New("mem: need at least one shard")
+	}
+
+	if cfg.Size < int64(cfg.Shards)*entryOverhead {
+		return nil, errors.New("mem: size too small")
+	}
+
+	drv := &Driver{ttl: cfg.TTL, now: time.Now}
+	capacity := cfg.Size / int64(cfg.Shards)
+
+	for i := 0; i < cfg.Shards; i++ {
+		p, err := newPolicy(cfg.Policy, capacity)
+		if err != nil {
+			return nil, err
+		}
+
+		drv.shards = append(drv.shards, &shard{
+			items:    make(map[string]*entry),
+			capacity: capacity,
+			policy:   p,
+		})
+	}
+
+	return drv, nil
+}
+
+// ParseSize reads sizes like "512", "64KB", "64MB" or "1GB"
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("mem: bad size %q", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// Name of the driver
+func (drv *Driver) Name() string {
+	return "mem"
+}
+
+// shardFor picks the shard key lives in
+func (drv *Driver) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return drv.shards[h.Sum32()%uint32(len(drv.shards))]
+}
+
+// Get gets data ;)
+func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
+	ret, ok := drv.shardFor(key).get(key, drv.now())
+
+	if !ok {
+		errChan <- gostorm.ErrNotFound
+	} else {
+		retChan <- ret
+	}
+}
+
+// Set sets data with the default TTL
+func (drv *Driver) Set(key, value string, retChan chan string, errChan chan error) {
+	drv.SetWithTTL(key, value, drv.ttl, retChan, errChan)
+}
+
+// SetWithTTL sets data that expires after ttl, zero meaning never
+func (drv *Driver) SetWithTTL(key, value string, ttl time.Duration, retChan chan string, errChan chan error) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = drv.now().Add(ttl)
+	}
+
+	err := drv.shardFor(key).set(key, value, expires)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// Expire changes the TTL of an existing key, zero meaning never
+func (drv *Driver) Expire(key string, ttl time.Duration, retChan chan string, errChan chan error) {
+	now := drv.now()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	if drv.shardFor(key).expire(key, expires, now) {
+		retChan <- ""
+	} else {
+		errChan <- gostorm.ErrNotFound
+	}
+}
+
+// TTL returns how long a key has left
+func (drv *Driver) TTL(key string, retChan chan time.Duration, errChan chan error) {
+	now := drv.now()
+	expires, ok := drv.shardFor(key).expiry(key, now)
+
+	switch {
+	case !ok:
+		errChan <- gostorm.ErrNotFound
+	case expires.IsZero():
+		retChan <- gostorm.NoExpiry
+	default:
+		retChan <- expires.Sub(now)
+	}
+}
+
+// Delete deletes data :(
+func (drv *Driver) Delete(key string, retChan chan string, errChan chan error) {
+	drv.shardFor(key).delete(key)
+	retChan <- ""
+}
+
+// List lists keys starting with prefix
+func (drv *Driver) List(prefix string, retChan chan []string, errChan chan error) {
+	now := drv.now()
+	keys := []string{}
+
+	for _, s := range drv.shards {
+		s.mu.Lock()
+		for key, e := range s.items {
+			if strings.HasPrefix(key, prefix) && !e.expired(now) {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	retChan <- keys
+}
+
+// Stats sums up the counters of all shards
+func (drv *Driver) Stats() Stats {
+	stats := Stats{}
+
+	for _, s := range drv.shards {
+		s.mu.Lock()
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		stats.Evictions += s.stats.Evictions
+		stats.Expired += s.stats.Expired
+		stats.Rejections += s.stats.Rejections
+		stats.Entries += len(s.items)
+		stats.Bytes += s.used
+		s.mu.Unlock()
+	}
+
+	return stats
+}
+
+// shard is an independently locked part of the cache
+type shard struct {
+	mu       sync.Mutex
+	items    map[string]*entry
+	used     int64
+	capacity int64
+	policy   policy
+	stats    Stats
+}
+
+func (s *shard) get(key string, now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy.record(key)
+
+	e, ok := s.lookup(key, now)
+	if !ok {
+		s.stats.Misses++
+		return "", false
+	}
+
+	s.stats.Hits++
+	s.policy.hit(e)
+
+	return e.value, true
+}
+
+func (s *shard) set(key, value string, expires time.Time) error {
+	size := int64(len(key)+len(value)) + entryOverhead
+	if size > s.capacity {
+		return ErrTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy.record(key)
+
+	// An update replaces a key the cache already holds, it's never turned
+	// away, only new keys have to be admitted
+	old, resident := s.items[key]
+	if resident {
+		s.remove(old, false)
+	}
+
+	// Decided once, before anything is evicted for it
+	if !resident && s.used+size > s.capacity && !s.policy.admit(key, s.policy.victim()) {
+		s.stats.Rejections++
+		return ErrRejected
+	}
+
+	for s.used+size > s.capacity {
+		victim := s.policy.victim()
+		s.remove(victim, true)
+		s.stats.Evictions++
+	}
+
+	e := &entry{key: key, value: value, size: size, expires: expires}
+	s.items[key] = e
+	s.used += size
+	s.policy.add(e)
+
+	return nil
+}
+
+// lookup returns the live entry for key, dropping it if it's expired
+func (s *shard) lookup(key string, now time.Time) (*entry, bool) {
+	e, ok := s.items[key]
+	if ok && e.expired(now) {
+		s.remove(e, false)
+		s.stats.Expired++
+		return nil, false
+	}
+	return e, ok
+}
+
+func (s *shard) expire(key string, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key, now)
+	if ok {
+		e.expires = expires
+	}
+	return ok
+}
+
+func (s *shard) expiry(key string, now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key, now)
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.expires, true
+}
+
+func (s *shard) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.remove(e, false)
+	}
+}
+
+// remove drops e, evicted tells the policy whether it was pushed out
+func (s *shard) remove(e *entry, evicted bool) {
+	delete(s.items, e.key)
+	s.used -= e.size
+	s.policy.remove(e, evicted)
+}
+
+// entry is a cached key
+type entry struct {
+	key     string
+	value   string
+	size    int64
+	expires time.Time
+
+	// bookkeeping of the policies
+	elem  interface{}
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
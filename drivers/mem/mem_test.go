@@ -0,0 +1,191 @@
+package mem
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+// small returns a single shard driver with room for three one-letter keys
+// holding one-letter values
+func small(t *testing.T, policy string) *Driver {
+	t.Helper()
+
+	drv, err := NewWithConfig(Config{Size: 3*(entryOverhead+2) + 2, Policy: policy, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv
+}
+
+func get(drv *Driver, key string) (string, error) {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Get(key, retChan, errChan)
+	select {
+	case v := <-retChan:
+		return v, nil
+	case err := <-errChan:
+		return "", err
+	}
+}
+
+func set(drv *Driver, key, value string, ttl time.Duration) error {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.SetWithTTL(key, value, ttl, retChan, errChan)
+	select {
+	case <-retChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+// keys returns the resident keys, sorted
+func keys(drv *Driver) []string {
+	retChan, errChan := make(chan []string, 1), make(chan error, 1)
+	drv.List("", retChan, errChan)
+	keys := <-retChan
+	sort.Strings(keys)
+	return keys
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		policy string
+		// steps are "set k" or "get k"
+		steps      []string
+		want       []string
+		rejections uint64
+	}{
+		{"lru", []string{"set a", "set b", "set c", "get a", "set d"}, []string{"a", "c", "d"}, 0},
+		{"lfu", []string{"set a", "set b", "set c", "get a", "get c", "set d"}, []string{"a", "c", "d"}, 0},
+		{"lfu ties go by recency", []string{"set a", "set b", "set c", "set d"}, []string{"b", "c", "d"}, 0},
+		{"arc", []string{"set a", "set b", "set c", "get a", "set d"}, []string{"a", "c", "d"}, 0},
+		{"arc ghost hit", []string{"set a", "set b", "set c", "get a", "set d", "set b"}, []string{"a", "b", "d"}, 0},
+		{"tinylfu turns a new key down", []string{"set a", "set b", "set c", "set d"}, []string{"a", "b", "c"}, 1},
+		{"tinylfu lets a popular key in", []string{"set a", "set b", "set c", "set d", "get d", "get d", "set d"}, []string{"b", "c", "d"}, 1},
+	}
+
+	for _, test := range tests {
+		drv := small(t, strings.Fields(test.policy)[0])
+
+		for _, step := range test.steps {
+			op, key := step[:3], step[4:]
+			if op == "get" {
+				get(drv, key)
+				continue
+			}
+			if err := set(drv, key, "v", 0); err != nil && err != ErrRejected {
+				t.Fatalf("%s: %s: %v", test.policy, step, err)
+			}
+		}
+
+		if got := keys(drv); strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v, want %v", test.policy, got, test.want)
+		}
+		if got := drv.Stats().Rejections; got != test.rejections {
+			t.Errorf("%s: %d rejections, want %d", test.policy, got, test.rejections)
+		}
+	}
+}
+
+func TestUpdateNeverRejected(t *testing.T) {
+	drv := small(t, "tinylfu")
+	for _, key := range []string{"a", "b", "c"} {
+		if err := set(drv, key, "v", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bigger than before, something else has to go for it
+	if err := set(drv, "a", "vvvvvvvv", 0); err != nil {
+		t.Fatalf("updating a resident key: %v", err)
+	}
+	if v, err := get(drv, "a"); err != nil || v != "vvvvvvvv" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	if stats := drv.Stats(); stats.Rejections != 0 || stats.Evictions != 1 {
+		t.Errorf("%d rejections and %d evictions, want 0 and 1", stats.Rejections, stats.Evictions)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	drv := small(t, "lru")
+	if err := set(drv, "a", strings.Repeat("v", 200), 0); err != ErrTooLarge {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	drv := small(t, "lru")
+	now := time.Unix(1000, 0)
+	drv.now = func() time.Time { return now }
+
+	if err := set(drv, "a", "v", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := set(drv, "b", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Second)
+
+	if _, err := get(drv, "a"); err != gostorm.ErrNotFound {
+		t.Errorf("expired key: got %v, want ErrNotFound", err)
+	}
+	if _, err := get(drv, "b"); err != nil {
+		t.Errorf("key without a ttl: %v", err)
+	}
+	if stats := drv.Stats(); stats.Expired != 1 || stats.Entries != 1 {
+		t.Errorf("%d expired and %d entries, want 1 and 1", stats.Expired, stats.Entries)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		err  bool
+	}{
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"64KB", 64 << 10, false},
+		{" 64mb ", 64 << 20, false},
+		{"1GB", 1 << 30, false},
+		{"MB", 0, true},
+		{"1.5GB", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSize(test.s)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("%q: got %d, %v", test.s, got, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		connString string
+		err        bool
+	}{
+		{"mem://", false},
+		{"mem://?size=1MB&policy=arc&ttl=1m&shards=4", false},
+		{"redis://", true},
+		{"mem://?size=big", true},
+		{"mem://?policy=random", true},
+		{"mem://?ttl=forever", true},
+		{"mem://?shards=0", true},
+		{"mem://?size=64&shards=4", true},
+	}
+
+	for _, test := range tests {
+		if _, err := New(test.connString); (err != nil) != test.err {
+			t.Errorf("%s: err %v, want error %v", test.connString, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package mem
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+)
+
+// policy decides what a shard evicts. Shards call it with their lock held.
+type policy interface {
+	// record notes an access to key, resident or not
+	record(key string)
+
+	// add starts tracking a new entry
+	add(e *entry)
+
+	// hit notes an access to a resident entry
+	hit(e *entry)
+
+	// remove stops tracking e, evicted tells it was pushed out for space
+	remove(e *entry, evicted bool)
+
+	// victim returns the entry to evict next
+	victim() *entry
+
+	// admit tells whether key is worth evicting victim for
+	admit(key string, victim *entry) bool
+}
+
+func newPolicy(name string, capacity int64) (policy, error) {
+	switch name {
+	case "lru":
+		return newLRU(), nil
+	case "lfu":
+		return &lfu{}, nil
+	case "arc":
+		return newARC(), nil
+	case "tinylfu":
+		// Assume smallish entries when sizing the sketch
+		return &tinyLFU{lru: newLRU(), sketch: newSketch(capacity / 256)}, nil
+	}
+	return nil, fmt.Errorf("mem: unknown policy %q", name)
+}
+
+// lru evicts the least recently used entry
+type lru struct {
+	entries *list.List
+}
+
+func newLRU() *lru {
+	return &lru{entries: list.New()}
+}
+
+func (p *lru) record(string) {}
+
+func (p *lru) add(e *entry) {
+	e.elem = p.entries.PushFront(e)
+}
+
+func (p *lru) hit(e *entry) {
+	p.entries.MoveToFront(e.elem.(*list.Element))
+}
+
+func (p *lru) remove(e *entry, evicted bool) {
+	p.entries.Remove(e.elem.(*list.Element))
+}
+
+func (p *lru) victim() *entry {
+	if back := p.entries.Back(); back != nil {
+		return back.Value.(*entry)
+	}
+	return nil
+}
+
+func (p *lru) admit(string, *entry) bool {
+	return true
+}
+
+// lfu evicts the least frequently used entry, the least recently used
+// one among equals
+type lfu struct {
+	entries lfuHeap
+	ticks   uint64
+}
+
+func (p *lfu) record(string) {}
+
+func (p *lfu) add(e *entry) {
+	p.ticks++
+	e.freq, e.tick = 1, p.ticks
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfu) hit(e *entry) {
+	p.ticks++
+	e.freq++
+	e.tick = p.ticks
+	heap.Fix(&p.entries, e.index)
+}
+
+func (p *lfu) remove(e *entry, evicted bool) {
+	heap.Remove(&p.entries, e.index)
+}
+
+func (p *lfu) victim() *entry {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	return p.entries[0]
+}
+
+func (p *lfu) admit(string, *entry) bool {
+	return true
+}
+
+// lfuHeap is a min-heap on (freq, tick)
+type lfuHeap []*entry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// arc is the Adaptive Replacement Cache: t1 holds entries seen once, t2
+// entries seen more often, and b1/b2 remember the keys recently evicted
+// from each. Hits on those ghosts shift the target size p of t1 towards
+// whichever side would have kept the key.
+type arc struct {
+	t1, t2 *list.List
+	b1, b2 *ghosts
+	p      int
+}
+
+func newARC() *arc {
+	return &arc{
+		t1: list.New(),
+		t2: list.New(),
+		b1: newGhosts(),
+		b2: newGhosts(),
+	}
+}
+
+// arcElem remembers which list an entry is on
+type arcElem struct {
+	list *list.List
+	elem *list.Element
+}
+
+func (p *arc) record(string) {}
+
+func (p *arc) add(e *entry) {
+	c := p.t1.Len() + p.t2.Len() + 1
+
+	switch {
+	case p.b1.has(e.key):
+		p.p = min(c, p.p+max(p.b2.len()/max(p.b1.len(), 1), 1))
+		p.b1.remove(e.key)
+		p.push(p.t2, e)
+	case p.b2.has(e.key):
+		p.p = max(0, p.p-max(p.b1.len()/max(p.b2.len(), 1), 1))
+		p.b2.remove(e.key)
+		p.push(p.t2, e)
+	default:
+		p.push(p.t1, e)
+	}
+
+	// Ghosts only need to cover about as many keys as there are entries
+	p.b1.trim(c)
+	p.b2.trim(c)
+}
+
+func (p *arc) push(l *list.List, e *entry) {
+	e.elem = &arcElem{list: l, elem: l.PushFront(e)}
+}
+
+func (p *arc) hit(e *entry) {
+	ae := e.elem.(*arcElem)
+	ae.list.Remove(ae.elem)
+	p.push(p.t2, e)
+}
+
+func (p *arc) remove(e *entry, evicted bool) {
+	ae := e.elem.(*arcElem)
+	ae.list.Remove(ae.elem)
+
+	if !evicted {
+		return
+	}
+
+	if ae.list == p.t1 {
+		p.b1.add(e.key)
+	} else {
+		p.b2.add(e.key)
+	}
+}
+
+func (p *arc) victim() *entry {
+	l := p.t2
+	if p.t1.Len() > 0 && (p.t1.Len() > p.p || p.t2.Len() == 0) {
+		l = p.t1
+	}
+
+	if back := l.Back(); back != nil {
+		return back.Value.(*entry)
+	}
+	return nil
+}
+
+func (p *arc) admit(string, *entry) bool {
+	return true
+}
+
+// ghosts is an LRU-ordered set of evicted keys
+type ghosts struct {
+	keys  *list.List
+	index map[string]*list.Element
+}
+
+func newGhosts() *ghosts {
+	return &ghosts{keys: list.New(), index: make(map[string]*list.Element)}
+}
+
+func (g *ghosts) len() int {
+	return g.keys.Len()
+}
+
+func (g *ghosts) has(key string) bool {
+	_, ok := g.index[key]
+	return ok
+}
+
+func (g *ghosts) add(key string) {
+	g.remove(key)
+	g.index[key] = g.keys.PushFront(key)
+}
+
+func (g *ghosts) remove(key string) {
+	if elem, ok := g.index[key]; ok {
+		g.keys.Remove(elem)
+		delete(g.index, key)
+	}
+}
+
+func (g *ghosts) trim(n int) {
+	for g.keys.Len() > n {
+		g.remove(g.keys.Back().Value.(string))
+	}
+}
+
+// tinyLFU is an LRU that only lets a new key in if it's been asked for more
+// often than the entry it would push out, keeping one-hit wonders from
+// flushing the cache
+type tinyLFU struct {
+	*lru
+	sketch *sketch
+}
+
+func (p *tinyLFU) record(key string) {
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFU) admit(key string, victim *entry) bool {
+	return victim == nil || p.sketch.estimate(key) > p.sketch.estimate(victim.key)
+}
+
+// sketch is a count-min sketch of 4-bit-ish counters, halved every so
+// often so old popularity fades away
+type sketch struct {
+	rows    [4][]uint8
+	mask    uint64
+	adds    int
+	resetAt int
+}
+
+func newSketch(width int64) *sketch {
+	size := uint64(64)
+	for int64(size) < width {
+		size <<= 1
+	}
+
+	s := &sketch{mask: size - 1, resetAt: int(size) * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// slots returns the counter index in each row for key
+func (s *sketch) slots(key string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	var slots [4]uint64
+	for i := range slots {
+		// Double hashing, good enough for a sketch
+		slots[i] = (sum + uint64(i)*(sum>>32|1)) & s.mask
+	}
+	return slots
+}
+
+func (s *sketch) increment(key string) {
+	for i, slot := range s.slots(key) {
+		if s.rows[i][slot] < 15 {
+			s.rows[i][slot]++
+		}
+	}
+
+	s.adds++
+	if s.adds >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	est := uint8(15)
+	for i, slot := range s.slots(key) {
+		if s.rows[i][slot] < est {
+			est = s.rows[i][slot]
+		}
+	}
+	return est
+}
+
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.adds /= 2
+}
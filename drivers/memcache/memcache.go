@@ -1,9 +1,12 @@
 package memcache
 
 import (
-	"log"
+	"fmt"
+	"strings"
+	"time"
 
 	gomemcache "github.com/bradfitz/gomemcache/memcache"
+	"github.com/wmgaca/gostorm"
 )
 
 // Driver for Gostorm
@@ -11,9 +14,13 @@ type Driver struct {
 	conn gomemcache.Client
 }
 
-// New returns a new memcache.Driver
+// New returns a new memcache.Driver for connString, a "host:port". There's
+// no TLS: gomemcache dials plain TCP with no way to hook in, so reach a
+// memcached that needs TLS through a tunnel like stunnel.
 func New(connString string) (*Driver, error) {
-	log.Printf("Connecting to memcached => %s", connString)
+	if strings.Contains(connString, "://") {
+		return nil, fmt.Errorf("memcache: want host:port, got a URL, TLS isn't supported")
+	}
 
 	driver := &Driver{
 		conn: *gomemcache.New(connString),
@@ -22,9 +29,17 @@ func New(connString string) (*Driver, error) {
 	return driver, nil
 }
 
+// Name of the driver
+func (drv *Driver) Name() string {
+	return "memcache"
+}
+
 // Get gets data ;)
 func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
-	ret, err := drv.conn.Get("go:test")
+	ret, err := drv.conn.Get(key)
+	if err == gomemcache.ErrCacheMiss {
+		err = gostorm.ErrNotFound
+	}
 
 	if err != nil {
 		errChan <- err
@@ -47,3 +62,65 @@ func (drv *Driver) Set(key, value string, retChan chan string, errChan chan erro
 	}
 
 }
+
+// SetWithTTL sets data that expires after ttl
+func (drv *Driver) SetWithTTL(key, value string, ttl time.Duration, retChan chan string, errChan chan error) {
+	err := drv.conn.Set(&gomemcache.Item{
+		Key:        key,
+		Value:      []byte(value),
+		Expiration: expiration(ttl),
+	})
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// Expire changes the TTL of an existing key, zero meaning never
+func (drv *Driver) Expire(key string, ttl time.Duration, retChan chan string, errChan chan error) {
+	err := drv.conn.Touch(key, expiration(ttl))
+	if err == gomemcache.ErrCacheMiss {
+		err = gostorm.ErrNotFound
+	}
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// TTL can't be done, memcached won't tell
+func (drv *Driver) TTL(key string, retChan chan time.Duration, errChan chan error) {
+	errChan <- gostorm.ErrUnsupported
+}
+
+// maxRelativeExpiration is as far as memcached takes relative expirations,
+// anything later has to be a unix timestamp
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// expiration turns a TTL into memcached's expiration, in whole seconds
+func expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Unix()) + seconds
+	}
+	return seconds
+}
+
+// Delete deletes data :(
+func (drv *Driver) Delete(key string, retChan chan string, errChan chan error) {
+	err := drv.conn.Delete(key)
+
+	if err != nil && err != gomemcache.ErrCacheMiss {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
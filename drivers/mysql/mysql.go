@@ -1,14 +1,20 @@
 package mysql
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
 
-	// Well, go vet makes me comment on this.
-	_ "github.com/go-sql-driver/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
 )
 
+// tlsConfigs numbers the TLS configs NewTLS registers
+var tlsConfigs int32
+
 // Driver does the driving
 type Driver struct {
 	conn *sql.DB
@@ -18,18 +24,40 @@ type Driver struct {
 func New(connString string) (*Driver, error) {
 	// Package mysql should:
 	myConn, err := sql.Open("mysql", connString)
-
-	log.Printf("Connecting to MySQL => %s", connString)
-
 	if err != nil {
 		return nil, errors.New("Can't connect to MySQL.")
 	}
 
-	log.Println("Connecting to MySQL => OK")
+	slog.Info("mysql: connected")
 
 	return &Driver{conn: myConn}, nil
 }
 
+// NewTLS is New connecting over TLS set up by config, see
+// tlsconfig.FromQuery. config needs its ServerName set, unless it skips
+// verification.
+func NewTLS(connString string, config *tls.Config) (*Driver, error) {
+	if strings.Contains(connString, "tls=") {
+		return nil, errors.New("mysql: connString already says how to do TLS")
+	}
+
+	name := fmt.Sprintf("gostorm-%d", atomic.AddInt32(&tlsConfigs, 1))
+	if err := mysqldriver.RegisterTLSConfig(name, config); err != nil {
+		return nil, err
+	}
+
+	sep := "?"
+	if strings.Contains(connString, "?") {
+		sep = "&"
+	}
+	return New(connString + sep + "tls=" + name)
+}
+
+// Close closes the connections
+func (drv *Driver) Close() error {
+	return drv.conn.Close()
+}
+
 // Get the value!
 func (drv *Driver) Get() {
 
@@ -3,27 +3,61 @@ package redis
 import (
 	// "errors"
 
-	"log"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/url"
 	"strings"
+	"time"
 
 	redigo "github.com/garyburd/redigo/redis"
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/tlsconfig"
 )
 
-const redisProtocol = "tcp"
+const (
+	redisProtocol = "tcp"
+
+	maxIdleConns = 8
+	idleTimeout  = 4 * time.Minute
+	dialTimeout  = 10 * time.Second
+
+	scanCount = 1000
+)
+
+// globEscaper makes a prefix safe to use in a MATCH pattern
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
 
 // Driver for Gostorm
 type Driver struct {
-	conn redigo.Conn
+	pool *redigo.Pool
 }
 
-// New returns a new RedisDriver, duh.
+// New returns a new RedisDriver, duh. A "rediss://" connString connects
+// over TLS, "?ca=...&cert=...&key=..." setting it up, see
+// tlsconfig.FromQuery.
 func New(connString string) (*Driver, error) {
 	redisURL, err := url.Parse(connString)
 	if err != nil {
 		return nil, err
 	}
 
+	var tlsConfig *tls.Config
+	switch redisURL.Scheme {
+	case "rediss":
+		if tlsConfig, err = tlsconfig.FromQuery(redisURL.Query()); err != nil {
+			return nil, err
+		}
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig.ServerName = redisURL.Hostname()
+		}
+	case "redis":
+		if tlsconfig.HasParams(redisURL.Query()) {
+			return nil, fmt.Errorf("redis: TLS settings need a rediss:// URL")
+		}
+	}
+
 	auth := ""
 	if redisURL.User != nil {
 		if password, ok := redisURL.User.Password(); ok {
@@ -31,31 +65,81 @@ func New(connString string) (*Driver, error) {
 		}
 	}
 
-	conn, err := redigo.Dial(redisProtocol, redisURL.Host)
-	if err != nil {
-		return nil, err
+	db := ""
+	if len(redisURL.Path) > 1 {
+		db = strings.TrimPrefix(redisURL.Path, "/")
 	}
 
-	if len(auth) > 0 {
-		_, err = conn.Do("AUTH", auth)
-		if err != nil {
-			return nil, err
+	dial := func() (redigo.Conn, error) {
+		var conn redigo.Conn
+		if tlsConfig != nil {
+			netConn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, redisProtocol, redisURL.Host, tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			conn = redigo.NewConn(netConn, 0, 0)
+		} else {
+			var err error
+			if conn, err = redigo.Dial(redisProtocol, redisURL.Host); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(auth) > 0 {
+			if _, err := conn.Do("AUTH", auth); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		if len(db) > 0 {
+			if _, err := conn.Do("SELECT", db); err != nil {
+				conn.Close()
+				return nil, err
+			}
 		}
+
+		return conn, nil
 	}
 
-	if len(redisURL.Path) > 1 {
-		db := strings.TrimPrefix(redisURL.Path, "/")
-		conn.Do("SELECT", db)
+	// A broken redigo.Conn stays broken, so connections come from a pool
+	// and a retried call gets a fresh one.
+	pool := &redigo.Pool{
+		Dial:        dial,
+		MaxIdle:     maxIdleConns,
+		IdleTimeout: idleTimeout,
 	}
 
-	log.Println("redis.New OK")
+	conn := pool.Get()
+	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("redis: connected")
+
+	return &Driver{pool: pool}, nil
+}
 
-	return &Driver{conn: conn}, nil
+// Name of the driver
+func (drv *Driver) Name() string {
+	return "redis"
+}
+
+// Close closes the pool's connections
+func (drv *Driver) Close() error {
+	return drv.pool.Close()
 }
 
 // Get return a value for a given key or an error if occured
 func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
-	ret, err := redigo.String(drv.conn.Do("get", key))
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	ret, err := redigo.String(conn.Do("get", key))
+	if err == redigo.ErrNil {
+		err = gostorm.ErrNotFound
+	}
 
 	if err != nil {
 		errChan <- err
@@ -66,14 +150,130 @@ func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
 
 // Set sets data :)
 func (drv *Driver) Set(key, value string, retChan chan string, errChan chan error) {
-	log.Printf("redis.set %s=%s", key, value)
-	ret, err := redigo.String(drv.conn.Do("set", key, value))
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	ret, err := redigo.String(conn.Do("set", key, value))
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ret
+	}
+}
+
+// SetWithTTL sets data that expires after ttl
+func (drv *Driver) SetWithTTL(key, value string, ttl time.Duration, retChan chan string, errChan chan error) {
+	if ttl <= 0 {
+		drv.Set(key, value, retChan, errChan)
+		return
+	}
+
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	ret, err := redigo.String(conn.Do("set", key, value, "px", milliseconds(ttl)))
 
 	if err != nil {
-		log.Printf("redis.set err=%s", err.Error())
 		errChan <- err
 	} else {
-		log.Println("redis.set OK")
 		retChan <- ret
 	}
 }
+
+// Expire changes the TTL of an existing key, zero meaning never
+func (drv *Driver) Expire(key string, ttl time.Duration, retChan chan string, errChan chan error) {
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	var (
+		found bool
+		err   error
+	)
+
+	if ttl > 0 {
+		found, err = redigo.Bool(conn.Do("pexpire", key, milliseconds(ttl)))
+	} else if found, err = redigo.Bool(conn.Do("exists", key)); err == nil && found {
+		_, err = conn.Do("persist", key)
+	}
+
+	if err == nil && !found {
+		err = gostorm.ErrNotFound
+	}
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// TTL returns how long a key has left
+func (drv *Driver) TTL(key string, retChan chan time.Duration, errChan chan error) {
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	ms, err := redigo.Int64(conn.Do("pttl", key))
+
+	switch {
+	case err != nil:
+		errChan <- err
+	case ms == -2:
+		errChan <- gostorm.ErrNotFound
+	case ms == -1:
+		retChan <- gostorm.NoExpiry
+	default:
+		retChan <- time.Duration(ms) * time.Millisecond
+	}
+}
+
+// milliseconds rounds ttl up to whole milliseconds, the finest redis does
+func milliseconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// List lists keys starting with prefix, SCANning rather than KEYS so a big
+// keyspace doesn't block the server
+func (drv *Driver) List(prefix string, retChan chan []string, errChan chan error) {
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	pattern := globEscaper.Replace(prefix) + "*"
+	keys := []string{}
+	cursor := "0"
+
+	for {
+		values, err := redigo.Values(conn.Do("scan", cursor, "match", pattern, "count", scanCount))
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		var batch []string
+		if _, err := redigo.Scan(values, &cursor, &batch); err != nil {
+			errChan <- err
+			return
+		}
+
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			break
+		}
+	}
+
+	retChan <- keys
+}
+
+// Delete removes a key, missing or not
+func (drv *Driver) Delete(key string, retChan chan string, errChan chan error) {
+	conn := drv.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("del", key)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
@@ -0,0 +1,175 @@
+// Package upstream is a Gostorm driver backed by another gostorm server's
+// HTTP API, or anything speaking the same REST dialect, so a regional
+// gostorm can sit in front of a central one.
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/client"
+	"github.com/wmgaca/gostorm/tlsconfig"
+)
+
+const defaultTimeout = 2 * time.Second
+
+// Driver for Gostorm
+type Driver struct {
+	client *client.Client
+	span   gostorm.SpanContext
+}
+
+// New returns a new upstream.Driver for a conn string like
+// "http://central:8080?timeout=500ms", https works too. Several servers,
+// "http://central-1:8080,http://central-2:8080", are failed over between.
+// For https "ca", "cert", "key" and "server_name" set up TLS, see
+// tlsconfig.FromQuery.
+func New(connString string) (*Driver, error) {
+	servers := strings.Split(connString, ",")
+
+	last, err := url.Parse(servers[len(servers)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultTimeout
+	if s := last.Query().Get("timeout"); len(s) > 0 {
+		if timeout, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("upstream: %s", err)
+		}
+	}
+
+	// Gostorm retries failed calls itself, the client only fails over
+	opts := []client.Option{
+		client.WithTimeout(timeout),
+		client.WithRetry(gostorm.RetryPolicy{MaxAttempts: 1}),
+	}
+
+	if tlsconfig.HasParams(last.Query()) {
+		config, err := tlsconfig.FromQuery(last.Query())
+		if err != nil {
+			return nil, fmt.Errorf("upstream: %s", err)
+		}
+		opts = append(opts, client.WithTLS(config))
+	}
+
+	c, err := client.New(servers, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %s", err)
+	}
+
+	return &Driver{client: c}, nil
+}
+
+// Name of the driver
+func (drv *Driver) Name() string {
+	return "upstream"
+}
+
+// Close closes idle connections to the servers
+func (drv *Driver) Close() error {
+	return drv.client.Close()
+}
+
+// WithSpan returns a Driver whose calls are part of the trace sc, so the
+// upstream's spans join it
+func (drv *Driver) WithSpan(sc gostorm.SpanContext) gostorm.Driver {
+	return &Driver{client: drv.client, span: sc}
+}
+
+func (drv *Driver) ctx() context.Context {
+	return client.ContextWithSpan(context.Background(), drv.span)
+}
+
+// Get gets data ;)
+func (drv *Driver) Get(key string, retChan chan string, errChan chan error) {
+	value, err := drv.client.Get(drv.ctx(), key)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- value
+	}
+}
+
+// Set sets data :)
+func (drv *Driver) Set(key, value string, retChan chan string, errChan chan error) {
+	err := drv.client.Set(drv.ctx(), key, value)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// Delete deletes data :(
+func (drv *Driver) Delete(key string, retChan chan string, errChan chan error) {
+	err := drv.client.Delete(drv.ctx(), key)
+
+	if err != nil && !gostorm.IsNotFound(err) {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// SetWithTTL sets data that expires after ttl, zero meaning never
+func (drv *Driver) SetWithTTL(key, value string, ttl time.Duration, retChan chan string, errChan chan error) {
+	err := drv.client.SetWithTTL(drv.ctx(), key, value, ttl)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// Expire changes the TTL of an existing key, zero meaning never
+func (drv *Driver) Expire(key string, ttl time.Duration, retChan chan string, errChan chan error) {
+	err := drv.client.Expire(drv.ctx(), key, ttl)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ""
+	}
+}
+
+// TTL returns how long a key has left, gostorm.NoExpiry if it lives forever
+func (drv *Driver) TTL(key string, retChan chan time.Duration, errChan chan error) {
+	ttl, err := drv.client.TTL(drv.ctx(), key)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- ttl
+	}
+}
+
+// List lists keys starting with prefix
+func (drv *Driver) List(prefix string, retChan chan []string, errChan chan error) {
+	keys, err := drv.client.List(drv.ctx(), prefix)
+
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- keys
+	}
+}
+
+// GetMulti gets many keys in a single round trip if the upstream has
+// batch endpoints, one by one if it doesn't. Errors are per key.
+func (drv *Driver) GetMulti(keys []string) (map[string]string, map[string]error) {
+	return drv.client.GetMulti(drv.ctx(), keys)
+}
+
+// SetMulti sets many keys in a single round trip if the upstream has batch
+// endpoints, one by one if it doesn't. Errors are per key.
+func (drv *Driver) SetMulti(values map[string]string) map[string]error {
+	return drv.client.SetMulti(drv.ctx(), values)
+}
@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/drivers/mem"
+)
+
+// central starts a gostorm server over a mem driver, mangled by wrap
+func central(t *testing.T, wrap func(http.Handler) http.Handler) *Driver {
+	t.Helper()
+
+	drv, err := mem.New("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := gostorm.New(gostorm.WithDriver(drv), gostorm.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	s := httptest.NewServer(wrap(gostorm.NewHandler(gs)))
+	t.Cleanup(s.Close)
+
+	upstream, err := New(s.URL + "?timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+func noWrap(h http.Handler) http.Handler {
+	return h
+}
+
+func get(drv *Driver, key string) (string, error) {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	drv.Get(key, retChan, errChan)
+	select {
+	case v := <-retChan:
+		return v, nil
+	case err := <-errChan:
+		return "", err
+	}
+}
+
+func wait(call func(retChan chan string, errChan chan error)) error {
+	retChan, errChan := make(chan string, 1), make(chan error, 1)
+	call(retChan, errChan)
+	select {
+	case <-retChan:
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+func ttl(drv *Driver, key string) (time.Duration, error) {
+	retChan, errChan := make(chan time.Duration, 1), make(chan error, 1)
+	drv.TTL(key, retChan, errChan)
+	select {
+	case ttl := <-retChan:
+		return ttl, nil
+	case err := <-errChan:
+		return 0, err
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	drv := central(t, noWrap)
+
+	if err := wait(func(r chan string, e chan error) { drv.Set("a/b%c", "v", r, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := get(drv, "a/b%c"); err != nil || value != "v" {
+		t.Errorf("got %q, %v", value, err)
+	}
+
+	if err := wait(func(r chan string, e chan error) { drv.Delete("a/b%c", r, e) }); err != nil {
+		t.Error(err)
+	}
+	if _, err := get(drv, "a/b%c"); !gostorm.IsNotFound(err) {
+		t.Errorf("after a delete got %v, want not found", err)
+	}
+	if err := wait(func(r chan string, e chan error) { drv.Delete("a/b%c", r, e) }); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	drv := central(t, noWrap)
+
+	if err := wait(func(r chan string, e chan error) { drv.SetWithTTL("k", "v", time.Minute, r, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if left, err := ttl(drv, "k"); err != nil || left <= 59*time.Second || left > time.Minute {
+		t.Errorf("got %s, %v, want about a minute", left, err)
+	}
+
+	if err := wait(func(r chan string, e chan error) { drv.Expire("k", 0, r, e) }); err != nil {
+		t.Fatal(err)
+	}
+	if left, err := ttl(drv, "k"); err != nil || left != gostorm.NoExpiry {
+		t.Errorf("got %s, %v, want no expiry", left, err)
+	}
+
+	if err := wait(func(r chan string, e chan error) { drv.Expire("missing", time.Minute, r, e) }); !gostorm.IsNotFound(err) {
+		t.Errorf("expiring a missing key got %v, want not found", err)
+	}
+	if _, err := ttl(drv, "missing"); !gostorm.IsNotFound(err) {
+		t.Errorf("the TTL of a missing key got %v, want not found", err)
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	var batches int32
+
+	// An older upstream, without the batch endpoints
+	drv := central(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/mget" || r.URL.Path == "/v1/mset" {
+				atomic.AddInt32(&batches, 1)
+				http.NotFound(w, r)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	if errs := drv.SetMulti(map[string]string{"a": "1", "b": "2"}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	values, errs := drv.GetMulti([]string{"a", "b", "c"})
+	if len(values) != 2 || values["a"] != "1" || values["b"] != "2" {
+		t.Errorf("got %v", values)
+	}
+	if len(errs) != 1 || !gostorm.IsNotFound(errs["c"]) {
+		t.Errorf("got errors %v, want c not found", errs)
+	}
+
+	if n := atomic.LoadInt32(&batches); n != 1 {
+		t.Errorf("the batch endpoints got %d calls, want 1", n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var singles int32
+
+	drv := central(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/mget" && r.URL.Path != "/v1/mset" {
+				atomic.AddInt32(&singles, 1)
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	if errs := drv.SetMulti(map[string]string{"a": "1", "b": "2"}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	values, errs := drv.GetMulti([]string{"a", "b", "c"})
+	if len(values) != 2 || values["a"] != "1" || !gostorm.IsNotFound(errs["c"]) {
+		t.Errorf("got %v, %v", values, errs)
+	}
+
+	if n := atomic.LoadInt32(&singles); n != 0 {
+		t.Errorf("%d single key calls, want none", n)
+	}
+}
@@ -0,0 +1,134 @@
+package gostorm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors Gostorm returns, compare against them with errors.Is
+var (
+	// ErrNotFound means no driver has the key, drivers return it on a miss
+	ErrNotFound = errors.New("gostorm: key not found")
+
+	// ErrTimeout means the request ran out of time
+	ErrTimeout = errors.New("gostorm: timeout")
+
+	// ErrNoDrivers means there's nothing to fan out to
+	ErrNoDrivers = errors.New("gostorm: no drivers configured")
+
+	// ErrUnsupported means a driver can't do what it was asked to
+	ErrUnsupported = errors.New("gostorm: operation not supported")
+
+	// ErrShutdown means Shutdown was called, no new operations are taken
+	ErrShutdown = errors.New("gostorm: shutting down")
+)
+
+// DriverError is the outcome of a single failed driver call
+type DriverError struct {
+	Driver string
+	Op     Op
+	Err    error
+}
+
+func (e *DriverError) Error() string {
+	return fmt.Sprintf("%s.%s: %s", e.Driver, e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DriverError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned when no driver succeeded, it holds one
+// DriverError per driver
+type MultiError struct {
+	Errors []*DriverError
+}
+
+// Cause sums the driver errors up: ErrNotFound if every driver missed,
+// ErrUnsupported if none of them could do it, otherwise ErrTimeout if any
+// of them timed out, nil if it's a mixed bag
+func (e *MultiError) Cause() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+
+	for _, cause := range []error{ErrNotFound, ErrUnsupported} {
+		all := true
+		for _, err := range e.Errors {
+			if !errors.Is(err, cause) {
+				all = false
+			}
+		}
+		if all {
+			return cause
+		}
+	}
+
+	for _, err := range e.Errors {
+		if errors.Is(err, ErrTimeout) {
+			return ErrTimeout
+		}
+	}
+
+	return nil
+}
+
+func (e *MultiError) Error() string {
+	summary := "gostorm: all drivers failed"
+	if cause := e.Cause(); cause != nil {
+		summary = cause.Error()
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%s (%s)", summary, strings.Join(msgs, "; "))
+}
+
+// Is makes errors.Is(err, ErrNotFound) and friends work on the summary
+func (e *MultiError) Is(target error) bool {
+	cause := e.Cause()
+	return cause != nil && cause == target
+}
+
+// IsNotFound tells whether err means the key doesn't exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsTimeout tells whether err means the request ran out of time
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout)
+}
+
+// ErrorClass sorts errors into "timeout", "not_found", "unsupported",
+// "transient" and "other", for metrics and traces. It's "" for nil.
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case IsTimeout(err):
+		return "timeout"
+	case IsNotFound(err):
+		return "not_found"
+	case errors.Is(err, ErrUnsupported):
+		return "unsupported"
+	case IsTransient(err):
+		return "transient"
+	}
+	return "other"
+}
+
+// driverName returns a driver's Name() if it has one, its type otherwise
+func driverName(drv Driver) string {
+	if named, ok := drv.(interface {
+		Name() string
+	}); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", drv)
+}
@@ -0,0 +1,65 @@
+package gostorm
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func multi(errs ...error) *MultiError {
+	m := &MultiError{}
+	for i, err := range errs {
+		m.Errors = append(m.Errors, &DriverError{Driver: string(rune('a' + i)), Op: OpGet, Err: err})
+	}
+	return m
+}
+
+func TestMultiErrorCause(t *testing.T) {
+	other := errors.New("boom")
+
+	tests := []struct {
+		name string
+		err  *MultiError
+		want error
+	}{
+		{"none", multi(), nil},
+		{"all missed", multi(ErrNotFound, ErrNotFound), ErrNotFound},
+		{"all unsupported", multi(ErrUnsupported, ErrUnsupported), ErrUnsupported},
+		{"one timed out", multi(ErrNotFound, ErrTimeout), ErrTimeout},
+		{"unsupported and timed out", multi(ErrUnsupported, ErrTimeout), ErrTimeout},
+		{"unsupported and missed", multi(ErrUnsupported, ErrNotFound), nil},
+		{"mixed bag", multi(other, ErrNotFound), nil},
+	}
+
+	for _, test := range tests {
+		if got := test.err.Cause(); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if test.want != nil && !errors.Is(test.err, test.want) {
+			t.Errorf("%s: errors.Is(err, %v) is false", test.name, test.want)
+		}
+	}
+}
+
+func TestStatusFor(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{multi(ErrNotFound), http.StatusNotFound, "not_found"},
+		{multi(ErrTimeout, ErrNotFound), http.StatusGatewayTimeout, "timeout"},
+		{multi(ErrUnsupported, ErrUnsupported), http.StatusNotImplemented, "unsupported"},
+		{ErrNoDrivers, http.StatusServiceUnavailable, "no_drivers"},
+		{ErrShutdown, http.StatusServiceUnavailable, "shutting_down"},
+		{ErrQuotaExceeded, http.StatusInsufficientStorage, "quota_exceeded"},
+		{multi(errors.New("boom")), http.StatusBadGateway, "driver_error"},
+	}
+
+	for _, test := range tests {
+		status, code := statusFor(test.err)
+		if status != test.status || code != test.code {
+			t.Errorf("%v: got %d %s, want %d %s", test.err, status, code, test.status, test.code)
+		}
+	}
+}
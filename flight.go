@@ -0,0 +1,54 @@
+package gostorm
+
+import (
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces concurrent calls for the same key into a single one
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in progress, followers wait for done to be closed
+type flight struct {
+	done chan struct{}
+	ret  string
+	err  error
+}
+
+// do starts fn for key, unless a call for key is already in flight, and
+// waits for the call's result, but no longer than timeout. The call runs on
+// its own budget, so whoever started it giving up early doesn't cut it
+// short for the others. shared tells whether the call was someone else's.
+func (g *flightGroup) do(key string, timeout <-chan time.Time, fn func() (string, error)) (ret string, err error, shared bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+
+	f, shared := g.flights[key]
+	if !shared {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+
+		go func() {
+			f.ret, f.err = fn()
+
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.ret, f.err, shared
+	case <-timeout:
+		return "", ErrTimeout, shared
+	}
+}
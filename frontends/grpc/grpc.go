@@ -0,0 +1,503 @@
+// Package grpc serves a Gostorm over gRPC, as defined in gostorm.proto.
+// The Handler is an http.Handler, so it can share a port with the HTTP API:
+// route requests to it with IsGRPC and serve HTTP/2, in the clear or over
+// TLS.
+//
+// Calls go through gostorm.Instrument, so they're traced, logged and
+// measured like the HTTP API's requests, and run for the tenant in
+// gostorm.TenantHeader, held to its quotas and rate. Behind auth.Handler
+// each call's keys are checked against the principal's grants.
+//
+// Only what gostorm.proto needs of gRPC is implemented: no compression, and
+// messages are limited to 4MB like in most gRPC implementations.
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/auth"
+)
+
+const (
+	// maxMessageSize caps a single message either way
+	maxMessageSize = 4 << 20
+
+	// maxKeyLength matches the HTTP API
+	maxKeyLength = 250
+
+	// batchConcurrency is how many operations of a Batch stream run at once
+	batchConcurrency = 64
+
+	servicePrefix = "/gostorm.v1.Gostorm/"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	codeOK                = 0
+	codeInvalidArgument   = 3
+	codeDeadlineExceeded  = 4
+	codeNotFound          = 5
+	codePermissionDenied  = 7
+	codeResourceExhausted = 8
+	codeAborted           = 10
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
+)
+
+// methods are the methods of the service
+var methods = []string{"Get", "Set", "Delete", "Batch", "Watch"}
+
+// Handler serves the gostorm.v1.Gostorm service
+type Handler struct {
+	gs      *gostorm.Gostorm
+	routes  map[string]http.Handler
+	unknown http.Handler
+}
+
+// NewHandler returns a Handler serving gs
+func NewHandler(gs *gostorm.Gostorm) *Handler {
+	h := &Handler{gs: gs, routes: make(map[string]http.Handler)}
+	for _, method := range methods {
+		h.routes[servicePrefix+method] = gostorm.Instrument(gs, servicePrefix+method, http.HandlerFunc(h.serve))
+	}
+	h.unknown = gostorm.Instrument(gs, "grpc unmatched", http.HandlerFunc(h.serve))
+	return h
+}
+
+// IsGRPC tells whether r is a gRPC call rather than a plain HTTP request
+func IsGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// rpcError is a failed call, ending it with its status code
+type rpcError struct {
+	code    int
+	message string
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("grpc: code %d: %s", e.code, e.message)
+}
+
+func errorf(code int, format string, v ...interface{}) *rpcError {
+	return &rpcError{code: code, message: fmt.Sprintf(format, v...)}
+}
+
+// statusOf maps an error from Gostorm to a status
+func statusOf(err error) *status {
+	var rerr *rpcError
+
+	switch {
+	case errors.As(err, &rerr):
+		return &status{code: rerr.code, message: rerr.message}
+	case gostorm.IsNotFound(err):
+		return &status{code: codeNotFound, message: err.Error()}
+	case gostorm.IsTimeout(err):
+		return &status{code: codeDeadlineExceeded, message: err.Error()}
+	case errors.Is(err, gostorm.ErrUnsupported):
+		return &status{code: codeUnimplemented, message: err.Error()}
+	case errors.Is(err, gostorm.ErrUnknownTenant):
+		return &status{code: codeInvalidArgument, message: err.Error()}
+	case errors.Is(err, gostorm.ErrThrottled), errors.Is(err, gostorm.ErrQuotaExceeded):
+		return &status{code: codeResourceExhausted, message: err.Error()}
+	}
+	return &status{code: codeUnavailable, message: err.Error()}
+}
+
+// stream is a call in progress, reading requests off the body and writing
+// responses, the writes being safe to make from several goroutines
+type stream struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	call    *gostorm.Caller
+	timeout time.Duration
+
+	// principal is who auth.Handler let in, nil without auth
+	principal *auth.Principal
+
+	mu      sync.Mutex
+	started bool
+}
+
+// startLocked sends the response headers, once, the status going in the
+// trailers that follow the messages
+func (s *stream) startLocked() {
+	if s.started {
+		return
+	}
+	s.started = true
+
+	s.w.Header().Set("Content-Type", "application/grpc")
+	s.w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// flush gets the response headers out, and whatever was sent so far
+func (s *stream) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startLocked()
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish ends the call with its status, in trailers, or in the headers
+// alone when nothing was sent, like gRPC's trailers-only responses
+func (s *stream) finish(st *status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/grpc")
+	}
+	s.w.Header().Set("Grpc-Status", strconv.Itoa(st.code))
+	if len(st.message) > 0 {
+		s.w.Header().Set("Grpc-Message", url.PathEscape(st.message))
+	}
+	if !s.started {
+		s.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *stream) recv(msg interface{ unmarshal([]byte) error }) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(s.r.Body, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errorf(codeInternal, "truncated message")
+		}
+		return err
+	}
+
+	if prefix[0] != 0 {
+		return errorf(codeUnimplemented, "compressed messages aren't supported")
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return errorf(codeResourceExhausted, "message larger than %d bytes", maxMessageSize)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(s.r.Body, buf); err != nil {
+		return errorf(codeInternal, "truncated message")
+	}
+
+	if err := msg.unmarshal(buf); err != nil {
+		return errorf(codeInternal, "%s", err)
+	}
+
+	return nil
+}
+
+func (s *stream) send(msg interface{ marshal() []byte }) error {
+	payload := msg.marshal()
+
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startLocked()
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// ServeHTTP runs a call, always answering 200 with the outcome in the
+// grpc-status trailer, or header if the call failed before sending anything
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsGRPC(r) || r.Method != "POST" {
+		http.Error(w, "not a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	route, ok := h.routes[r.URL.Path]
+	if !ok {
+		route = h.unknown
+	}
+	route.ServeHTTP(w, r)
+}
+
+// serve runs a call once it's instrumented
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	s := &stream{w: w, r: r, timeout: h.timeout(r)}
+	s.principal, _ = auth.PrincipalFromContext(r.Context())
+
+	call, err := h.gs.CallerFor(r)
+	if err == nil {
+		s.call = call
+		err = h.call(strings.TrimPrefix(r.URL.Path, servicePrefix), s)
+	}
+
+	st := &status{code: codeOK}
+	if err != nil {
+		st = statusOf(err)
+	}
+	s.finish(st)
+}
+
+// timeout is the grpc-timeout the client asked for, capped at the
+// Gostorm's own timeout like with the HTTP API
+func (h *Handler) timeout(r *http.Request) time.Duration {
+	max := h.gs.Timeout()
+
+	header := r.Header.Get("Grpc-Timeout")
+	if len(header) < 2 {
+		return max
+	}
+
+	n, err := strconv.ParseInt(header[:len(header)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return max
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	unit, ok := units[header[len(header)-1]]
+	if !ok || n > int64(max/unit) {
+		return max
+	}
+
+	return time.Duration(n) * unit
+}
+
+func (h *Handler) call(method string, s *stream) error {
+	switch method {
+	case "Get":
+		return h.get(s)
+	case "Set":
+		return h.set(s)
+	case "Delete":
+		return h.delete(s)
+	case "Batch":
+		return h.batch(s)
+	case "Watch":
+		return h.watch(s)
+	}
+	return errorf(codeUnimplemented, "unknown method %s", s.r.URL.Path)
+}
+
+func checkKey(key string) error {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return errorf(codeInvalidArgument, "key must be 1-%d bytes", maxKeyLength)
+	}
+	return nil
+}
+
+// allow checks the principal may do perm on key, or on every key under it
+// for a watch
+func (s *stream) allow(perm auth.Perm, key string) error {
+	if s.principal == nil || s.principal.Can(perm, key) {
+		return nil
+	}
+	return errorf(codePermissionDenied, "%s needed on %q", perm, key)
+}
+
+func (s *stream) doGet(req *getRequest) (string, error) {
+	if err := checkKey(req.key); err != nil {
+		return "", err
+	}
+	if err := s.allow(auth.Read, req.key); err != nil {
+		return "", err
+	}
+	return s.call.Get(req.key, s.timeout)
+}
+
+func (s *stream) doSet(req *setRequest) error {
+	if err := checkKey(req.key); err != nil {
+		return err
+	}
+	if req.ttl < 0 {
+		return errorf(codeInvalidArgument, "ttl_ms can't be negative")
+	}
+	if err := s.allow(auth.Write, req.key); err != nil {
+		return err
+	}
+	return s.call.SetWithTTL(req.key, req.value, req.ttl, s.timeout)
+}
+
+func (s *stream) doDelete(req *deleteRequest) error {
+	if err := checkKey(req.key); err != nil {
+		return err
+	}
+	if err := s.allow(auth.Write, req.key); err != nil {
+		return err
+	}
+	return s.call.Delete(req.key, s.timeout)
+}
+
+func (h *Handler) get(s *stream) error {
+	req := &getRequest{}
+	if err := s.recv(req); err != nil {
+		return err
+	}
+
+	value, err := s.doGet(req)
+	if err != nil {
+		return err
+	}
+
+	return s.send(&getResponse{value: value})
+}
+
+// empty is SetResponse and DeleteResponse
+type empty struct{}
+
+func (empty) marshal() []byte { return nil }
+
+func (h *Handler) set(s *stream) error {
+	req := &setRequest{}
+	if err := s.recv(req); err != nil {
+		return err
+	}
+
+	if err := s.doSet(req); err != nil {
+		return err
+	}
+
+	return s.send(empty{})
+}
+
+func (h *Handler) delete(s *stream) error {
+	req := &deleteRequest{}
+	if err := s.recv(req); err != nil {
+		return err
+	}
+
+	if err := s.doDelete(req); err != nil {
+		return err
+	}
+
+	return s.send(empty{})
+}
+
+// batch runs operations as they come in, up to batchConcurrency at once,
+// each with the call's timeout
+func (h *Handler) batch(s *stream) error {
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	var sendErr error
+	var once sync.Once
+
+	defer wg.Wait()
+
+	for {
+		req := &batchRequest{}
+		err := s.recv(req)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-s.r.Context().Done():
+			return s.r.Context().Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			resp := &batchResponse{id: req.id}
+
+			var err error
+			switch {
+			case req.get != nil:
+				resp.value, err = s.doGet(req.get)
+			case req.set != nil:
+				err = s.doSet(req.set)
+			case req.del != nil:
+				err = s.doDelete(req.del)
+			default:
+				err = errorf(codeInvalidArgument, "no operation in request %d", req.id)
+			}
+
+			if err != nil {
+				resp.err = statusOf(err)
+			}
+
+			if err := s.send(resp); err != nil {
+				once.Do(func() { sendErr = err })
+			}
+		}()
+	}
+
+	wg.Wait()
+	return sendErr
+}
+
+// watch streams events until the client goes away or falls behind
+func (h *Handler) watch(s *stream) error {
+	req := &watchRequest{}
+	if err := s.recv(req); err != nil {
+		return err
+	}
+
+	if err := s.allow(auth.Read, req.prefix); err != nil {
+		return err
+	}
+
+	watcher := s.call.Watch(req.prefix)
+	defer watcher.Stop()
+
+	// The response headers go out now, so the client knows it's watching
+	s.flush()
+
+	for {
+		select {
+		case e, ok := <-watcher.C:
+			if !ok {
+				if err := watcher.Err(); err != nil {
+					return errorf(codeAborted, "%s", err)
+				}
+				return nil
+			}
+
+			event := &watchEvent{key: e.Key, value: e.Value, ttl: e.TTL}
+			switch e.Op {
+			case gostorm.OpDelete:
+				event.typ = eventDelete
+			case gostorm.OpExpire:
+				event.typ = eventExpire
+			}
+
+			if err := s.send(event); err != nil {
+				return err
+			}
+		case <-s.r.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package grpc_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/auth"
+	"github.com/wmgaca/gostorm/drivers/mem"
+	"github.com/wmgaca/gostorm/frontends/grpc"
+)
+
+// These tests talk to the Handler the way any gRPC client would, with Go's
+// own HTTP/2 client and protobuf messages written out byte by byte, so
+// they don't lean on the package's codec.
+
+func varint(field int, v uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func bytesField(field int, v []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func str(field int, v string) []byte {
+	return bytesField(field, []byte(v))
+}
+
+func msg(fields ...[]byte) []byte {
+	return bytes.Join(fields, nil)
+}
+
+func frame(m []byte) []byte {
+	b := make([]byte, 5, 5+len(m))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(m)))
+	return append(b, m...)
+}
+
+// server serves a Gostorm backed by mem, with a tenant called t
+func server(t *testing.T) (*gostorm.Gostorm, string) {
+	return serverBehind(t, func(h http.Handler) http.Handler { return h })
+}
+
+// serverBehind is server with the Handler wrapped in wrap
+func serverBehind(t *testing.T, wrap func(http.Handler) http.Handler) (*gostorm.Gostorm, string) {
+	drv, err := mem.New("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := gostorm.New(
+		gostorm.WithDriver(drv),
+		gostorm.WithTimeout(time.Second),
+		gostorm.WithTenant(gostorm.Tenant{Name: "t", Prefix: "t/"}),
+	)
+
+	srv := httptest.NewUnstartedServer(wrap(grpc.NewHandler(gs)))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return gs, srv.URL
+}
+
+func client() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// response is what came back from a call
+type response struct {
+	messages [][]byte
+	status   int
+	message  string
+	// trailersOnly is set when the status came in the headers
+	trailersOnly bool
+}
+
+func readResponse(t *testing.T, resp *http.Response) response {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HTTP status %d", resp.StatusCode)
+	}
+
+	var r response
+	for {
+		var first [1]byte
+		if _, err := io.ReadFull(resp.Body, first[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		r.messages = append(r.messages, readMessage(t, io.MultiReader(bytes.NewReader(first[:]), resp.Body)))
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if len(resp.Header.Get("Grpc-Status")) > 0 {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+		r.trailersOnly = true
+	}
+
+	var err error
+	if r.status, err = strconv.Atoi(status); err != nil {
+		t.Fatalf("bad grpc-status %q", status)
+	}
+	r.message, _ = url.PathUnescape(message)
+	return r
+}
+
+func request(base, method, tenant string, body io.Reader) *http.Request {
+	req, _ := http.NewRequest("POST", base+"/gostorm.v1.Gostorm/"+method, body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if len(tenant) > 0 {
+		req.Header.Set(gostorm.TenantHeader, tenant)
+	}
+	return req
+}
+
+// call sends body and reads everything that comes back
+func call(t *testing.T, base, method, tenant string, body []byte) response {
+	t.Helper()
+
+	resp, err := client().Do(request(base, method, tenant, bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func TestUnary(t *testing.T) {
+	_, base := server(t)
+
+	tests := []struct {
+		name    string
+		method  string
+		tenant  string
+		body    []byte
+		status  int
+		message []byte
+	}{
+		{"set", "Set", "", frame(msg(str(1, "k"), str(2, "v"))), 0, []byte{}},
+		{"get", "Get", "", frame(msg(str(1, "k"))), 0, msg(str(1, "v"))},
+		{"set with ttl", "Set", "", frame(msg(str(1, "ttl"), str(2, "v"), varint(3, 60000))), 0, []byte{}},
+		{"get with ttl", "Get", "", frame(msg(str(1, "ttl"))), 0, msg(str(1, "v"))},
+		{"delete", "Delete", "", frame(msg(str(1, "k"))), 0, []byte{}},
+		{"get deleted", "Get", "", frame(msg(str(1, "k"))), 5, nil},
+		{"empty key", "Get", "", frame(msg()), 3, nil},
+		{"negative ttl", "Set", "", frame(msg(str(1, "k"), str(2, "v"), varint(3, 1<<64-1000))), 3, nil},
+		{"unknown method", "Nope", "", frame(msg(str(1, "k"))), 12, nil},
+		{"unknown tenant", "Get", "nope", frame(msg(str(1, "k"))), 3, nil},
+		{"compressed", "Get", "", append([]byte{1}, frame(msg(str(1, "k")))[1:]...), 12, nil},
+		{"truncated", "Get", "", frame(msg(str(1, "k")))[:6], 13, nil},
+		{"malformed", "Get", "", frame([]byte{0x0a, 0x05, 'k'}), 13, nil},
+	}
+
+	for _, test := range tests {
+		r := call(t, base, test.method, test.tenant, test.body)
+
+		if r.status != test.status {
+			t.Errorf("%s: status %d (%s), want %d", test.name, r.status, r.message, test.status)
+			continue
+		}
+		if test.message == nil {
+			if len(r.messages) > 0 || !r.trailersOnly {
+				t.Errorf("%s: want a trailers-only response, got %d messages", test.name, len(r.messages))
+			}
+			continue
+		}
+		if len(r.messages) != 1 || !bytes.Equal(r.messages[0], test.message) {
+			t.Errorf("%s: got %x, want %x", test.name, r.messages, test.message)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	gs, base := server(t)
+
+	if r := call(t, base, "Set", "t", frame(msg(str(1, "k"), str(2, "v")))); r.status != 0 {
+		t.Fatalf("set: status %d (%s)", r.status, r.message)
+	}
+
+	if value, err := gs.GetWithTimeout("t/k", time.Second); err != nil || value != "v" {
+		t.Errorf("t/k is %q, %v, want v", value, err)
+	}
+	if r := call(t, base, "Get", "", frame(msg(str(1, "k")))); r.status != 5 {
+		t.Errorf("k without the tenant: status %d, want 5", r.status)
+	}
+	if r := call(t, base, "Get", "t", frame(msg(str(1, "k")))); r.status != 0 || !bytes.Equal(r.messages[0], msg(str(1, "v"))) {
+		t.Errorf("k for the tenant: status %d, messages %x", r.status, r.messages)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	gs, base := server(t)
+	gs.SetWithTimeout("there", "v", time.Second)
+	gs.SetWithTimeout("gone", "v", time.Second)
+
+	body := msg(
+		frame(msg(varint(1, 1), bytesField(3, msg(str(1, "k"), str(2, "v1"))))),
+		frame(msg(varint(1, 2), bytesField(2, msg(str(1, "there"))))),
+		frame(msg(varint(1, 3), bytesField(2, msg(str(1, "missing"))))),
+		frame(msg(varint(1, 4), bytesField(4, msg(str(1, "gone"))))),
+		frame(msg(varint(1, 5))),
+	)
+
+	r := call(t, base, "Batch", "", body)
+	if r.status != 0 {
+		t.Fatalf("status %d (%s)", r.status, r.message)
+	}
+
+	// Responses come as they're done, each starting with its id, errors
+	// being a Status with the code first
+	want := map[byte][]byte{
+		1: msg(varint(1, 1)),
+		2: msg(varint(1, 2), str(2, "v")),
+		4: msg(varint(1, 4)),
+	}
+	wantCodes := map[byte]byte{3: 5, 5: 3}
+
+	if len(r.messages) != 5 {
+		t.Fatalf("got %d responses, want 5", len(r.messages))
+	}
+	for _, m := range r.messages {
+		id := m[1]
+		if w, ok := want[id]; ok {
+			if !bytes.Equal(m, w) {
+				t.Errorf("response %d is %x, want %x", id, m, w)
+			}
+			continue
+		}
+		// id, then field 3 (the error) holding field 1 (the code)
+		if len(m) < 6 || m[2] != 3<<3|2 || m[4] != 1<<3 || m[5] != wantCodes[id] {
+			t.Errorf("response %d is %x, want code %d", id, m, wantCodes[id])
+		}
+	}
+}
+
+// readMessage reads the next message of a stream
+func readMessage(t *testing.T, body io.Reader) []byte {
+	t.Helper()
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		t.Fatal(err)
+	}
+	m := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(body, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWatch(t *testing.T) {
+	gs, base := server(t)
+
+	reqBody, w := io.Pipe()
+	defer w.Close()
+	go w.Write(frame(msg(str(1, "a"))))
+
+	// The headers come once the watcher is there
+	resp, err := client().Do(request(base, "Watch", "t", reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Only the tenant's keys under the prefix show up, without the
+	// tenant's prefix
+	gs.SetWithTimeout("a", "untenanted", time.Second)
+	gs.SetWithTimeout("t/b", "other prefix", time.Second)
+	gs.SetWithTimeout("t/a", "v", time.Second)
+	gs.DeleteWithTimeout("t/a", time.Second)
+
+	if m, want := readMessage(t, resp.Body), msg(str(2, "a"), str(3, "v")); !bytes.Equal(m, want) {
+		t.Errorf("set event %x, want %x", m, want)
+	}
+	if m, want := readMessage(t, resp.Body), msg(varint(1, 1), str(2, "a")); !bytes.Equal(m, want) {
+		t.Errorf("delete event %x, want %x", m, want)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	tokens := auth.NewTokens()
+	tokens.Add("app", &auth.Principal{Name: "app", Grants: []auth.Grant{{Prefix: "app/", Perm: auth.Read}, {Prefix: "app/w/", Perm: auth.Write}}})
+
+	gs, base := serverBehind(t, func(h http.Handler) http.Handler {
+		return auth.Handler(h, tokens, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	})
+	gs.SetWithTimeout("app/a", "v", time.Second)
+
+	tests := []struct {
+		name   string
+		method string
+		body   []byte
+		status int
+	}{
+		{"get", "Get", frame(msg(str(1, "app/a"))), 0},
+		{"get elsewhere", "Get", frame(msg(str(1, "other"))), 7},
+		{"set without a grant", "Set", frame(msg(str(1, "app/a"), str(2, "v"))), 7},
+		{"set", "Set", frame(msg(str(1, "app/w/a"), str(2, "v"))), 0},
+		{"delete elsewhere", "Delete", frame(msg(str(1, "other"))), 7},
+		{"watch everything", "Watch", frame(msg()), 7},
+	}
+
+	for _, test := range tests {
+		req := request(base, test.method, "", bytes.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer app")
+
+		resp, err := client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := readResponse(t, resp); r.status != test.status {
+			t.Errorf("%s: status %d (%s), want %d", test.name, r.status, r.message, test.status)
+		}
+	}
+
+	// In a batch each operation is checked on its own
+	body := msg(
+		frame(msg(varint(1, 1), bytesField(2, msg(str(1, "app/a"))))),
+		frame(msg(varint(1, 2), bytesField(2, msg(str(1, "other"))))),
+	)
+	req := request(base, "Batch", "", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer app")
+
+	resp, err := client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := readResponse(t, resp)
+	if r.status != 0 || len(r.messages) != 2 {
+		t.Fatalf("status %d (%s), %d responses", r.status, r.message, len(r.messages))
+	}
+	for _, m := range r.messages {
+		switch id := m[1]; {
+		case id == 1 && !bytes.Equal(m, msg(varint(1, 1), str(2, "v"))):
+			t.Errorf("response 1 is %x", m)
+		case id == 2 && (len(m) < 6 || m[5] != 7):
+			t.Errorf("response 2 is %x, want code 7", m)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The messages of gostorm.proto, encoded and decoded by hand. There are few
+// of them and they're flat, which isn't worth a protobuf dependency.
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errBadProto = errors.New("malformed protobuf message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// appendBytes appends a length-delimited field, proto3 leaves empty ones out
+func appendBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	return appendBytes(b, field, []byte(v))
+}
+
+func appendUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+// appendMessage appends an embedded message, even an empty one, so that it
+// shows up as set
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// field is a decoded field, varint holding the value of the numeric ones
+// and bytes that of length-delimited ones
+type field struct {
+	num    int
+	wire   int
+	varint uint64
+	bytes  []byte
+}
+
+// eachField calls fn for every field of msg, in order
+func eachField(msg []byte, fn func(f field) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 || tag>>3 == 0 {
+			return errBadProto
+		}
+		msg = msg[n:]
+
+		f := field{num: int(tag >> 3), wire: int(tag & 7)}
+
+		switch f.wire {
+		case wireVarint:
+			f.varint, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errBadProto
+			}
+			msg = msg[n:]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return errBadProto
+			}
+			f.varint = binary.LittleEndian.Uint64(msg)
+			msg = msg[8:]
+		case wireFixed32:
+			if len(msg) < 4 {
+				return errBadProto
+			}
+			f.varint = uint64(binary.LittleEndian.Uint32(msg))
+			msg = msg[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errBadProto
+			}
+			f.bytes = msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+		default:
+			return errBadProto
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ttlFromMillis reads a ttl_ms field, which encodes an int64 as a varint
+func ttlFromMillis(v uint64) time.Duration {
+	return time.Duration(int64(v)) * time.Millisecond
+}
+
+type getRequest struct {
+	key string
+}
+
+func (m *getRequest) unmarshal(b []byte) error {
+	return eachField(b, func(f field) error {
+		if f.num == 1 && f.wire == wireBytes {
+			m.key = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+type getResponse struct {
+	value string
+}
+
+func (m *getResponse) marshal() []byte {
+	return appendString(nil, 1, m.value)
+}
+
+type setRequest struct {
+	key   string
+	value string
+	ttl   time.Duration
+}
+
+func (m *setRequest) unmarshal(b []byte) error {
+	return eachField(b, func(f field) error {
+		switch {
+		case f.num == 1 && f.wire == wireBytes:
+			m.key = string(f.bytes)
+		case f.num == 2 && f.wire == wireBytes:
+			m.value = string(f.bytes)
+		case f.num == 3 && f.wire == wireVarint:
+			m.ttl = ttlFromMillis(f.varint)
+		}
+		return nil
+	})
+}
+
+type deleteRequest struct {
+	key string
+}
+
+func (m *deleteRequest) unmarshal(b []byte) error {
+	return eachField(b, func(f field) error {
+		if f.num == 1 && f.wire == wireBytes {
+			m.key = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+// batchRequest has exactly one of get, set and delete set
+type batchRequest struct {
+	id  uint64
+	get *getRequest
+	set *setRequest
+	del *deleteRequest
+}
+
+func (m *batchRequest) unmarshal(b []byte) error {
+	return eachField(b, func(f field) error {
+		switch {
+		case f.num == 1 && f.wire == wireVarint:
+			m.id = f.varint
+		case f.num == 2 && f.wire == wireBytes:
+			m.get, m.set, m.del = &getRequest{}, nil, nil
+			return m.get.unmarshal(f.bytes)
+		case f.num == 3 && f.wire == wireBytes:
+			m.get, m.set, m.del = nil, &setRequest{}, nil
+			return m.set.unmarshal(f.bytes)
+		case f.num == 4 && f.wire == wireBytes:
+			m.get, m.set, m.del = nil, nil, &deleteRequest{}
+			return m.del.unmarshal(f.bytes)
+		}
+		return nil
+	})
+}
+
+type status struct {
+	code    int
+	message string
+}
+
+func (m *status) marshal() []byte {
+	b := appendUint(nil, 1, uint64(m.code))
+	return appendString(b, 2, m.message)
+}
+
+type batchResponse struct {
+	id    uint64
+	value string
+	err   *status
+}
+
+func (m *batchResponse) marshal() []byte {
+	b := appendUint(nil, 1, m.id)
+	b = appendString(b, 2, m.value)
+	if m.err != nil {
+		b = appendMessage(b, 3, m.err.marshal())
+	}
+	return b
+}
+
+type watchRequest struct {
+	prefix string
+}
+
+func (m *watchRequest) unmarshal(b []byte) error {
+	return eachField(b, func(f field) error {
+		if f.num == 1 && f.wire == wireBytes {
+			m.prefix = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+// WatchEvent.Type values
+const (
+	eventSet    = 0
+	eventDelete = 1
+	eventExpire = 2
+)
+
+type watchEvent struct {
+	typ   int
+	key   string
+	value string
+	ttl   time.Duration
+}
+
+func (m *watchEvent) marshal() []byte {
+	b := appendUint(nil, 1, uint64(m.typ))
+	b = appendString(b, 2, m.key)
+	b = appendString(b, 3, m.value)
+	return appendUint(b, 4, uint64(m.ttl/time.Millisecond))
+}
@@ -0,0 +1,69 @@
+package grpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetRequestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want setRequest
+		err  bool
+	}{
+		{"empty", nil, setRequest{}, false},
+		{"fields", []byte{0x0a, 1, 'k', 0x12, 1, 'v', 0x18, 0xe8, 0x07}, setRequest{key: "k", value: "v", ttl: time.Second}, false},
+		{"unknown fields skipped", []byte{0x20, 5, 0x29, 1, 2, 3, 4, 5, 6, 7, 8, 0x35, 1, 2, 3, 4, 0x0a, 1, 'k'}, setRequest{key: "k"}, false},
+		{"wrong wire type ignored", []byte{0x08, 1, 0x0a, 1, 'k'}, setRequest{key: "k"}, false},
+		{"last one wins", []byte{0x0a, 1, 'a', 0x0a, 1, 'b'}, setRequest{key: "b"}, false},
+		{"short bytes", []byte{0x0a, 5, 'k'}, setRequest{}, true},
+		{"short varint", []byte{0x18, 0x80}, setRequest{}, true},
+		{"field 0", []byte{0x02, 0}, setRequest{}, true},
+		{"groups", []byte{0x0b, 0x0c}, setRequest{}, true},
+	}
+
+	for _, test := range tests {
+		var got setRequest
+		err := got.unmarshal(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%s: err %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if !test.err && got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBatchRequestUnmarshal(t *testing.T) {
+	var req batchRequest
+	// id 7, a get then a delete: the last op wins, like a oneof
+	if err := req.unmarshal([]byte{0x08, 7, 0x12, 3, 0x0a, 1, 'a', 0x22, 3, 0x0a, 1, 'b'}); err != nil {
+		t.Fatal(err)
+	}
+	if req.id != 7 || req.get != nil || req.set != nil || req.del == nil || req.del.key != "b" {
+		t.Errorf("got %+v", req)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  interface{ marshal() []byte }
+		want []byte
+	}{
+		{"empty get response", &getResponse{}, nil},
+		{"get response", &getResponse{value: "v"}, []byte{0x0a, 1, 'v'}},
+		{"ok batch response", &batchResponse{id: 1}, []byte{0x08, 1}},
+		{"failed batch response", &batchResponse{id: 2, err: &status{code: codeNotFound, message: "x"}}, []byte{0x08, 2, 0x1a, 5, 0x08, 5, 0x12, 1, 'x'}},
+		{"empty status still set", &batchResponse{err: &status{}}, []byte{0x1a, 0}},
+		{"watch event", &watchEvent{typ: eventExpire, key: "k", ttl: 2 * time.Second}, []byte{0x08, 2, 0x12, 1, 'k', 0x20, 0xd0, 0x0f}},
+	}
+
+	for _, test := range tests {
+		if got := test.msg.marshal(); string(got) != string(test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.want)
+		}
+	}
+}
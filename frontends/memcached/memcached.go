@@ -0,0 +1,598 @@
+// Package memcached serves a Gostorm over the memcached text protocol, so
+// apps that only speak memcache can use it. Every command is translated
+// onto Gostorm operations across all of its drivers.
+//
+// Flags aren't stored: they're accepted and always read back as 0. CAS
+// uniques are a hash of the value. Every command writing a key holds a
+// lock on it, so read-modify-write ones (add, replace, cas, incr, decr)
+// are atomic against each other, but the locks are this frontend's own:
+// writes through the HTTP API, redis or gRPC frontends, or another
+// process, can still land in the middle of them.
+package memcached
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+const (
+	// version is what the version command reports
+	version = "gostorm-1.0"
+
+	maxKeyLength = 250
+	maxValueSize = 1 << 20
+	maxLineSize  = 2048
+
+	// maxRelativeExpiration is as far as exptime is relative, anything
+	// bigger is a unix timestamp
+	maxRelativeExpiration = 30 * 24 * 60 * 60
+
+	// lockStripes is the number of locks writes share
+	lockStripes = 64
+)
+
+// Server speaks the memcached text protocol
+type Server struct {
+	gs     *gostorm.Gostorm
+	logger *slog.Logger
+	locks  [lockStripes]sync.Mutex
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server serving gs
+func NewServer(gs *gostorm.Gostorm) *Server {
+	return &Server{
+		gs:        gs,
+		logger:    slog.Default(),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// SetLogger sets where the server logs to, slog.Default() if not
+func (srv *Server) SetLogger(logger *slog.Logger) {
+	srv.logger = logger
+}
+
+// ErrServerClosed is returned by Serve once Close was called
+var ErrServerClosed = errors.New("memcached: server closed")
+
+// ListenAndServe listens on addr, e.g. ":11211", and serves
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = true
+	srv.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		srv.mu.Lock()
+		srv.conns[conn] = true
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+
+		go srv.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes the open ones, waiting for
+// commands in progress to finish
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for conn := range srv.conns {
+		// Wake up readers, a command being run still gets to reply
+		conn.SetReadDeadline(time.Now())
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return nil
+}
+
+// lock serializes the commands writing key, through this Server only
+func (srv *Server) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &srv.locks[h.Sum32()%lockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// conn is a client connection
+type conn struct {
+	srv *Server
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func (srv *Server) serveConn(nc net.Conn) {
+	defer func() {
+		nc.Close()
+		srv.mu.Lock()
+		delete(srv.conns, nc)
+		srv.mu.Unlock()
+		srv.wg.Done()
+	}()
+
+	c := &conn{srv: srv, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				srv.logger.Warn("memcached: connection failed", "remote", nc.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+
+		quit := c.handle(line)
+
+		// Flush once the pipeline is drained rather than after every reply
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a command line, without its \r\n
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLineSize {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reply writes a line
+func (c *conn) reply(format string, v ...interface{}) {
+	fmt.Fprintf(c.w, format+"\r\n", v...)
+}
+
+// serverError reports a Gostorm failure
+func (c *conn) serverError(err error) {
+	c.reply("SERVER_ERROR %s", strings.Replace(err.Error(), "\r\n", " ", -1))
+}
+
+// handle runs a command line, telling whether the client wants out
+func (c *conn) handle(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		c.reply("ERROR")
+		return false
+	}
+
+	cmd, args := fields[0], fields[1:]
+
+	switch cmd {
+	case "get", "gets":
+		c.get(args, cmd == "gets")
+	case "set", "add", "replace", "cas":
+		c.store(cmd, args)
+	case "delete":
+		c.delete(args)
+	case "incr", "decr":
+		c.incrDecr(cmd, args)
+	case "touch":
+		c.touch(args)
+	case "version":
+		c.reply("VERSION %s", version)
+	case "verbosity":
+		c.reply("OK")
+	case "quit":
+		return true
+	default:
+		c.reply("ERROR")
+	}
+
+	return false
+}
+
+// noreply strips a trailing "noreply", telling whether it was there
+func noreply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// casUnique derives a CAS unique from a value, never 0
+func casUnique(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	if sum := h.Sum64(); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+// ttl turns an exptime into a TTL: 0 is forever, up to 30 days it's
+// relative, past that a unix timestamp. A negative TTL means already expired.
+func ttl(exptime int64) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= maxRelativeExpiration:
+		return time.Duration(exptime) * time.Second
+	}
+
+	d := time.Unix(exptime, 0).Sub(time.Now())
+	if d <= 0 {
+		return -1
+	}
+	return d
+}
+
+func (c *conn) get(keys []string, withCas bool) {
+	if len(keys) == 0 {
+		c.reply("ERROR")
+		return
+	}
+
+	for _, key := range keys {
+		if !validKey(key) {
+			c.reply("CLIENT_ERROR bad key")
+			return
+		}
+	}
+
+	values, errs := c.srv.gs.GetMulti(keys)
+
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			if err := errs[key]; err != nil && !gostorm.IsNotFound(err) {
+				c.srv.logger.Warn("memcached: get failed", "key", key, "err", err)
+			}
+			continue
+		}
+
+		if withCas {
+			c.reply("VALUE %s 0 %d %d", key, len(value), casUnique(value))
+		} else {
+			c.reply("VALUE %s 0 %d", key, len(value))
+		}
+		c.w.WriteString(value)
+		c.w.WriteString("\r\n")
+	}
+
+	c.reply("END")
+}
+
+// readData reads a data block of n bytes and its \r\n
+func (c *conn) readData(n int) (string, error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return "", err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", errors.New("bad data chunk")
+	}
+	return string(buf[:n]), nil
+}
+
+// store handles set, add, replace and cas:
+// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (c *conn) store(cmd string, args []string) {
+	args, quiet := noreply(args)
+
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want {
+		c.reply("ERROR")
+		return
+	}
+
+	key := args[0]
+	_, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, expErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+
+	if flagsErr != nil || expErr != nil || sizeErr != nil || size < 0 {
+		c.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+
+	if size > maxValueSize {
+		// Swallow the data so the connection stays in sync
+		io.CopyN(io.Discard, c.r, int64(size)+2)
+		c.reply("SERVER_ERROR object too large for cache")
+		return
+	}
+
+	value, err := c.readData(size)
+	if err != nil {
+		c.reply("CLIENT_ERROR bad data chunk")
+		return
+	}
+
+	if !validKey(key) {
+		c.reply("CLIENT_ERROR bad key")
+		return
+	}
+
+	var unique uint64
+	if cmd == "cas" {
+		if unique, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			c.reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+
+	result := c.doStore(cmd, key, value, ttl(exptime), unique)
+	if !quiet {
+		c.w.WriteString(result)
+	}
+}
+
+// doStore runs a storage command, returning the reply line
+func (c *conn) doStore(cmd, key, value string, ttl time.Duration, unique uint64) string {
+	gs := c.srv.gs
+
+	// set takes the lock too, or it could land between a cas' get and set
+	defer c.srv.lock(key)()
+
+	if cmd != "set" {
+		current, err := gs.Get(key)
+		found := err == nil
+		if err != nil && !gostorm.IsNotFound(err) {
+			return "SERVER_ERROR " + err.Error() + "\r\n"
+		}
+
+		switch cmd {
+		case "add":
+			if found {
+				return "NOT_STORED\r\n"
+			}
+		case "replace":
+			if !found {
+				return "NOT_STORED\r\n"
+			}
+		case "cas":
+			if !found {
+				return "NOT_FOUND\r\n"
+			}
+			if casUnique(current) != unique {
+				return "EXISTS\r\n"
+			}
+		}
+	}
+
+	var err error
+	if ttl < 0 {
+		// Expired on arrival
+		err = gs.Delete(key)
+	} else {
+		err = gs.SetWithTTL(key, value, ttl)
+	}
+
+	if err != nil {
+		return "SERVER_ERROR " + err.Error() + "\r\n"
+	}
+	return "STORED\r\n"
+}
+
+// delete <key> [noreply]
+func (c *conn) delete(args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 1 {
+		c.reply("ERROR")
+		return
+	}
+
+	key := args[0]
+	if !validKey(key) {
+		c.reply("CLIENT_ERROR bad key")
+		return
+	}
+
+	gs := c.srv.gs
+
+	unlock := c.srv.lock(key)
+	_, err := gs.Get(key)
+	if err == nil {
+		err = gs.Delete(key)
+	}
+	unlock()
+
+	if quiet {
+		return
+	}
+
+	switch {
+	case err == nil:
+		c.reply("DELETED")
+	case gostorm.IsNotFound(err):
+		c.reply("NOT_FOUND")
+	default:
+		c.serverError(err)
+	}
+}
+
+// incrDecr handles incr and decr: <cmd> <key> <delta> [noreply]
+func (c *conn) incrDecr(cmd string, args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		c.reply("ERROR")
+		return
+	}
+
+	key := args[0]
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || !validKey(key) {
+		c.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+
+	gs := c.srv.gs
+	unlock := c.srv.lock(key)
+	defer unlock()
+
+	current, err := gs.Get(key)
+	if err != nil {
+		if !quiet {
+			if gostorm.IsNotFound(err) {
+				c.reply("NOT_FOUND")
+			} else {
+				c.serverError(err)
+			}
+		}
+		return
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(current), 10, 64)
+	if err != nil {
+		if !quiet {
+			c.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		}
+		return
+	}
+
+	if cmd == "incr" {
+		n += delta // wraps around at 64 bits, like memcached
+	} else if delta > n {
+		n = 0
+	} else {
+		n -= delta
+	}
+
+	value := strconv.FormatUint(n, 10)
+
+	// Keep whatever TTL the key had
+	keep, err := gs.TTL(key)
+	if err != nil || keep == gostorm.NoExpiry {
+		keep = 0
+	}
+
+	if err := gs.SetWithTTL(key, value, keep); err != nil {
+		if !quiet {
+			c.serverError(err)
+		}
+		return
+	}
+
+	if !quiet {
+		c.reply("%s", value)
+	}
+}
+
+// touch <key> <exptime> [noreply]
+func (c *conn) touch(args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		c.reply("ERROR")
+		return
+	}
+
+	key := args[0]
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || !validKey(key) {
+		c.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+
+	d := ttl(exptime)
+
+	unlock := c.srv.lock(key)
+	if d < 0 {
+		_, err = c.srv.gs.Get(key)
+		if err == nil {
+			err = c.srv.gs.Delete(key)
+		}
+	} else {
+		err = c.srv.gs.Expire(key, d)
+	}
+	unlock()
+
+	if quiet {
+		return
+	}
+
+	switch {
+	case err == nil:
+		c.reply("TOUCHED")
+	case gostorm.IsNotFound(err):
+		c.reply("NOT_FOUND")
+	default:
+		c.serverError(err)
+	}
+}
@@ -0,0 +1,178 @@
+package memcached
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/drivers/mem"
+)
+
+// exchange is a request and the exact reply it should get
+type exchange struct {
+	send string
+	want string
+}
+
+// dial starts a Server over a mem driver and connects to it
+func dial(t *testing.T) net.Conn {
+	t.Helper()
+
+	drv, err := mem.New("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(gostorm.New(gostorm.WithDriver(drv)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestProtocol(t *testing.T) {
+	unique := casUnique("x")
+	tooLarge := strings.Repeat("v", maxValueSize+1)
+
+	tests := []struct {
+		name      string
+		exchanges []exchange
+	}{
+		{"set and get", []exchange{
+			{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"get a b\r\n", "VALUE a 0 1\r\nx\r\nEND\r\n"},
+		}},
+		{"empty value", []exchange{
+			{"set a 5 0 0\r\n\r\n", "STORED\r\n"},
+			{"get a\r\n", "VALUE a 0 0\r\n\r\nEND\r\n"},
+		}},
+		{"add", []exchange{
+			{"add a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"add a 0 0 1\r\ny\r\n", "NOT_STORED\r\n"},
+			{"get a\r\n", "VALUE a 0 1\r\nx\r\nEND\r\n"},
+		}},
+		{"replace", []exchange{
+			{"replace a 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+			{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"replace a 0 0 1\r\ny\r\n", "STORED\r\n"},
+			{"get a\r\n", "VALUE a 0 1\r\ny\r\nEND\r\n"},
+		}},
+		{"gets and cas", []exchange{
+			{"cas a 0 0 1 1\r\ny\r\n", "NOT_FOUND\r\n"},
+			{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"gets a\r\n", fmt.Sprintf("VALUE a 0 1 %d\r\nx\r\nEND\r\n", unique)},
+			{fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", unique+1), "EXISTS\r\n"},
+			{fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", unique), "STORED\r\n"},
+			{fmt.Sprintf("cas a 0 0 1 %d\r\nz\r\n", unique), "EXISTS\r\n"},
+			{"cas a 0 0 1 many\r\nz\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		}},
+		{"delete", []exchange{
+			{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"delete a\r\n", "DELETED\r\n"},
+			{"delete a\r\n", "NOT_FOUND\r\n"},
+			{"delete\r\n", "ERROR\r\n"},
+		}},
+		{"incr and decr", []exchange{
+			{"incr n 1\r\n", "NOT_FOUND\r\n"},
+			{"set n 0 0 1\r\n5\r\n", "STORED\r\n"},
+			{"incr n 3\r\n", "8\r\n"},
+			{"decr n 10\r\n", "0\r\n"},
+			{"incr n -1\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+			{"set s 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		}},
+		{"touch", []exchange{
+			{"touch a 10\r\n", "NOT_FOUND\r\n"},
+			{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"touch a 10\r\n", "TOUCHED\r\n"},
+			{"touch a -1\r\n", "TOUCHED\r\n"},
+			{"get a\r\n", "END\r\n"},
+		}},
+		{"expired on arrival", []exchange{
+			{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+			{"set a 0 -1 1\r\ny\r\n", "STORED\r\n"},
+			{"get a\r\n", "END\r\n"},
+		}},
+		{"noreply", []exchange{
+			{"set a 0 0 1 noreply\r\nx\r\n", ""},
+			{"incr a 1 noreply\r\n", ""},
+			{"delete b noreply\r\n", ""},
+			{"get a\r\n", "VALUE a 0 1\r\nx\r\nEND\r\n"},
+		}},
+		{"bad lines", []exchange{
+			{"\r\n", "ERROR\r\n"},
+			{"bogus\r\n", "ERROR\r\n"},
+			{"get\r\n", "ERROR\r\n"},
+			{"set a 0 0\r\n", "ERROR\r\n"},
+			{"set a x 0 1\r\n", "CLIENT_ERROR bad command line format\r\n"},
+			{"set a 0 0 -1\r\n", "CLIENT_ERROR bad command line format\r\n"},
+			{"get " + strings.Repeat("k", maxKeyLength+1) + "\r\n", "CLIENT_ERROR bad key\r\n"},
+			{"version\r\n", "VERSION " + version + "\r\n"},
+		}},
+		{"bad data chunk", []exchange{
+			// What follows the bad chunk is read as the next command
+			{"set a 0 0 1\r\nxy\r\n", "CLIENT_ERROR bad data chunk\r\nERROR\r\n"},
+			{"get a\r\n", "END\r\n"},
+		}},
+		{"too large", []exchange{
+			{fmt.Sprintf("set a 0 0 %d\r\n%s\r\n", len(tooLarge), tooLarge), "SERVER_ERROR object too large for cache\r\n"},
+			{"get a\r\n", "END\r\n"},
+		}},
+	}
+
+	for _, test := range tests {
+		conn := dial(t)
+
+		for i, ex := range test.exchanges {
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.WriteString(conn, ex.send); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+
+			got := make([]byte, len(ex.want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Errorf("%s: exchange %d: %v", test.name, i, err)
+				break
+			}
+			if string(got) != ex.want {
+				t.Errorf("%s: exchange %d: got %q, want %q", test.name, i, got, ex.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		exptime  int64
+		min, max time.Duration
+	}{
+		{0, 0, 0},
+		{-5, -1, -1},
+		{60, time.Minute, time.Minute},
+		{maxRelativeExpiration, 30 * 24 * time.Hour, 30 * 24 * time.Hour},
+		{now - 10, -1, -1},
+		{now + 100, 98 * time.Second, 100 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := ttl(test.exptime); got < test.min || got > test.max {
+			t.Errorf("%d: got %s, want %s..%s", test.exptime, got, test.min, test.max)
+		}
+	}
+}
@@ -0,0 +1,1016 @@
+// Package resp serves a Gostorm over RESP, the redis protocol, so redis
+// clients can use it. Commands are translated onto Gostorm operations
+// across all of its drivers, pipelined commands are answered in order.
+//
+// Only strings are supported, there's a single database and read-modify-
+// write commands (SET NX/XX, INCR and friends) are only atomic within this
+// process.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+const (
+	maxKeyLength = 250
+	maxValueSize = 1 << 20
+
+	// maxArgs caps the number of arguments of a single command
+	maxArgs = 1 << 16
+
+	// maxCommandSize caps the arguments of a single command taken together
+	maxCommandSize = 16 << 20
+
+	// maxInlineSize caps inline commands, the ones typed in over telnet
+	maxInlineSize = 64 << 10
+
+	// defaultScanCount is how many keys SCAN looks at unless told otherwise
+	defaultScanCount = 10
+
+	// lockStripes is the number of locks writes share
+	lockStripes = 64
+)
+
+// Server speaks RESP
+type Server struct {
+	gs     *gostorm.Gostorm
+	logger *slog.Logger
+	locks  [lockStripes]sync.Mutex
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server serving gs
+func NewServer(gs *gostorm.Gostorm) *Server {
+	return &Server{
+		gs:        gs,
+		logger:    slog.Default(),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// SetLogger sets where the server logs to, slog.Default() if not
+func (srv *Server) SetLogger(logger *slog.Logger) {
+	srv.logger = logger
+}
+
+// ErrServerClosed is returned by Serve once Close was called
+var ErrServerClosed = errors.New("resp: server closed")
+
+// ListenAndServe listens on addr, e.g. ":6379", and serves
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = true
+	srv.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		srv.mu.Lock()
+		srv.conns[conn] = true
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+
+		go srv.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes the open ones, waiting for
+// commands in progress to finish
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for conn := range srv.conns {
+		// Wake up readers, a command being run still gets to reply
+		conn.SetReadDeadline(time.Now())
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return nil
+}
+
+// lock serializes writes to keys, so one can't land in the middle of a
+// read-modify-write. Stripes are taken in order, commands locking several
+// keys can't deadlock each other.
+func (srv *Server) lock(keys ...string) func() {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		stripes = append(stripes, int(h.Sum32()%lockStripes))
+	}
+	sort.Ints(stripes)
+
+	var held []*sync.Mutex
+	for i, stripe := range stripes {
+		if i > 0 && stripe == stripes[i-1] {
+			continue
+		}
+		mu := &srv.locks[stripe]
+		mu.Lock()
+		held = append(held, mu)
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+	}
+}
+
+// conn is a client connection
+type conn struct {
+	srv *Server
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func (srv *Server) serveConn(nc net.Conn) {
+	defer func() {
+		nc.Close()
+		srv.mu.Lock()
+		delete(srv.conns, nc)
+		srv.mu.Unlock()
+		srv.wg.Done()
+	}()
+
+	c := &conn{srv: srv, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.writeError("ERR Protocol error: " + string(perr))
+				c.w.Flush()
+			} else if err != io.EOF && !isTimeout(err) {
+				srv.logger.Warn("resp: connection failed", "remote", nc.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+
+		quit := false
+		if len(args) > 0 {
+			quit = c.handle(args)
+		}
+
+		// Flush once the pipeline is drained rather than after every reply
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// protocolError is a malformed request, the connection is closed after it
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// readLine reads a line, without its \r\n
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Only inline commands get to be this long
+		buf := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(buf) <= maxInlineSize {
+			line, err = c.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if len(buf) > maxInlineSize {
+			return "", protocolError("too big inline request")
+		}
+		line = buf
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readCommand reads a command, either a RESP array of bulk strings or an
+// inline one
+func (c *conn) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+
+	args := make([]string, 0, max(n, 0))
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxValueSize+maxKeyLength {
+			return nil, protocolError("invalid bulk length")
+		}
+		if total += size; total > maxCommandSize {
+			return nil, protocolError("command too big")
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, protocolError("bad bulk string")
+		}
+
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func (c *conn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *conn) writeError(s string) {
+	c.w.WriteString("-" + strings.Replace(s, "\r\n", " ", -1) + "\r\n")
+}
+
+func (c *conn) writeInt(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *conn) writeBulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *conn) writeNil() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *conn) writeArray(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeGostormError reports a failure from Gostorm
+func (c *conn) writeGostormError(err error) {
+	c.writeError("ERR " + err.Error())
+}
+
+// command is how a command is run, arity being the number of arguments it
+// takes including its name, negative meaning at least that many
+type command struct {
+	arity int
+	run   func(c *conn, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {-1, (*conn).ping},
+		"echo":    {2, (*conn).echo},
+		"quit":    {1, nil},
+		"select":  {2, (*conn).selectDB},
+		"command": {-1, (*conn).command},
+		"client":  {-2, (*conn).client},
+		"get":     {2, (*conn).get},
+		"set":     {-3, (*conn).set},
+		"setex":   {4, (*conn).setex},
+		"psetex":  {4, (*conn).setex},
+		"setnx":   {3, (*conn).setnx},
+		"del":     {-2, (*conn).del},
+		"unlink":  {-2, (*conn).del},
+		"mget":    {-2, (*conn).mget},
+		"mset":    {-3, (*conn).mset},
+		"exists":  {-2, (*conn).exists},
+		"expire":  {3, (*conn).expire},
+		"pexpire": {3, (*conn).expire},
+		"persist": {2, (*conn).persist},
+		"ttl":     {2, (*conn).ttl},
+		"pttl":    {2, (*conn).ttl},
+		"incr":    {2, (*conn).incr},
+		"decr":    {2, (*conn).incr},
+		"incrby":  {3, (*conn).incr},
+		"decrby":  {3, (*conn).incr},
+		"scan":    {-2, (*conn).scan},
+	}
+}
+
+// handle runs a command, telling whether the client wants out
+func (c *conn) handle(args []string) bool {
+	name := strings.ToLower(args[0])
+
+	cmd, ok := commands[name]
+	if !ok {
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+
+	if name == "quit" {
+		c.writeSimple("OK")
+		return true
+	}
+
+	args[0] = name
+	cmd.run(c, args)
+	return false
+}
+
+// checkKeys writes an error and returns false if any of keys can't be stored
+func (c *conn) checkKeys(keys ...string) bool {
+	for _, key := range keys {
+		if len(key) == 0 || len(key) > maxKeyLength {
+			c.writeError("ERR key must be 1-250 bytes")
+			return false
+		}
+	}
+	return true
+}
+
+// checkValue writes an error and returns false if value is too big
+func (c *conn) checkValue(value string) bool {
+	if len(value) > maxValueSize {
+		c.writeError("ERR value is too large")
+		return false
+	}
+	return true
+}
+
+func (c *conn) ping(args []string) {
+	switch len(args) {
+	case 1:
+		c.writeSimple("PONG")
+	case 2:
+		c.writeBulk(args[1])
+	default:
+		c.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (c *conn) echo(args []string) {
+	c.writeBulk(args[1])
+}
+
+// selectDB only knows database 0, clients still like to select it
+func (c *conn) selectDB(args []string) {
+	if args[1] != "0" {
+		c.writeError("ERR DB index is out of range")
+		return
+	}
+	c.writeSimple("OK")
+}
+
+// command keeps redis-cli happy, it asks for COMMAND DOCS on startup
+func (c *conn) command(args []string) {
+	c.writeArray(0)
+}
+
+// client accepts CLIENT SETNAME and friends, ignoring them
+func (c *conn) client(args []string) {
+	c.writeSimple("OK")
+}
+
+func (c *conn) get(args []string) {
+	key := args[1]
+	if !c.checkKeys(key) {
+		return
+	}
+
+	value, err := c.srv.gs.Get(key)
+	switch {
+	case err == nil:
+		c.writeBulk(value)
+	case gostorm.IsNotFound(err):
+		c.writeNil()
+	default:
+		c.writeGostormError(err)
+	}
+}
+
+// set handles SET key value [EX seconds|PX milliseconds|KEEPTTL] [NX|XX]
+func (c *conn) set(args []string) {
+	key, value := args[1], args[2]
+	if !c.checkKeys(key) || !c.checkValue(value) {
+		return
+	}
+
+	var ttl time.Duration
+	var nx, xx, keepTTL bool
+
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			keepTTL = true
+		case "ex", "px":
+			if i+1 == len(args) || ttl != 0 {
+				c.writeError("ERR syntax error")
+				return
+			}
+
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				c.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "ex" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		c.writeError("ERR syntax error")
+		return
+	}
+
+	defer c.srv.lock(key)()
+
+	if !nx && !xx && !keepTTL {
+		if err := c.srv.gs.SetWithTTL(key, value, ttl); err != nil {
+			c.writeGostormError(err)
+			return
+		}
+		c.writeSimple("OK")
+		return
+	}
+
+	_, err := c.srv.gs.Get(key)
+	found := err == nil
+	if err != nil && !gostorm.IsNotFound(err) {
+		c.writeGostormError(err)
+		return
+	}
+
+	if (nx && found) || (xx && !found) {
+		c.writeNil()
+		return
+	}
+
+	if keepTTL && found {
+		ttl = c.currentTTL(key)
+	}
+
+	if err := c.srv.gs.SetWithTTL(key, value, ttl); err != nil {
+		c.writeGostormError(err)
+		return
+	}
+	c.writeSimple("OK")
+}
+
+// currentTTL is what's left of key's TTL, 0 if it doesn't expire or if it
+// can't be told
+func (c *conn) currentTTL(key string) time.Duration {
+	ttl, err := c.srv.gs.TTL(key)
+	if err != nil || ttl == gostorm.NoExpiry {
+		return 0
+	}
+	return ttl
+}
+
+// setex handles SETEX key seconds value and PSETEX key milliseconds value
+func (c *conn) setex(args []string) {
+	key, value := args[1], args[3]
+	if !c.checkKeys(key) || !c.checkValue(value) {
+		return
+	}
+
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || n <= 0 {
+		c.writeError(fmt.Sprintf("ERR invalid expire time in '%s' command", args[0]))
+		return
+	}
+
+	ttl := time.Duration(n) * time.Second
+	if args[0] == "psetex" {
+		ttl = time.Duration(n) * time.Millisecond
+	}
+
+	defer c.srv.lock(key)()
+
+	if err := c.srv.gs.SetWithTTL(key, value, ttl); err != nil {
+		c.writeGostormError(err)
+		return
+	}
+	c.writeSimple("OK")
+}
+
+func (c *conn) setnx(args []string) {
+	key, value := args[1], args[2]
+	if !c.checkKeys(key) || !c.checkValue(value) {
+		return
+	}
+
+	defer c.srv.lock(key)()
+
+	_, err := c.srv.gs.Get(key)
+	if err == nil {
+		c.writeInt(0)
+		return
+	}
+	if !gostorm.IsNotFound(err) {
+		c.writeGostormError(err)
+		return
+	}
+
+	if err := c.srv.gs.Set(key, value); err != nil {
+		c.writeGostormError(err)
+		return
+	}
+	c.writeInt(1)
+}
+
+// existing returns those of keys that exist
+func (c *conn) existing(keys []string) (map[string]string, error) {
+	values, errs := c.srv.gs.GetMulti(keys)
+	for _, err := range errs {
+		if !gostorm.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// del handles DEL and UNLINK, counting the keys that were there
+func (c *conn) del(args []string) {
+	keys := args[1:]
+	if !c.checkKeys(keys...) {
+		return
+	}
+
+	defer c.srv.lock(keys...)()
+
+	found, err := c.existing(keys)
+	if err != nil {
+		c.writeGostormError(err)
+		return
+	}
+
+	var deleted int64
+	for key := range found {
+		if err := c.srv.gs.Delete(key); err != nil {
+			c.writeGostormError(err)
+			return
+		}
+		deleted++
+	}
+
+	c.writeInt(deleted)
+}
+
+func (c *conn) mget(args []string) {
+	keys := args[1:]
+	if !c.checkKeys(keys...) {
+		return
+	}
+
+	values, errs := c.srv.gs.GetMulti(keys)
+
+	c.writeArray(len(keys))
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			c.writeBulk(value)
+			continue
+		}
+
+		// An array can't hold errors, a failed key reads as missing
+		if err := errs[key]; err != nil && !gostorm.IsNotFound(err) {
+			c.srv.logger.Warn("resp: mget failed", "key", key, "err", err)
+		}
+		c.writeNil()
+	}
+}
+
+func (c *conn) mset(args []string) {
+	if len(args)%2 != 1 {
+		c.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	values := make(map[string]string, len(args)/2)
+	keys := make([]string, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		if !c.checkKeys(args[i]) || !c.checkValue(args[i+1]) {
+			return
+		}
+		values[args[i]] = args[i+1]
+		keys = append(keys, args[i])
+	}
+
+	defer c.srv.lock(keys...)()
+
+	errs := c.srv.gs.SetMulti(values)
+	for key, err := range errs {
+		c.writeGostormError(fmt.Errorf("%s: %s", key, err))
+		return
+	}
+
+	c.writeSimple("OK")
+}
+
+// exists counts the keys that exist, a key given twice counting twice
+func (c *conn) exists(args []string) {
+	keys := args[1:]
+	if !c.checkKeys(keys...) {
+		return
+	}
+
+	found, err := c.existing(keys)
+	if err != nil {
+		c.writeGostormError(err)
+		return
+	}
+
+	var n int64
+	for _, key := range keys {
+		if _, ok := found[key]; ok {
+			n++
+		}
+	}
+
+	c.writeInt(n)
+}
+
+// expire handles EXPIRE key seconds and PEXPIRE key milliseconds, a TTL
+// that isn't positive deletes the key
+func (c *conn) expire(args []string) {
+	key := args[1]
+	if !c.checkKeys(key) {
+		return
+	}
+
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.writeError("ERR value is not an integer or out of range")
+		return
+	}
+
+	ttl := time.Duration(n) * time.Second
+	if args[0] == "pexpire" {
+		ttl = time.Duration(n) * time.Millisecond
+	}
+
+	defer c.srv.lock(key)()
+
+	if ttl <= 0 {
+		_, err = c.srv.gs.Get(key)
+		if err == nil {
+			err = c.srv.gs.Delete(key)
+		}
+	} else {
+		err = c.srv.gs.Expire(key, ttl)
+	}
+
+	switch {
+	case err == nil:
+		c.writeInt(1)
+	case gostorm.IsNotFound(err):
+		c.writeInt(0)
+	default:
+		c.writeGostormError(err)
+	}
+}
+
+// persist drops a key's TTL. Whether there was one isn't known without
+// asking every driver, so it answers 1 for any existing key.
+func (c *conn) persist(args []string) {
+	key := args[1]
+	if !c.checkKeys(key) {
+		return
+	}
+
+	defer c.srv.lock(key)()
+
+	err := c.srv.gs.Expire(key, 0)
+	switch {
+	case err == nil:
+		c.writeInt(1)
+	case gostorm.IsNotFound(err):
+		c.writeInt(0)
+	default:
+		c.writeGostormError(err)
+	}
+}
+
+// ttl handles TTL and PTTL: -2 for a missing key, -1 for one that doesn't
+// expire
+func (c *conn) ttl(args []string) {
+	key := args[1]
+	if !c.checkKeys(key) {
+		return
+	}
+
+	ttl, err := c.srv.gs.TTL(key)
+	switch {
+	case gostorm.IsNotFound(err):
+		c.writeInt(-2)
+	case err != nil:
+		c.writeGostormError(err)
+	case ttl == gostorm.NoExpiry:
+		c.writeInt(-1)
+	case args[0] == "pttl":
+		c.writeInt(int64(ttl / time.Millisecond))
+	default:
+		// Round up, a key about to expire still has a second left
+		c.writeInt(int64((ttl + time.Second - 1) / time.Second))
+	}
+}
+
+// incr handles INCR, DECR, INCRBY and DECRBY, a missing key counting as 0
+func (c *conn) incr(args []string) {
+	key := args[1]
+	if !c.checkKeys(key) {
+		return
+	}
+
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		if delta, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			c.writeError("ERR value is not an integer or out of range")
+			return
+		}
+	}
+
+	if args[0] == "decr" || args[0] == "decrby" {
+		if delta == -1<<63 {
+			c.writeError("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+
+	defer c.srv.lock(key)()
+
+	var n int64
+	var ttl time.Duration
+
+	current, err := c.srv.gs.Get(key)
+	switch {
+	case err == nil:
+		if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+			c.writeError("ERR value is not an integer or out of range")
+			return
+		}
+		ttl = c.currentTTL(key)
+	case !gostorm.IsNotFound(err):
+		c.writeGostormError(err)
+		return
+	}
+
+	if (delta > 0 && n > (1<<63-1)-delta) || (delta < 0 && n < (-1<<63)-delta) {
+		c.writeError("ERR increment or decrement would overflow")
+		return
+	}
+	n += delta
+
+	if err := c.srv.gs.SetWithTTL(key, strconv.FormatInt(n, 10), ttl); err != nil {
+		c.writeGostormError(err)
+		return
+	}
+
+	c.writeInt(n)
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]. The
+// cursor is an offset into the sorted keys, so keys added or removed
+// between calls shift it: a key might show up twice, like in redis, or be
+// missed.
+func (c *conn) scan(args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.writeError("ERR invalid cursor")
+		return
+	}
+
+	pattern, count, wantStrings := "*", defaultScanCount, true
+
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.writeError("ERR syntax error")
+			return
+		}
+
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		case "type":
+			// Strings are all there is
+			wantStrings = strings.ToLower(args[i+1]) == "string"
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	var page []string
+	next := uint64(0)
+
+	if wantStrings {
+		keys, err := c.srv.gs.List(literalPrefix(pattern))
+		if err != nil {
+			c.writeGostormError(err)
+			return
+		}
+
+		start := min(cursor, uint64(len(keys)))
+		end := min(start+uint64(count), uint64(len(keys)))
+
+		// Like in redis, COUNT is how many keys to look at, not to return
+		for _, key := range keys[start:end] {
+			if match(pattern, key) {
+				page = append(page, key)
+			}
+		}
+
+		if end < uint64(len(keys)) {
+			next = end
+		}
+	}
+
+	c.writeArray(2)
+	c.writeBulk(strconv.FormatUint(next, 10))
+	c.writeArray(len(page))
+	for _, key := range page {
+		c.writeBulk(key)
+	}
+}
+
+// literalPrefix is the part of a glob pattern before its first special
+// character, only keys starting with it can match
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// match tells whether s matches a redis glob pattern: * and ? match any
+// characters, / included, [abc], [^abc] and [a-z] match a class and \
+// escapes. On a mismatch only the last * backs off, taking one more byte,
+// so it's linear in the pattern times s, however many stars there are.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, next = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if ok, width := matchOne(pattern[p:], s[i]); ok {
+				p, i = p+width, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		next++
+		p, i = star+1, next
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne tells whether b matches the pattern's first token, a literal, ?,
+// a class or an escape, and how long the token is
+func matchOne(pattern string, b byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// An unclosed [ is just a [
+			return b == '[', 1
+		}
+		return matchClass(pattern[1:end+1], b), end + 2
+	case '\\':
+		if len(pattern) > 1 {
+			return b == pattern[1], 2
+		}
+	}
+	return b == pattern[0], 1
+}
+
+// matchClass tells whether b is in a character class like "abc", "^abc" or
+// "a-z"
+func matchClass(class string, b byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+
+	found := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := min(class[i], class[i+2]), max(class[i], class[i+2])
+			if lo <= b && b <= hi {
+				found = true
+			}
+			i += 2
+		} else if class[i] == b {
+			found = true
+		}
+	}
+
+	return found != negate
+}
@@ -0,0 +1,375 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+	"github.com/wmgaca/gostorm/drivers/mem"
+)
+
+// exchange is a request and the exact reply it should get
+type exchange struct {
+	send string
+	want string
+}
+
+// cmd encodes a command as a RESP array of bulk strings
+func cmd(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return s
+}
+
+// dial starts a Server over a mem driver and connects to it
+func dial(t *testing.T) net.Conn {
+	t.Helper()
+
+	_, addr := serve(t)
+	return connect(t, addr)
+}
+
+// serve starts a Server over a mem driver, returning it and its address
+func serve(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	drv, err := mem.New("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(gostorm.New(gostorm.WithDriver(drv)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, l.Addr().String()
+}
+
+func connect(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// roundTrip sends ex and checks the reply
+func roundTrip(conn net.Conn, ex exchange) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, ex.send); err != nil {
+		return err
+	}
+
+	got := make([]byte, len(ex.want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if string(got) != ex.want {
+		return fmt.Errorf("got %q, want %q", got, ex.want)
+	}
+	return nil
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanges []exchange
+	}{
+		{"ping", []exchange{
+			{cmd("PING"), "+PONG\r\n"},
+			{cmd("ping", "hi"), "$2\r\nhi\r\n"},
+			{"PING\r\n", "+PONG\r\n"},
+			{cmd("echo", "a b"), "$3\r\na b\r\n"},
+		}},
+		{"pipelined", []exchange{
+			{cmd("set", "a", "1") + cmd("get", "a") + "ping\r\n", "+OK\r\n$1\r\n1\r\n+PONG\r\n"},
+		}},
+		{"set and get", []exchange{
+			{cmd("get", "a"), "$-1\r\n"},
+			{cmd("set", "a", "x\r\ny"), "+OK\r\n"},
+			{cmd("get", "a"), "$4\r\nx\r\ny\r\n"},
+			{cmd("set", "e", ""), "+OK\r\n"},
+			{cmd("get", "e"), "$0\r\n\r\n"},
+		}},
+		{"set options", []exchange{
+			{cmd("set", "a", "1", "xx"), "$-1\r\n"},
+			{cmd("set", "a", "1", "NX"), "+OK\r\n"},
+			{cmd("set", "a", "2", "nx"), "$-1\r\n"},
+			{cmd("set", "a", "3", "xx", "ex", "100"), "+OK\r\n"},
+			{cmd("set", "a", "4", "keepttl"), "+OK\r\n"},
+			{cmd("ttl", "a"), ":100\r\n"},
+			{cmd("get", "a"), "$1\r\n4\r\n"},
+			{cmd("set", "a", "1", "nx", "xx"), "-ERR syntax error\r\n"},
+			{cmd("set", "a", "1", "ex", "10", "keepttl"), "-ERR syntax error\r\n"},
+			{cmd("set", "a", "1", "ex"), "-ERR syntax error\r\n"},
+			{cmd("set", "a", "1", "ex", "0"), "-ERR invalid expire time in 'set' command\r\n"},
+			{cmd("set", "a", "1", "px", "soon"), "-ERR invalid expire time in 'set' command\r\n"},
+			{cmd("set", "a", "1", "forever"), "-ERR syntax error\r\n"},
+		}},
+		{"setex and setnx", []exchange{
+			{cmd("setex", "a", "100", "1"), "+OK\r\n"},
+			{cmd("ttl", "a"), ":100\r\n"},
+			{cmd("psetex", "a", "0", "1"), "-ERR invalid expire time in 'psetex' command\r\n"},
+			{cmd("setnx", "b", "1"), ":1\r\n"},
+			{cmd("setnx", "b", "2"), ":0\r\n"},
+			{cmd("get", "b"), "$1\r\n1\r\n"},
+		}},
+		{"multiple keys", []exchange{
+			{cmd("mset", "a", "1", "b", "2"), "+OK\r\n"},
+			{cmd("mset", "a", "1", "b"), "-ERR wrong number of arguments for 'mset' command\r\n"},
+			{cmd("exists", "a", "a", "c"), ":2\r\n"},
+			{cmd("del", "a", "c"), ":1\r\n"},
+			{cmd("mget", "a", "b"), "*2\r\n$-1\r\n$1\r\n2\r\n"},
+			{cmd("unlink", "b"), ":1\r\n"},
+		}},
+		{"incr", []exchange{
+			{cmd("incr", "n"), ":1\r\n"},
+			{cmd("incrby", "n", "10"), ":11\r\n"},
+			{cmd("decrby", "n", "20"), ":-9\r\n"},
+			{cmd("decr", "n"), ":-10\r\n"},
+			{cmd("incrby", "n", "ten"), "-ERR value is not an integer or out of range\r\n"},
+			{cmd("set", "s", "x"), "+OK\r\n"},
+			{cmd("incr", "s"), "-ERR value is not an integer or out of range\r\n"},
+			{cmd("set", "m", "9223372036854775807"), "+OK\r\n"},
+			{cmd("incr", "m"), "-ERR increment or decrement would overflow\r\n"},
+			{cmd("decrby", "m", "-9223372036854775808"), "-ERR decrement would overflow\r\n"},
+		}},
+		{"expiry", []exchange{
+			{cmd("ttl", "a"), ":-2\r\n"},
+			{cmd("set", "a", "1"), "+OK\r\n"},
+			{cmd("ttl", "a"), ":-1\r\n"},
+			{cmd("expire", "a", "100"), ":1\r\n"},
+			{cmd("ttl", "a"), ":100\r\n"},
+			{cmd("persist", "a"), ":1\r\n"},
+			{cmd("ttl", "a"), ":-1\r\n"},
+			{cmd("expire", "b", "100"), ":0\r\n"},
+			{cmd("persist", "b"), ":0\r\n"},
+			{cmd("expire", "a", "soon"), "-ERR value is not an integer or out of range\r\n"},
+			{cmd("pexpire", "a", "0"), ":1\r\n"},
+			{cmd("exists", "a"), ":0\r\n"},
+		}},
+		{"scan", []exchange{
+			{cmd("mset", "user:1", "x", "user:2", "y", "other", "z"), "+OK\r\n"},
+			{cmd("scan", "0", "match", "user:*"), "*2\r\n$1\r\n0\r\n*2\r\n$6\r\nuser:1\r\n$6\r\nuser:2\r\n"},
+			{cmd("scan", "0", "count", "2"), "*2\r\n$1\r\n2\r\n*2\r\n$5\r\nother\r\n$6\r\nuser:1\r\n"},
+			{cmd("scan", "2", "count", "2"), "*2\r\n$1\r\n0\r\n*1\r\n$6\r\nuser:2\r\n"},
+			{cmd("scan", "0", "type", "hash"), "*2\r\n$1\r\n0\r\n*0\r\n"},
+			{cmd("scan", "0", "count", "0"), "-ERR value is not an integer or out of range\r\n"},
+			{cmd("scan", "0", "match"), "-ERR syntax error\r\n"},
+			{cmd("scan", "x"), "-ERR invalid cursor\r\n"},
+		}},
+		{"errors", []exchange{
+			{cmd("nope"), "-ERR unknown command 'nope'\r\n"},
+			{cmd("get"), "-ERR wrong number of arguments for 'get' command\r\n"},
+			{cmd("GET", "a", "b"), "-ERR wrong number of arguments for 'get' command\r\n"},
+			{cmd("get", ""), "-ERR key must be 1-250 bytes\r\n"},
+			{cmd("get", strings.Repeat("k", maxKeyLength+1)), "-ERR key must be 1-250 bytes\r\n"},
+			{cmd("select", "0"), "+OK\r\n"},
+			{cmd("select", "1"), "-ERR DB index is out of range\r\n"},
+			{"\r\n" + cmd("ping"), "+PONG\r\n"},
+		}},
+		{"quit", []exchange{
+			{cmd("quit") + cmd("ping"), "+OK\r\n"},
+		}},
+	}
+
+	for _, test := range tests {
+		conn := dial(t)
+
+		for i, ex := range test.exchanges {
+			if err := roundTrip(conn, ex); err != nil {
+				t.Errorf("%s: exchange %d: %v", test.name, i, err)
+				break
+			}
+		}
+	}
+}
+
+func TestWritesTakeTheKeyLock(t *testing.T) {
+	tests := []struct {
+		send string
+		want string
+	}{
+		{cmd("SET", "k", "v"), "+OK\r\n"},
+		{cmd("SETEX", "k", "10", "v"), "+OK\r\n"},
+		{cmd("PSETEX", "k", "10000", "v"), "+OK\r\n"},
+		{cmd("MSET", "a", "1", "k", "v"), "+OK\r\n"},
+		{cmd("EXPIRE", "k", "10"), ":1\r\n"},
+		{cmd("PEXPIRE", "k", "10000"), ":1\r\n"},
+		{cmd("PERSIST", "k"), ":1\r\n"},
+		{cmd("DEL", "a", "k"), ":2\r\n"},
+		{cmd("UNLINK", "k"), ":0\r\n"},
+	}
+
+	srv, addr := serve(t)
+	conn := connect(t, addr)
+
+	for _, test := range tests {
+		unlock := srv.lock("k")
+
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.WriteString(conn, test.send); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing comes back while the lock's held
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%q: answered while k was locked", test.send)
+		}
+		unlock()
+
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		got := make([]byte, len(test.want))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != test.want {
+			t.Fatalf("%q: got %q, %v, want %q", test.send, got, err, test.want)
+		}
+	}
+}
+
+func TestMultiKeyWritesDontDeadlock(t *testing.T) {
+	_, addr := serve(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		conn := connect(t, addr)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r := bufio.NewReader(conn)
+			for j := 0; j < 50; j++ {
+				// Keys in every order, some of them on the same stripe
+				a, b := fmt.Sprintf("k%d", (i*7+j)%100), fmt.Sprintf("k%d", (i*13+j*3)%100)
+				send := cmd("MSET", a, "1", b, "2", a, "3")
+				if i%2 == 1 {
+					send = cmd("DEL", b, a, b)
+				}
+
+				conn.SetDeadline(time.Now().Add(2 * time.Second))
+				if _, err := io.WriteString(conn, send); err != nil {
+					t.Error(err)
+					return
+				}
+				if line, err := r.ReadString('\n'); err != nil || strings.HasPrefix(line, "-") {
+					t.Errorf("%q: got %q, %v", send, line, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestProtocolErrors(t *testing.T) {
+	// Every argument's fine, all of them together aren't
+	arg := fmt.Sprintf("$%d\r\n%s\r\n", maxValueSize, strings.Repeat("v", maxValueSize))
+	tooBig := fmt.Sprintf("*%d\r\n", maxCommandSize/maxValueSize+1) + strings.Repeat(arg, maxCommandSize/maxValueSize) + "$1\r\n"
+
+	tests := []struct {
+		name string
+		send string
+		want string
+	}{
+		{"bad multibulk length", "*x\r\n", "invalid multibulk length"},
+		{"too many args", fmt.Sprintf("*%d\r\n", maxArgs+1), "invalid multibulk length"},
+		{"not a bulk string", "*1\r\n+get\r\n", "expected '$', got '+'"},
+		{"negative bulk length", "*1\r\n$-5\r\n", "invalid bulk length"},
+		{"huge bulk length", fmt.Sprintf("*1\r\n$%d\r\n", maxValueSize+maxKeyLength+1), "invalid bulk length"},
+		{"bulk string too long", "*1\r\n$3\r\ngetx\r\n", "bad bulk string"},
+		{"inline too big", strings.Repeat("a", maxInlineSize+10) + "\r\n", "too big inline request"},
+		{"command too big", tooBig, "command too big"},
+	}
+
+	for _, test := range tests {
+		conn := dial(t)
+
+		if err := roundTrip(conn, exchange{test.send, "-ERR Protocol error: " + test.want + "\r\n"}); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		// The connection is dropped after a malformed request
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: the connection is still open, read got %v", test.name, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"*:1", "user:1", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[llo", "h[llo", true},
+		{"h[llo", "hallo", false},
+		{"abc", "ab", false},
+		{"ab", "abc", false},
+		{"a*", "", false},
+		{"**a", "ba", true},
+		{"*a?", "aab", true},
+		{`ab\`, `ab\`, true},
+		{"*[0-9]", "k:x9", true},
+		// Would take forever if every * backtracked on its own
+		{strings.Repeat("a*", 30) + "b", strings.Repeat("a", 200), false},
+		{strings.Repeat("*a", 30), strings.Repeat("a", 200), true},
+	}
+
+	for _, test := range tests {
+		if got := match(test.pattern, test.s); got != test.want {
+			t.Errorf("match(%q, %q): got %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	tests := map[string]string{
+		"user:*":  "user:",
+		"user:?":  "user:",
+		"a[bc]":   "a",
+		`a\*`:     "a",
+		"*":       "",
+		"literal": "literal",
+	}
+
+	for pattern, want := range tests {
+		if got := literalPrefix(pattern); got != want {
+			t.Errorf("%q: got %q, want %q", pattern, got, want)
+		}
+	}
+}
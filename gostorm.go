@@ -1,231 +1,793 @@
-package main
+// Package gostorm fetches data from multiple datastores at once, returning
+// whatever comes back first.
+package gostorm
 
 import (
 	"errors"
-	"fmt"
-	"log"
-	"net/http"
-	"os"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
-
-	"github.com/gorilla/mux"
-	"github.com/wmgaca/gostorm/drivers/redis"
 )
 
-// Debug mode, more verbose if true
-var Debug = false
+// DefaultTimeout is the budget for Get, Set and Delete unless told otherwise
+const DefaultTimeout = 10 * time.Second
+
+// Gostorm is Gostorm's config
+type Gostorm struct {
+	drivers     []*backend
+	timeout     time.Duration
+	readPolicy  Consistency
+	writePolicy Consistency
+	logger      *slog.Logger
+	debug       bool
+	metrics     Metrics
+	clock       Clock
+	coalesce    bool
+	tracer      Tracer
+	gets        flightGroup
+	watches     watchHub
+	started     time.Time
+	tenants     map[string]*tenant
+
+	// mu guards shuttingDown, pending counts the fan-outs' goroutines so
+	// Shutdown can wait for them
+	mu           sync.Mutex
+	shuttingDown bool
+	pending      sync.WaitGroup
+}
+
+// backend is a driver together with the policies used when calling it
+type backend struct {
+	driver  Driver
+	retry   map[Op]RetryPolicy
+	timeout time.Duration
+
+	// mu guards status and latencies, Index, Name and Capabilities never
+	// change
+	mu        sync.Mutex
+	status    DriverStatus
+	latencies latencies
+}
 
-var gostormInstance Gostorm
+// outcome is what a single driver made of an operation
+type outcome struct {
+	backend *backend
+	ret     string
+	err     *DriverError
+}
 
-const defaultTimeout = 10 * time.Second
+// New sets up Gostorm, see the With* functions for what can be configured
+func New(opts ...Option) *Gostorm {
+	gs := &Gostorm{
+		timeout:     DefaultTimeout,
+		readPolicy:  One,
+		writePolicy: One,
+		metrics:     nopMetrics{},
+		tracer:      nopTracer{},
+		clock:       systemClock{},
+		coalesce:    true,
+	}
 
-func init() {
-	if len(os.Getenv("DEBUG")) > 0 {
-		Debug = true
+	for _, opt := range opts {
+		opt(gs)
 	}
 
-	log.Printf("gostorm Debug=%t", Debug)
-}
+	if gs.logger == nil {
+		gs.logger = defaultLogger(gs.debug)
+	}
+	gs.checkTenants()
+	gs.started = gs.clock.Now()
 
-// Gostorm is Gostorm's config
-type Gostorm struct {
-	drivers []Driver
+	return gs
 }
 
-// New sets up Gostorm's connections
-func New(drivers ...Driver) *Gostorm {
-	return &Gostorm{
-		drivers: drivers,
-	}
+// Timeout returns the overall budget for Get, Set and Delete
+func (gs *Gostorm) Timeout() time.Duration {
+	return gs.timeout
 }
 
-// GetWithTimeout a value by key
-func (gs *Gostorm) GetWithTimeout(key string, timeout time.Duration) (string, error) {
-	retChan := make(chan string)
-	errChan := make(chan error)
+// invoke runs a single driver call, giving up once deadline passes
+func (gs *Gostorm) invoke(parent scope, b *backend, op Op, attempt int, call func(Driver, chan string, chan error), deadline time.Time) (string, error) {
+	// Buffered, so an abandoned call doesn't leak its goroutine
+	retChan := make(chan string, 1)
+	errChan := make(chan error, 1)
 
-	for _, driver := range gs.drivers {
-		go driver.Get(key, retChan, errChan)
-	}
+	span, drv := gs.startCall(parent, b, op, attempt)
+
+	start := gs.clock.Now()
+	b.started()
+	go func() {
+		defer b.finished()
+		call(drv, retChan, errChan)
+	}()
 
 	var (
 		ret string
 		err error
 	)
 
-	retCount := 0
-	startTime := time.Now()
+	select {
+	case ret = <-retChan:
+	case err = <-errChan:
+	case <-gs.clock.After(deadline.Sub(start)):
+		err = ErrTimeout
+	}
+
+	elapsed := gs.clock.Now().Sub(start)
+	gs.metrics.ObserveDriver(driverName(b.driver), op, elapsed, err)
+	b.observe(err, elapsed, gs.clock.Now())
+	span.End(err)
+
+	return ret, err
+}
+
+// do calls the driver, retrying per its op policy while the deadline allows
+func (gs *Gostorm) do(parent scope, b *backend, op Op, call func(Driver, chan string, chan error), deadline time.Time, outChan chan outcome) {
+	policy := b.retry[op]
+
+	if b.timeout > 0 {
+		if budget := gs.clock.Now().Add(b.timeout); budget.Before(deadline) {
+			deadline = budget
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		ret, err := gs.invoke(parent, b, op, attempt, call, deadline)
+		if err == nil {
+			outChan <- outcome{backend: b, ret: ret}
+			return
+		}
+
+		if !policy.shouldRetry(attempt, err) {
+			outChan <- outcome{backend: b, err: b.err(op, err)}
+			return
+		}
+
+		delay := policy.Backoff(attempt)
+		if gs.clock.Now().Add(delay).After(deadline) {
+			outChan <- outcome{backend: b, err: b.err(op, err)}
+			return
+		}
+
+		parent.log.Warn("retrying", "driver", b.status.Name, "op", op, "attempt", attempt, "err", err)
+		<-gs.clock.After(delay)
+	}
+}
+
+// err wraps an error returned by the driver
+func (b *backend) err(op Op, err error) *DriverError {
+	return &DriverError{Driver: driverName(b.driver), Op: op, Err: err}
+}
+
+// fanOut calls every driver and waits for as many successes as policy
+// requires, returning the value most of them agree on. If that can't
+// happen, it returns a *MultiError with every failed driver's outcome.
+func (gs *Gostorm) fanOut(parent scope, op Op, policy Consistency, call func(Driver, chan string, chan error), timeout time.Duration) (string, error) {
+	targets := parent.tenant.only(gs.targets(op))
+	if len(targets) == 0 {
+		return "", ErrNoDrivers
+	}
+
+	if err := gs.enter(len(targets)); err != nil {
+		return "", err
+	}
+
+	required := policy.required(len(targets))
+	outChan := make(chan outcome, len(targets))
+
+	deadline := gs.clock.Now().Add(timeout)
+
+	// They carry on after fanOut returns, e.g. writes to the drivers the
+	// policy didn't wait for
+	for _, b := range targets {
+		go func(b *backend) {
+			defer gs.pending.Done()
+			gs.do(parent, b, op, call, deadline, outChan)
+		}(b)
+	}
+
+	timeoutChan := gs.clock.After(timeout)
+
+	var values []string
+	multiErr := &MultiError{}
+	answered := make(map[*backend]bool)
 
 	for {
 		select {
-		case ret = <-retChan:
-			retCount++
-			log.Printf("gostorm.ret => %s", ret)
-			return ret, nil
-		case err = <-errChan:
-			retCount++
-			log.Printf("gostorm.err => %s", err)
-			if retCount == len(gs.drivers) {
-				return "", err
+		case out := <-outChan:
+			answered[out.backend] = true
+
+			if out.err != nil {
+				parent.log.Debug("driver failed", "driver", out.backend.status.Name, "op", op, "err", out.err.Err)
+				multiErr.Errors = append(multiErr.Errors, out.err)
+				if len(multiErr.Errors) > len(targets)-required {
+					return "", multiErr
+				}
+				continue
 			}
-		default:
-			if time.Since(startTime) > timeout {
-				return "", errors.New("Gostorm connection timeout.")
+
+			parent.log.Debug("driver answered", "driver", out.backend.status.Name, "op", op, "size", len(out.ret))
+			values = append(values, out.ret)
+
+			if len(values) == 1 && op.read() {
+				if m, ok := gs.metrics.(ReadMetrics); ok {
+					m.ReadWon(out.backend.status.Name, op)
+				}
+			}
+			if len(values) == required {
+				return majority(values), nil
+			}
+		case <-timeoutChan:
+			// Whoever hasn't answered by now timed out
+			for _, b := range targets {
+				if !answered[b] {
+					multiErr.Errors = append(multiErr.Errors, b.err(op, ErrTimeout))
+				}
 			}
+			return "", multiErr
 		}
 	}
 }
 
+// majority returns the most common of values, the earliest one on a tie
+func majority(values []string) string {
+	counts := make(map[string]int)
+	best := values[0]
+
+	for _, value := range values {
+		counts[value]++
+		if counts[value] > counts[best] {
+			best = value
+		}
+	}
+
+	return best
+}
+
+// GetWithTimeout a value by key. Concurrent Gets of the same key share a
+// single fan-out, unless WithCoalescing(false) says otherwise.
+func (gs *Gostorm) GetWithTimeout(key string, timeout time.Duration) (string, error) {
+	return gs.get(origin{}, key, timeout)
+}
+
+// get is GetWithTimeout on behalf of o, a coalesced get's
+// driver calls being traced under the get that made them
+func (gs *Gostorm) get(o origin, key string, timeout time.Duration) (ret string, err error) {
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, OpGet, key)
+	defer func() { span.End(err) }()
+
+	get := func(timeout time.Duration) (string, error) {
+		return gs.fanOut(p, OpGet, p.tenant.readPolicy(gs.readPolicy), func(drv Driver, retChan chan string, errChan chan error) {
+			drv.Get(key, retChan, errChan)
+		}, timeout)
+	}
+
+	if !gs.coalesce {
+		return get(timeout)
+	}
+
+	// The shared fan-out gets the full budget, a caller in a hurry only
+	// stops waiting for it
+	ret, err, shared := gs.gets.do(key, gs.clock.After(timeout), func() (string, error) {
+		return get(max(timeout, gs.timeout))
+	})
+	if shared {
+		gs.metrics.Coalesced(OpGet)
+		span.SetAttr("coalesced", "true")
+	}
+
+	return ret, err
+}
+
 // SetWithTimeout a value by key
 func (gs *Gostorm) SetWithTimeout(key, value string, timeout time.Duration) error {
-	retChan := make(chan string)
-	errChan := make(chan error)
+	return gs.set(origin{}, key, value, timeout)
+}
+
+func (gs *Gostorm) set(o origin, key, value string, timeout time.Duration) (err error) {
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, OpSet, key)
+	defer func() { span.End(err) }()
 
-	for _, driver := range gs.drivers {
-		go driver.Set(key, value, retChan, errChan)
+	release, err := p.tenant.admit(key, size(key, value), gs.clock.Now())
+	if err != nil {
+		return err
 	}
 
-	var (
-		ret string
-		err error
-	)
+	_, err = gs.fanOut(p, OpSet, p.tenant.writePolicy(gs.writePolicy), func(drv Driver, retChan chan string, errChan chan error) {
+		drv.Set(key, value, retChan, errChan)
+	}, timeout)
 
-	retCount := 0
-	startTime := time.Now()
+	if err != nil {
+		release()
+	} else {
+		p.tenant.stored(key, size(key, value), time.Time{})
+		gs.watches.publish(Event{Op: OpSet, Key: key, Value: value})
+	}
 
-	for {
+	return err
+}
+
+// DeleteWithTimeout a key
+func (gs *Gostorm) DeleteWithTimeout(key string, timeout time.Duration) error {
+	return gs.delete(origin{}, key, timeout)
+}
+
+func (gs *Gostorm) delete(o origin, key string, timeout time.Duration) (err error) {
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, OpDelete, key)
+	defer func() { span.End(err) }()
+
+	_, err = gs.fanOut(p, OpDelete, p.tenant.writePolicy(gs.writePolicy), func(drv Driver, retChan chan string, errChan chan error) {
+		drv.Delete(key, retChan, errChan)
+	}, timeout)
+
+	if err == nil {
+		p.tenant.removed(key)
+		gs.watches.publish(Event{Op: OpDelete, Key: key})
+	}
+
+	return err
+}
+
+// ListWithTimeout returns the keys starting with prefix, merged from every
+// driver that can list them. It fails only if none of them could.
+func (gs *Gostorm) ListWithTimeout(prefix string, timeout time.Duration) ([]string, error) {
+	return gs.list(origin{}, prefix, timeout)
+}
+
+func (gs *Gostorm) list(o origin, prefix string, timeout time.Duration) (keys []string, err error) {
+	prefix = o.tenant.key(prefix)
+	span, p := gs.startOp(o, OpList, prefix)
+	defer func() { span.End(err) }()
+
+	type listing struct {
+		backend *backend
+		keys    []string
+		err     error
+	}
+
+	targets := p.tenant.only(gs.targets(OpList))
+	if len(targets) == 0 {
+		return nil, ErrNoDrivers
+	}
+
+	resChan := make(chan listing, len(targets))
+	deadline := gs.clock.Now().Add(timeout)
+	pending := make(map[*backend]bool)
+
+	for _, b := range targets {
+		if _, ok := b.driver.(Lister); !ok {
+			continue
+		}
+		if err := gs.enter(1); err != nil {
+			return nil, err
+		}
+		pending[b] = true
+
+		go func(b *backend) {
+			defer gs.pending.Done()
+
+			keysChan := make(chan []string, 1)
+			errChan := make(chan error, 1)
+
+			callSpan, drv := gs.startCall(p, b, OpList, 1)
+			lister, ok := drv.(Lister)
+			if !ok {
+				lister = b.driver.(Lister)
+			}
+
+			start := gs.clock.Now()
+			b.started()
+			go func() {
+				defer b.finished()
+				lister.List(prefix, keysChan, errChan)
+			}()
+
+			res := listing{backend: b}
+			select {
+			case res.keys = <-keysChan:
+			case res.err = <-errChan:
+			case <-gs.clock.After(deadline.Sub(start)):
+				res.err = ErrTimeout
+			}
+
+			elapsed := gs.clock.Now().Sub(start)
+			gs.metrics.ObserveDriver(driverName(b.driver), OpList, elapsed, res.err)
+			b.observe(res.err, elapsed, gs.clock.Now())
+			callSpan.End(res.err)
+			resChan <- res
+		}(b)
+	}
+
+	seen := make(map[string]bool)
+	listed := false
+	multiErr := &MultiError{}
+	timeoutChan := gs.clock.After(timeout)
+
+	for len(pending) > 0 {
 		select {
-		case ret = <-retChan:
-			retCount++
-			log.Printf("gs.set => %s", ret)
-			return nil
-		case err = <-errChan:
-			retCount++
-			log.Printf("gs.set => %s", err)
-			// 2 == number of data stores we're using at the moment ;)
-			if retCount == 2 {
-				return err
+		case res := <-resChan:
+			delete(pending, res.backend)
+
+			if errors.Is(res.err, ErrUnsupported) {
+				continue
 			}
-		default:
-			if time.Since(startTime) > timeout {
-				return errors.New("Gostorm connection timeout.")
+			if res.err != nil {
+				p.log.Debug("driver failed", "driver", res.backend.status.Name, "op", OpList, "err", res.err)
+				multiErr.Errors = append(multiErr.Errors, res.backend.err(OpList, res.err))
+				continue
 			}
+
+			listed = true
+			for _, key := range res.keys {
+				seen[key] = true
+			}
+		case <-timeoutChan:
+			for b := range pending {
+				multiErr.Errors = append(multiErr.Errors, b.err(OpList, ErrTimeout))
+			}
+			pending = nil
+		}
+	}
+
+	if !listed {
+		if len(multiErr.Errors) == 0 {
+			return nil, ErrUnsupported
 		}
+		return nil, multiErr
+	}
+
+	keys = make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, p.tenant.strip(key))
 	}
+	sort.Strings(keys)
+
+	return keys, nil
 }
 
-// Get a value by key
-func (gs *Gostorm) Get(key string) (string, error) {
-	return gs.GetWithTimeout(key, defaultTimeout)
+// SetWithTTLTimeout sets a value that expires after ttl. Drivers that can't
+// expire keys are left out, and count as failed.
+func (gs *Gostorm) SetWithTTLTimeout(key, value string, ttl, timeout time.Duration) error {
+	return gs.setWithTTL(origin{}, key, value, ttl, timeout)
 }
 
-// Set a key=value
-func (gs *Gostorm) Set(key, value string) error {
-	return gs.SetWithTimeout(key, value, defaultTimeout)
+func (gs *Gostorm) setWithTTL(o origin, key, value string, ttl, timeout time.Duration) (err error) {
+	if ttl == 0 {
+		return gs.set(o, key, value, timeout)
+	}
+
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, OpSet, key)
+	defer func() { span.End(err) }()
+
+	release, err := p.tenant.admit(key, size(key, value), gs.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = gs.fanOut(p, OpSet, p.tenant.writePolicy(gs.writePolicy), func(drv Driver, retChan chan string, errChan chan error) {
+		expirer, ok := drv.(Expirer)
+		if !ok {
+			errChan <- ErrUnsupported
+			return
+		}
+		expirer.SetWithTTL(key, value, ttl, retChan, errChan)
+	}, timeout)
+
+	if err != nil {
+		release()
+	} else {
+		p.tenant.stored(key, size(key, value), expiry(gs.clock.Now(), ttl))
+		gs.watches.publish(Event{Op: OpSet, Key: key, Value: value, TTL: ttl})
+	}
+
+	return err
 }
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	ret := "Go, baby, go!"
-	log.Printf("%s / => %s", r.Method, ret)
-	fmt.Fprintf(w, "%s\n", ret)
+// ExpireWithTimeout changes the TTL of an existing key, zero meaning never
+func (gs *Gostorm) ExpireWithTimeout(key string, ttl, timeout time.Duration) error {
+	return gs.expire(origin{}, key, ttl, timeout)
 }
 
-func getHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+func (gs *Gostorm) expire(o origin, key string, ttl, timeout time.Duration) (err error) {
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, OpExpire, key)
+	defer func() { span.End(err) }()
 
-	ret, err := gostormInstance.Get(key)
-	if err != nil {
-		ret = err.Error()
+	_, err = gs.fanOut(p, OpExpire, p.tenant.writePolicy(gs.writePolicy), func(drv Driver, retChan chan string, errChan chan error) {
+		expirer, ok := drv.(Expirer)
+		if !ok {
+			errChan <- ErrUnsupported
+			return
+		}
+		expirer.Expire(key, ttl, retChan, errChan)
+	}, timeout)
+
+	if err == nil {
+		p.tenant.expiring(key, expiry(gs.clock.Now(), ttl))
+		gs.watches.publish(Event{Op: OpExpire, Key: key, TTL: ttl})
 	}
 
-	log.Printf("%s /get/%s/ => %s", r.Method, key, ret)
+	return err
+}
 
-	fmt.Fprintf(w, "%s\n", ret)
+// TTLWithTimeout returns how long a key has left, NoExpiry if it lives forever
+func (gs *Gostorm) TTLWithTimeout(key string, timeout time.Duration) (time.Duration, error) {
+	return gs.ttl(origin{}, key, timeout)
 }
 
-func setHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+func (gs *Gostorm) ttl(o origin, key string, timeout time.Duration) (_ time.Duration, err error) {
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, OpTTL, key)
+	defer func() { span.End(err) }()
+
+	ret, err := gs.fanOut(p, OpTTL, p.tenant.readPolicy(gs.readPolicy), func(drv Driver, retChan chan string, errChan chan error) {
+		expirer, ok := drv.(Expirer)
+		if !ok {
+			errChan <- ErrUnsupported
+			return
+		}
 
-	key := "?"
-	value := "?"
-	ret := "?"
+		ttlChan := make(chan time.Duration, 1)
+		ttlErrChan := make(chan error, 1)
+		go expirer.TTL(key, ttlChan, ttlErrChan)
+
+		select {
+		case ttl := <-ttlChan:
+			retChan <- strconv.FormatInt(int64(ttl), 10)
+		case err := <-ttlErrChan:
+			errChan <- err
+		}
+	}, timeout)
 
 	if err != nil {
-		ret = err.Error()
-	} else {
-		if len(r.PostForm["key"]) == 0 || len(r.PostForm["value"]) == 0 {
-			ret = "Missing key or value?"
-		} else {
+		return 0, err
+	}
 
-			key = r.PostForm["key"][0]
-			value = r.PostForm["value"][0]
+	ttl, err := strconv.ParseInt(ret, 10, 64)
+	return time.Duration(ttl), err
+}
 
-			ret = "SUCCESS"
-			err = gostormInstance.Set(key, value)
-			if err != nil {
-				ret = err.Error()
-			}
+// GetMultiWithTimeout gets many keys at once, in a single call to drivers
+// that are BatchGetters and a call a key to the others. It returns the
+// values found and an error for every key that wasn't.
+func (gs *Gostorm) GetMultiWithTimeout(keys []string, timeout time.Duration) (map[string]string, map[string]error) {
+	return gs.getMulti(origin{}, keys, timeout)
+}
+
+func (gs *Gostorm) getMulti(o origin, keys []string, timeout time.Duration) (map[string]string, map[string]error) {
+	// Middleware takes batches whatever's under it, it's up to that driver
+	batched := func(drv Driver) bool {
+		_, ok := innermost(drv).(BatchGetter)
+		return ok
+	}
+
+	// Unless a driver can take them all at once, every key has a get of
+	// its own, coalesced with any other get of it
+	if !anyBatched(o.tenant.only(gs.targets(OpGet)), batched) {
+		return gs.getEach(o, keys, timeout)
+	}
+
+	span, p := gs.startOp(o, "getmulti", "")
+	defer span.End(nil)
+
+	// Where each key is stored, duplicates asked for once
+	var stored []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key = p.tenant.key(key); !seen[key] {
+			seen[key] = true
+			stored = append(stored, key)
 		}
 	}
 
-	log.Printf("%s /set/%s/ => %s", r.Method, key, ret)
+	call := batch{
+		batched: batched,
+		all: func(drv Driver) (map[string]string, map[string]error) {
+			values, errs := drv.(BatchGetter).GetMulti(stored)
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			for _, key := range stored {
+				if _, ok := values[key]; !ok && errs[key] == nil {
+					errs[key] = ErrNotFound
+				}
+			}
+			return values, errs
+		},
+		single: func(key string) func(Driver, chan string, chan error) {
+			return func(drv Driver, retChan chan string, errChan chan error) {
+				drv.Get(key, retChan, errChan)
+			}
+		},
+	}
+
+	found, failed := gs.fanOutBatch(p, OpGet, p.tenant.readPolicy(gs.readPolicy), stored, call, timeout)
+
+	values := make(map[string]string)
+	for key, value := range found {
+		values[p.tenant.strip(key)] = value
+	}
+	errs := make(map[string]error)
+	for key, err := range failed {
+		errs[p.tenant.strip(key)] = err
+	}
 
-	fmt.Fprintf(w, "%s\n", ret)
+	return values, errs
 }
 
-func configureRouter() *mux.Router {
-	router := mux.NewRouter()
+// getEach is getMulti a key at a time
+func (gs *Gostorm) getEach(o origin, keys []string, timeout time.Duration) (map[string]string, map[string]error) {
+	type result struct {
+		key   string
+		value string
+		err   error
+	}
+
+	resChan := make(chan result, len(keys))
+	for _, key := range keys {
+		go func(key string) {
+			value, err := gs.get(o, key, timeout)
+			resChan <- result{key, value, err}
+		}(key)
+	}
+
+	values := make(map[string]string)
+	errs := make(map[string]error)
 
-	router.HandleFunc("/", homeHandler).Methods("GET")
-	router.HandleFunc("/get/{key:[a-zA-Z0-9:.]+}/", getHandler).Methods("GET")
-	router.HandleFunc("/set/", setHandler).Methods("POST")
+	for range keys {
+		res := <-resChan
+		if res.err != nil {
+			errs[res.key] = res.err
+		} else {
+			values[res.key] = res.value
+		}
+	}
 
-	return router
+	return values, errs
 }
 
-func main() {
-	log.Println("Starting gostorm...")
+// SetMultiWithTimeout sets many keys at once, in a single call to drivers
+// that are BatchSetters and a call a key to the others, returning an error
+// for every key that couldn't be set
+func (gs *Gostorm) SetMultiWithTimeout(values map[string]string, timeout time.Duration) map[string]error {
+	return gs.setMulti(origin{}, values, timeout)
+}
 
-	var drivers []Driver
+func (gs *Gostorm) setMulti(o origin, values map[string]string, timeout time.Duration) map[string]error {
+	// Middleware takes batches whatever's under it, it's up to that driver
+	batched := func(drv Driver) bool {
+		_, ok := innermost(drv).(BatchSetter)
+		return ok
+	}
 
-	redisConnString := os.Getenv("REDISTOGO_URL")
-	if len(redisConnString) == 0 {
-		log.Println("Missing REDISTOGO_URL env var, are we?")
-	} else {
-		redisDriver, err := redis.New(redisConnString)
-		if err == nil {
-			drivers = append(drivers, redisDriver)
+	if !anyBatched(o.tenant.only(gs.targets(OpSet)), batched) {
+		return gs.setEach(o, values, timeout)
+	}
+
+	span, p := gs.startOp(o, "setmulti", "")
+	defer span.End(nil)
+
+	errs := make(map[string]error)
+
+	// Keys over the tenant's quota, counting the ones admitted before
+	// them, are left out
+	now := gs.clock.Now()
+	toSet := make(map[string]string)
+	releases := make(map[string]func())
+	for key, value := range values {
+		key = p.tenant.key(key)
+		release, err := p.tenant.admit(key, size(key, value), now)
+		if err != nil {
+			errs[p.tenant.strip(key)] = err
+			continue
 		}
+		toSet[key] = value
+		releases[key] = release
 	}
 
-	// memcachedConnString := os.Getenv("MEMCACHED_CONN_STRING")
-	// if len(memcachedConnString) == 0 {
-	// 	log.Println("Missing MEMCACHED_CONN_STRING env var, are we?")
-	// } else {
-	// 	memcachedDriver, err := memcache.New(memcachedConnString)
-	// 	if err == nil {
-	// 		drivers = append(drivers, memcachedDriver)
-	// 	}
-	// }
+	keys := make([]string, 0, len(toSet))
+	for key := range toSet {
+		keys = append(keys, key)
+	}
 
-	gostormInstance = *New(drivers...)
+	call := batch{
+		batched: batched,
+		all: func(drv Driver) (map[string]string, map[string]error) {
+			return nil, drv.(BatchSetter).SetMulti(toSet)
+		},
+		single: func(key string) func(Driver, chan string, chan error) {
+			return func(drv Driver, retChan chan string, errChan chan error) {
+				drv.Set(key, toSet[key], retChan, errChan)
+			}
+		},
+	}
 
-	// MySQL
-	// mySqlConnString := os.Getenv("MYSQL_CONN_STRING")
-	// if len(mySqlConnString) == 0 {
-	// 	// return nil, errors.New("Missing MYSQL_CONN_STRING env var, are we?")
-	// }
+	_, failed := gs.fanOutBatch(p, OpSet, p.tenant.writePolicy(gs.writePolicy), keys, call, timeout)
 
-	ServerAddr := ":" + os.Getenv("PORT")
-	log.Printf("Running server on %s", ServerAddr)
+	for _, key := range keys {
+		if err, ok := failed[key]; ok {
+			releases[key]()
+			errs[p.tenant.strip(key)] = err
+			continue
+		}
+		p.tenant.stored(key, size(key, toSet[key]), time.Time{})
+		gs.watches.publish(Event{Op: OpSet, Key: key, Value: toSet[key]})
+	}
 
-	http.Handle("/", configureRouter())
-	// http.HandleFunc("/", homeHandler)
-	fmt.Println("listening...")
+	return errs
+}
 
-	err := http.ListenAndServe(ServerAddr, nil)
-	if err != nil {
-		panic(err)
+// setEach is setMulti a key at a time
+func (gs *Gostorm) setEach(o origin, values map[string]string, timeout time.Duration) map[string]error {
+	type result struct {
+		key string
+		err error
+	}
+
+	resChan := make(chan result, len(values))
+	for key, value := range values {
+		go func(key, value string) {
+			resChan <- result{key, gs.set(o, key, value, timeout)}
+		}(key, value)
 	}
+
+	errs := make(map[string]error)
+	for range values {
+		if res := <-resChan; res.err != nil {
+			errs[res.key] = res.err
+		}
+	}
+
+	return errs
+}
+
+// Get a value by key
+func (gs *Gostorm) Get(key string) (string, error) {
+	return gs.GetWithTimeout(key, gs.timeout)
+}
+
+// Set a key=value
+func (gs *Gostorm) Set(key, value string) error {
+	return gs.SetWithTimeout(key, value, gs.timeout)
+}
+
+// Delete a key
+func (gs *Gostorm) Delete(key string) error {
+	return gs.DeleteWithTimeout(key, gs.timeout)
+}
+
+// SetWithTTL sets a value that expires after ttl
+func (gs *Gostorm) SetWithTTL(key, value string, ttl time.Duration) error {
+	return gs.SetWithTTLTimeout(key, value, ttl, gs.timeout)
+}
+
+// Expire changes the TTL of an existing key
+func (gs *Gostorm) Expire(key string, ttl time.Duration) error {
+	return gs.ExpireWithTimeout(key, ttl, gs.timeout)
+}
+
+// TTL returns how long a key has left
+func (gs *Gostorm) TTL(key string) (time.Duration, error) {
+	return gs.TTLWithTimeout(key, gs.timeout)
+}
+
+// List keys starting with prefix
+func (gs *Gostorm) List(prefix string) ([]string, error) {
+	return gs.ListWithTimeout(prefix, gs.timeout)
+}
+
+// GetMulti gets many keys at once
+func (gs *Gostorm) GetMulti(keys []string) (map[string]string, map[string]error) {
+	return gs.GetMultiWithTimeout(keys, gs.timeout)
+}
+
+// SetMulti sets many keys at once
+func (gs *Gostorm) SetMulti(values map[string]string) map[string]error {
+	return gs.SetMultiWithTimeout(values, gs.timeout)
 }
@@ -0,0 +1,285 @@
+package gostorm
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDriver answers every call the same way, after delay
+type stubDriver struct {
+	value string
+	err   error
+	delay time.Duration
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (d *stubDriver) answer(retChan chan string, errChan chan error) {
+	d.mu.Lock()
+	d.calls++
+	d.mu.Unlock()
+
+	time.Sleep(d.delay)
+	if d.err != nil {
+		errChan <- d.err
+		return
+	}
+	retChan <- d.value
+}
+
+// count returns how many calls the driver got
+func (d *stubDriver) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+func (d *stubDriver) Get(key string, retChan chan string, errChan chan error) {
+	d.answer(retChan, errChan)
+}
+
+func (d *stubDriver) Set(key, value string, retChan chan string, errChan chan error) {
+	d.answer(retChan, errChan)
+}
+
+func (d *stubDriver) Delete(key string, retChan chan string, errChan chan error) {
+	d.answer(retChan, errChan)
+}
+
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		c    Consistency
+		n    int
+		want int
+	}{
+		{One, 1, 1},
+		{One, 3, 1},
+		{Quorum, 1, 1},
+		{Quorum, 2, 2},
+		{Quorum, 3, 2},
+		{Quorum, 4, 3},
+		{Quorum, 5, 3},
+		{All, 1, 1},
+		{All, 3, 3},
+	}
+
+	for _, test := range tests {
+		if got := test.c.required(test.n); got != test.want {
+			t.Errorf("%s of %d: got %d, want %d", test.c, test.n, got, test.want)
+		}
+	}
+}
+
+func TestMajority(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"a"}, "a"},
+		{[]string{"a", "b"}, "a"},
+		{[]string{"a", "b", "b"}, "b"},
+		{[]string{"b", "a", "a"}, "a"},
+		{[]string{"a", "b", "c", "c", "a"}, "c"},
+	}
+
+	for _, test := range tests {
+		if got := majority(test.values); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.values, got, test.want)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	boom := errors.New("boom")
+	ok := func(v string) *stubDriver { return &stubDriver{value: v} }
+	failing := func(err error) *stubDriver { return &stubDriver{err: err} }
+	slow := func(v string) *stubDriver { return &stubDriver{value: v, delay: 100 * time.Millisecond} }
+
+	tests := []struct {
+		name    string
+		policy  Consistency
+		drivers []*stubDriver
+		want    string
+		err     func(error) bool
+	}{
+		{"one of one", One, []*stubDriver{ok("v")}, "v", nil},
+		{"one with a failure", One, []*stubDriver{failing(boom), ok("v")}, "v", nil},
+		{"one, all failed", One, []*stubDriver{failing(boom), failing(boom)}, "", func(err error) bool { return errors.As(err, new(*MultiError)) }},
+		{"one, all missed", One, []*stubDriver{failing(ErrNotFound), failing(ErrNotFound)}, "", IsNotFound},
+		{"quorum of three", Quorum, []*stubDriver{ok("v"), ok("v"), failing(boom)}, "v", nil},
+		{"quorum lost", Quorum, []*stubDriver{ok("v"), failing(boom), failing(boom)}, "", func(err error) bool { return err != nil && !IsNotFound(err) }},
+		{"quorum disagreeing", Quorum, []*stubDriver{ok("a"), ok("b"), ok("b"), ok("b")}, "b", nil},
+		{"all", All, []*stubDriver{ok("v"), ok("v")}, "v", nil},
+		{"all with a failure", All, []*stubDriver{ok("v"), failing(boom)}, "", func(err error) bool { return err != nil }},
+		{"all, one too slow", All, []*stubDriver{ok("v"), slow("v")}, "", IsTimeout},
+		{"one, all unsupported", One, []*stubDriver{failing(ErrUnsupported)}, "", func(err error) bool { return errors.Is(err, ErrUnsupported) }},
+	}
+
+	for _, test := range tests {
+		opts := []Option{WithReadPolicy(test.policy), WithTimeout(50 * time.Millisecond)}
+		for _, drv := range test.drivers {
+			opts = append(opts, WithDriver(drv, WithRetry(OpGet, RetryPolicy{})))
+		}
+		gs := New(opts...)
+
+		got, err := gs.Get("k")
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != nil && !test.err(err):
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case got != test.want:
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFanOutNoDrivers(t *testing.T) {
+	if _, err := New().Get("k"); err != ErrNoDrivers {
+		t.Errorf("got %v, want ErrNoDrivers", err)
+	}
+}
+
+// batchDriver takes a batch of gets in one call
+type batchDriver struct {
+	stubDriver
+	values map[string]string
+
+	mu      sync.Mutex
+	batches int
+}
+
+func (d *batchDriver) GetMulti(keys []string) (map[string]string, map[string]error) {
+	d.mu.Lock()
+	d.batches++
+	d.mu.Unlock()
+
+	values := make(map[string]string)
+	for _, key := range keys {
+		if v, ok := d.values[key]; ok {
+			values[key] = v
+		}
+	}
+	return values, nil
+}
+
+func TestGetMultiBatches(t *testing.T) {
+	batched := &batchDriver{values: map[string]string{"a": "1", "b": "2"}}
+	single := &stubDriver{value: "1"}
+
+	tests := []struct {
+		name    string
+		policy  Consistency
+		drivers []Driver
+		want    map[string]string
+		missing []string
+	}{
+		{"batch only", One, []Driver{batched}, map[string]string{"a": "1", "b": "2"}, []string{"c"}},
+		{"with a per-key driver", All, []Driver{batched, single}, map[string]string{"a": "1"}, []string{"c"}},
+	}
+
+	for _, test := range tests {
+		batched.batches = 0
+
+		gs := New(WithDrivers(test.drivers...), WithReadPolicy(test.policy))
+		values, errs := gs.GetMultiWithTimeout([]string{"a", "b", "c", "a"}, time.Second)
+		// Calls the policy didn't wait for are done after this
+		gs.Shutdown(time.Second)
+
+		if batched.batches != 1 {
+			t.Errorf("%s: %d batches, want 1", test.name, batched.batches)
+		}
+		for key, want := range test.want {
+			if values[key] != want {
+				t.Errorf("%s: %s is %q, want %q", test.name, key, values[key], want)
+			}
+		}
+		for _, key := range test.missing {
+			if !IsNotFound(errs[key]) {
+				t.Errorf("%s: %s failed with %v, want not found", test.name, key, errs[key])
+			}
+		}
+	}
+
+	if single.count() != 3 {
+		t.Errorf("the per-key driver got %d calls, want 3", single.count())
+	}
+}
+
+// batchSetter takes a batch of sets in one call
+type batchSetter struct {
+	batchDriver
+}
+
+func (d *batchSetter) SetMulti(values map[string]string) map[string]error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.batches++
+	for key, value := range values {
+		d.values[key] = value
+	}
+	return nil
+}
+
+func TestBatchesThroughMiddleware(t *testing.T) {
+	drv := &batchSetter{batchDriver{values: map[string]string{}}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	gs := New(WithDriver(Chain(drv, PrefixKeys("p:"), LogCalls(logger))))
+
+	if errs := gs.SetMulti(map[string]string{"a": "1", "b": "2"}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(drv.values, map[string]string{"p:a": "1", "p:b": "2"}) {
+		t.Errorf("the driver has %v", drv.values)
+	}
+
+	values, errs := gs.GetMulti([]string{"a", "b", "c"})
+	if !reflect.DeepEqual(values, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("got %v", values)
+	}
+	if !IsNotFound(errs["c"]) {
+		t.Errorf("c failed with %v, want not found", errs["c"])
+	}
+	if drv.batches != 2 {
+		t.Errorf("%d batches, want 2", drv.batches)
+	}
+
+	// Wrapping doesn't make a per-key driver take batches
+	if _, ok := innermost(Chain(&stubDriver{}, PrefixKeys("p:"))).(BatchGetter); ok {
+		t.Error("a wrapped stubDriver takes batches")
+	}
+}
+
+func TestCoalescedGetOutlivesShortTimeout(t *testing.T) {
+	drv := &stubDriver{value: "v", delay: 50 * time.Millisecond}
+	gs := New(WithDriver(drv), WithTimeout(time.Second))
+
+	var wg sync.WaitGroup
+	var leaderErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, leaderErr = gs.GetWithTimeout("k", time.Millisecond)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	value, err := gs.GetWithTimeout("k", time.Second)
+	wg.Wait()
+
+	if !IsTimeout(leaderErr) {
+		t.Errorf("the short get ended with %v, want a timeout", leaderErr)
+	}
+	if err != nil || value != "v" {
+		t.Errorf("the long get got %q, %v", value, err)
+	}
+	if drv.count() != 1 {
+		t.Errorf("%d driver calls, want 1", drv.count())
+	}
+}
@@ -0,0 +1,93 @@
+package gostorm
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version is gostorm's version, set at build time with
+// -ldflags "-X github.com/wmgaca/gostorm.Version=v1.2.3"
+var Version = "dev"
+
+// statusResponse is the body of GET /status
+type statusResponse struct {
+	Version     string         `json:"version"`
+	GoVersion   string         `json:"go_version"`
+	Revision    string         `json:"revision,omitempty"`
+	Modified    bool           `json:"modified,omitempty"`
+	StartedAt   time.Time      `json:"started_at"`
+	UptimeS     float64        `json:"uptime_s"`
+	Ready       bool           `json:"ready"`
+	NotReady    string         `json:"not_ready,omitempty"`
+	ReadPolicy  string         `json:"read_policy"`
+	WritePolicy string         `json:"write_policy"`
+	TimeoutMS   float64        `json:"timeout_ms"`
+	Drivers     []driverStatus `json:"drivers"`
+}
+
+// revision is the VCS revision the binary was built from, if go build
+// recorded it
+func revision() (rev string, modified bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", false
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			rev = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return rev, modified
+}
+
+// healthzHandler says the process is up, for liveness probes
+func (srv *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler says whether enough drivers are healthy to meet the
+// consistency policies, for load balancers
+func (srv *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := srv.gs.Ready(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "not_ready", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// statusHandler says how gostorm and each of its drivers are doing, for
+// dashboards
+func (srv *server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	gs := srv.gs
+
+	resp := statusResponse{
+		Version:     Version,
+		GoVersion:   runtime.Version(),
+		StartedAt:   gs.started,
+		UptimeS:     gs.clock.Now().Sub(gs.started).Seconds(),
+		Ready:       true,
+		ReadPolicy:  gs.readPolicy.String(),
+		WritePolicy: gs.writePolicy.String(),
+		TimeoutMS:   ms(gs.timeout),
+		Drivers:     []driverStatus{},
+	}
+	resp.Revision, resp.Modified = revision()
+
+	if err := gs.Ready(); err != nil {
+		resp.Ready = false
+		resp.NotReady = err.Error()
+	}
+
+	for _, s := range gs.Drivers() {
+		resp.Drivers = append(resp.Drivers, toDriverStatus(s))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
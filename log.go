@@ -0,0 +1,96 @@
+package gostorm
+
+import (
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// RequestIDHeader identifies a request in logs, taken from the client or
+// made up, and sent back either way
+const RequestIDHeader = "X-Request-Id"
+
+// LogConfig says how NewLogger logs
+type LogConfig struct {
+	// Level is the lowest level logged, info by default
+	Level slog.Leveler
+
+	// Text logs key=value lines instead of JSON
+	Text bool
+
+	// HashKeys logs hashes of keys instead of the keys themselves
+	HashKeys bool
+}
+
+// ParseLogLevel reads "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// NewLogger returns a logger writing JSON lines to w. Attributes named
+// value, values, password, secret, token, authorization or cookie are
+// redacted whatever their case, and passwords in URLs and DSNs are cut out
+// of string and error attributes. Anything else goes out as it is, values
+// logged under other names or in messages included, so gostorm logs them
+// only under those names.
+func NewLogger(w io.Writer, cfg LogConfig) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level: cfg.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			return redact(a, cfg.HashKeys)
+		},
+	}
+
+	if cfg.Text {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// sensitive are the attributes always redacted
+var sensitive = map[string]bool{
+	"value":         true,
+	"values":        true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"authorization": true,
+	"cookie":        true,
+}
+
+// credentials matches the "user:password@" of URLs and DSNs like
+// "redis://:secret@host" and "user:secret@tcp(host)/db"
+var credentials = regexp.MustCompile(`([^\s:/@]*:)[^\s:/@]+@`)
+
+// RedactCredentials cuts passwords out of URLs and DSNs in s
+func RedactCredentials(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return credentials.ReplaceAllString(s, "${1}[redacted]@")
+}
+
+func redact(a slog.Attr, hashKeys bool) slog.Attr {
+	if sensitive[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[redacted]")
+	}
+
+	if a.Value.Kind() == slog.KindAny {
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactCredentials(err.Error()))
+		}
+	}
+
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+
+	if hashKeys && a.Key == "key" {
+		return slog.String(a.Key, keyHash(a.Value.String()))
+	}
+
+	return slog.String(a.Key, RedactCredentials(a.Value.String()))
+}
@@ -0,0 +1,42 @@
+package gostorm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestNewLoggerRedacts(t *testing.T) {
+	tests := []struct {
+		name     string
+		attr     slog.Attr
+		hashKeys bool
+		want     string
+	}{
+		{"value", slog.String("value", "v"), false, "[redacted]"},
+		{"any case", slog.String("Authorization", "Bearer x"), false, "[redacted]"},
+		{"not a string", slog.Int("values", 3), false, "[redacted]"},
+		{"url", slog.String("url", "redis://:secret@host:6379"), false, "redis://:[redacted]@host:6379"},
+		{"dsn", slog.String("dsn", "user:secret@tcp(host)/db"), false, "user:[redacted]@tcp(host)/db"},
+		{"error", slog.Any("err", errors.New("dial user:secret@host")), false, "dial user:[redacted]@host"},
+		{"key", slog.String("key", "k"), false, "k"},
+		{"hashed key", slog.String("key", "k"), true, keyHash("k")},
+		{"other names go out as they are", slog.String("current", "v"), false, "v"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		NewLogger(&buf, LogConfig{HashKeys: test.hashKeys}).LogAttrs(context.Background(), slog.LevelInfo, "msg", test.attr)
+
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := line[test.attr.Key]; got != test.want {
+			t.Errorf("%s: got %v, want %s", test.name, got, test.want)
+		}
+	}
+}
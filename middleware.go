@@ -0,0 +1,519 @@
+package gostorm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a Driver to add behaviour around its calls
+type Middleware func(Driver) Driver
+
+// Call is a single driver operation, as middleware sees it. For OpList,
+// Key holds the prefix. TTL is set for OpExpire and for an OpSet that
+// expires. A batch, for drivers that are BatchGetters or BatchSetters, has
+// Keys for an OpGet or Values for an OpSet instead of a Key.
+type Call struct {
+	Op     Op
+	Key    string
+	Value  string
+	TTL    time.Duration
+	Keys   []string
+	Values map[string]string
+}
+
+// Reply is what the driver returned for a Call: the Value of a get, the
+// Keys of a list or the TTL of a key. A batch gets the Values found and
+// the Errs of the keys that failed.
+type Reply struct {
+	Value  string
+	Keys   []string
+	TTL    time.Duration
+	Values map[string]string
+	Errs   map[string]error
+}
+
+// Handler runs a Call, returning what the driver returned
+type Handler func(Call) (Reply, error)
+
+// Chain wraps drv in mws, the first one ending up outermost
+func Chain(drv Driver, mws ...Middleware) Driver {
+	for i := len(mws) - 1; i >= 0; i-- {
+		drv = mws[i](drv)
+	}
+	return drv
+}
+
+// Wrap returns a Driver running every call to inner through around, which
+// calls next to pass the call on
+func Wrap(inner Driver, around func(c Call, next Handler) (Reply, error)) Driver {
+	return &wrapped{inner: inner, around: around}
+}
+
+// wrapped is the Driver Wrap returns
+type wrapped struct {
+	inner  Driver
+	around func(Call, Handler) (Reply, error)
+}
+
+// Name keeps the inner driver's name, so errors and metrics still make sense
+func (w *wrapped) Name() string {
+	return driverName(w.inner)
+}
+
+// Unwrap returns the driver the middleware is around
+func (w *wrapped) Unwrap() Driver {
+	return w.inner
+}
+
+// next hands the call over to the inner driver and waits for it
+func (w *wrapped) next(c Call) (Reply, error) {
+	retChan := make(chan string, 1)
+	errChan := make(chan error, 1)
+
+	expirer, canExpire := w.inner.(Expirer)
+
+	switch c.Op {
+	case OpTTL:
+		if !canExpire {
+			return Reply{}, ErrUnsupported
+		}
+
+		ttlChan := make(chan time.Duration, 1)
+		expirer.TTL(c.Key, ttlChan, errChan)
+
+		select {
+		case ttl := <-ttlChan:
+			return Reply{TTL: ttl}, nil
+		case err := <-errChan:
+			return Reply{}, err
+		}
+	case OpList:
+		lister, ok := w.inner.(Lister)
+		if !ok {
+			return Reply{}, ErrUnsupported
+		}
+
+		keysChan := make(chan []string, 1)
+		lister.List(c.Key, keysChan, errChan)
+
+		select {
+		case keys := <-keysChan:
+			return Reply{Keys: keys}, nil
+		case err := <-errChan:
+			return Reply{}, err
+		}
+	case OpGet:
+		if c.Keys != nil {
+			getter, ok := w.inner.(BatchGetter)
+			if !ok {
+				return Reply{}, ErrUnsupported
+			}
+			values, errs := getter.GetMulti(c.Keys)
+			return Reply{Values: values, Errs: errs}, nil
+		}
+		w.inner.Get(c.Key, retChan, errChan)
+	case OpSet:
+		if c.Values != nil {
+			setter, ok := w.inner.(BatchSetter)
+			if !ok {
+				return Reply{}, ErrUnsupported
+			}
+			return Reply{Errs: setter.SetMulti(c.Values)}, nil
+		}
+
+		if c.TTL == 0 {
+			w.inner.Set(c.Key, c.Value, retChan, errChan)
+		} else if canExpire {
+			expirer.SetWithTTL(c.Key, c.Value, c.TTL, retChan, errChan)
+		} else {
+			return Reply{}, ErrUnsupported
+		}
+	case OpExpire:
+		if !canExpire {
+			return Reply{}, ErrUnsupported
+		}
+		expirer.Expire(c.Key, c.TTL, retChan, errChan)
+	case OpDelete:
+		w.inner.Delete(c.Key, retChan, errChan)
+	default:
+		return Reply{}, fmt.Errorf("gostorm: unknown op %q", c.Op)
+	}
+
+	select {
+	case ret := <-retChan:
+		return Reply{Value: ret}, nil
+	case err := <-errChan:
+		return Reply{}, err
+	}
+}
+
+// run passes the call through around and reports back on the channels
+func (w *wrapped) run(c Call, retChan chan string, errChan chan error) {
+	reply, err := w.around(c, w.next)
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- reply.Value
+	}
+}
+
+func (w *wrapped) Get(key string, retChan chan string, errChan chan error) {
+	w.run(Call{Op: OpGet, Key: key}, retChan, errChan)
+}
+
+func (w *wrapped) Set(key, value string, retChan chan string, errChan chan error) {
+	w.run(Call{Op: OpSet, Key: key, Value: value}, retChan, errChan)
+}
+
+func (w *wrapped) Delete(key string, retChan chan string, errChan chan error) {
+	w.run(Call{Op: OpDelete, Key: key}, retChan, errChan)
+}
+
+func (w *wrapped) SetWithTTL(key, value string, ttl time.Duration, retChan chan string, errChan chan error) {
+	w.run(Call{Op: OpSet, Key: key, Value: value, TTL: ttl}, retChan, errChan)
+}
+
+func (w *wrapped) Expire(key string, ttl time.Duration, retChan chan string, errChan chan error) {
+	w.run(Call{Op: OpExpire, Key: key, TTL: ttl}, retChan, errChan)
+}
+
+// TTL fails with ErrUnsupported if the inner driver isn't an Expirer, and
+// so do SetWithTTL and Expire
+func (w *wrapped) TTL(key string, retChan chan time.Duration, errChan chan error) {
+	reply, err := w.around(Call{Op: OpTTL, Key: key}, w.next)
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- reply.TTL
+	}
+}
+
+// List passes the prefix in Call.Key, it fails with ErrUnsupported if the
+// inner driver isn't a Lister
+func (w *wrapped) List(prefix string, retChan chan []string, errChan chan error) {
+	reply, err := w.around(Call{Op: OpList, Key: prefix}, w.next)
+	if err != nil {
+		errChan <- err
+	} else {
+		retChan <- reply.Keys
+	}
+}
+
+// GetMulti passes the batch through as a single call, it fails every key
+// with ErrUnsupported if the inner driver isn't a BatchGetter
+func (w *wrapped) GetMulti(keys []string) (map[string]string, map[string]error) {
+	reply, err := w.around(Call{Op: OpGet, Keys: keys}, w.next)
+	if err != nil {
+		return nil, failAll(keys, err)
+	}
+	return reply.Values, reply.Errs
+}
+
+// SetMulti passes the batch through as a single call, it fails every key
+// with ErrUnsupported if the inner driver isn't a BatchSetter
+func (w *wrapped) SetMulti(values map[string]string) map[string]error {
+	reply, err := w.around(Call{Op: OpSet, Values: values}, w.next)
+	if err != nil {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		return failAll(keys, err)
+	}
+	return reply.Errs
+}
+
+// failAll returns err for every one of keys
+func failAll(keys []string, err error) map[string]error {
+	errs := make(map[string]error, len(keys))
+	for _, key := range keys {
+		errs[key] = err
+	}
+	return errs
+}
+
+// innermost returns the driver under any middleware around drv
+func innermost(drv Driver) Driver {
+	for {
+		w, ok := drv.(interface{ Unwrap() Driver })
+		if !ok {
+			return drv
+		}
+		drv = w.Unwrap()
+	}
+}
+
+// Close closes the inner driver if it's an io.Closer, so Shutdown still
+// gets to it through middleware
+func (w *wrapped) Close() error {
+	if c, ok := w.inner.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// LogCalls logs every call, never the values
+func LogCalls(logger *slog.Logger) Middleware {
+	return func(drv Driver) Driver {
+		name := driverName(drv)
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			start := time.Now()
+			reply, err := next(c)
+			logger.Info("driver call", "driver", name, "op", c.Op, "key", c.Key, "elapsed_ms", float64(time.Since(start))/float64(time.Millisecond), "err", err)
+			return reply, err
+		})
+	}
+}
+
+// MeasureCalls reports every call to metrics
+func MeasureCalls(metrics Metrics) Middleware {
+	return func(drv Driver) Driver {
+		name := driverName(drv)
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			start := time.Now()
+			reply, err := next(c)
+			metrics.ObserveDriver(name, c.Op, time.Since(start), err)
+			return reply, err
+		})
+	}
+}
+
+// TraceCalls wraps every call in a span. Calls don't carry their trace
+// through middleware, so these spans start traces of their own, WithTracer
+// puts driver calls in the request's trace.
+func TraceCalls(tracer Tracer) Middleware {
+	return func(drv Driver) Driver {
+		name := driverName(drv)
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			span := tracer.StartSpan(SpanContext{}, name+"."+string(c.Op), map[string]string{
+				"driver":   name,
+				"op":       string(c.Op),
+				"key.hash": keyHash(c.Key),
+			})
+			reply, err := next(c)
+			span.End(err)
+			return reply, err
+		})
+	}
+}
+
+// RetryCalls retries failed calls per policy. Unlike WithRetry, it doesn't
+// know about the request deadline, so keep its delays short.
+func RetryCalls(policy RetryPolicy) Middleware {
+	return func(drv Driver) Driver {
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			for attempt := 1; ; attempt++ {
+				reply, err := next(c)
+				if err == nil || !policy.shouldRetry(attempt, err) {
+					return reply, err
+				}
+				time.Sleep(policy.Backoff(attempt))
+			}
+		})
+	}
+}
+
+// TimeoutCalls gives up on calls that take longer than timeout
+func TimeoutCalls(timeout time.Duration) Middleware {
+	type result struct {
+		reply Reply
+		err   error
+	}
+
+	return func(drv Driver) Driver {
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			resChan := make(chan result, 1)
+			go func() {
+				reply, err := next(c)
+				resChan <- result{reply, err}
+			}()
+
+			select {
+			case res := <-resChan:
+				return res.reply, res.err
+			case <-time.After(timeout):
+				return Reply{}, ErrTimeout
+			}
+		})
+	}
+}
+
+// PrefixKeys puts prefix in front of every key, namespacing a shared store
+func PrefixKeys(prefix string) Middleware {
+	return func(drv Driver) Driver {
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			c.Key = prefix + c.Key
+
+			if c.Keys != nil {
+				keys := make([]string, len(c.Keys))
+				for i, key := range c.Keys {
+					keys[i] = prefix + key
+				}
+				c.Keys = keys
+			}
+			if c.Values != nil {
+				values := make(map[string]string, len(c.Values))
+				for key, value := range c.Values {
+					values[prefix+key] = value
+				}
+				c.Values = values
+			}
+
+			reply, err := next(c)
+
+			for i, key := range reply.Keys {
+				reply.Keys[i] = strings.TrimPrefix(key, prefix)
+			}
+			if reply.Values != nil {
+				values := make(map[string]string, len(reply.Values))
+				for key, value := range reply.Values {
+					values[strings.TrimPrefix(key, prefix)] = value
+				}
+				reply.Values = values
+			}
+			if reply.Errs != nil {
+				errs := make(map[string]error, len(reply.Errs))
+				for key, err := range reply.Errs {
+					errs[strings.TrimPrefix(key, prefix)] = err
+				}
+				reply.Errs = errs
+			}
+
+			return reply, err
+		})
+	}
+}
+
+// Faults describes what InjectFaults breaks
+type Faults struct {
+	// ErrorRate is the fraction of calls (0..1) failing with Err
+	ErrorRate float64
+
+	// Err is the injected error, ErrInjected if nil
+	Err error
+
+	// LatencyRate is the fraction of calls (0..1) delayed by Latency
+	LatencyRate float64
+	Latency     time.Duration
+}
+
+// ErrInjected is what InjectFaults fails calls with by default
+var ErrInjected = errors.New("gostorm: injected fault")
+
+// InjectFaults makes calls slow or failing on purpose, to see how the rest
+// of the system copes
+func InjectFaults(faults Faults) Middleware {
+	injected := faults.Err
+	if injected == nil {
+		injected = ErrInjected
+	}
+
+	return func(drv Driver) Driver {
+		return Wrap(drv, func(c Call, next Handler) (Reply, error) {
+			if faults.Latency > 0 && rand.Float64() < faults.LatencyRate {
+				time.Sleep(faults.Latency)
+			}
+			if rand.Float64() < faults.ErrorRate {
+				return Reply{}, injected
+			}
+			return next(c)
+		})
+	}
+}
+
+// ParseMiddleware builds a chain from a spec like
+// "log|timeout=20ms|prefix=app:|retry=attempts=3,base=5ms|faults=error=0.01,latency=100ms,latencyrate=0.1"
+// Middleware needing more than the spec gives gets logger, metrics and tracer,
+// a nil metrics or tracer makes "metrics" or "trace" an error.
+func ParseMiddleware(spec string, logger *slog.Logger, metrics Metrics, tracer Tracer) ([]Middleware, error) {
+	var mws []Middleware
+
+	for _, field := range strings.Split(spec, "|") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		name, arg := field, ""
+		if i := strings.Index(field, "="); i >= 0 {
+			name, arg = field[:i], field[i+1:]
+		}
+
+		switch name {
+		case "log":
+			mws = append(mws, LogCalls(logger))
+		case "metrics":
+			if metrics == nil {
+				return nil, errors.New("middleware: no metrics configured")
+			}
+			mws = append(mws, MeasureCalls(metrics))
+		case "trace":
+			if tracer == nil {
+				return nil, errors.New("middleware: no tracer configured")
+			}
+			mws = append(mws, TraceCalls(tracer))
+		case "retry":
+			policy, err := ParseRetryPolicy(arg)
+			if err != nil {
+				return nil, err
+			}
+			mws = append(mws, RetryCalls(policy))
+		case "timeout":
+			timeout, err := time.ParseDuration(arg)
+			if err != nil {
+				return nil, fmt.Errorf("middleware: %s", err)
+			}
+			mws = append(mws, TimeoutCalls(timeout))
+		case "prefix":
+			mws = append(mws, PrefixKeys(arg))
+		case "faults":
+			faults, err := parseFaults(arg)
+			if err != nil {
+				return nil, err
+			}
+			mws = append(mws, InjectFaults(faults))
+		default:
+			return nil, fmt.Errorf("middleware: unknown middleware %q", name)
+		}
+	}
+
+	return mws, nil
+}
+
+// parseFaults reads "error=0.01,latency=100ms,latencyrate=0.1"
+func parseFaults(spec string) (Faults, error) {
+	faults := Faults{}
+
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return faults, fmt.Errorf("faults: bad field %q", field)
+		}
+
+		var err error
+		switch kv[0] {
+		case "error":
+			_, err = fmt.Sscan(kv[1], &faults.ErrorRate)
+		case "latency":
+			faults.Latency, err = time.ParseDuration(kv[1])
+			if faults.LatencyRate == 0 {
+				faults.LatencyRate = 1
+			}
+		case "latencyrate":
+			_, err = fmt.Sscan(kv[1], &faults.LatencyRate)
+		default:
+			err = fmt.Errorf("unknown field %q", kv[0])
+		}
+
+		if err != nil {
+			return faults, fmt.Errorf("faults: %s", err)
+		}
+	}
+
+	return faults, nil
+}
@@ -0,0 +1,217 @@
+package gostorm
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Option configures a Gostorm, pass them to New
+type Option func(*Gostorm)
+
+// DriverOption configures how Gostorm calls a single driver
+type DriverOption func(*backend)
+
+// Metrics gets told about every driver call
+type Metrics interface {
+	// ObserveDriver is called once per driver call
+	ObserveDriver(driver string, op Op, elapsed time.Duration, err error)
+
+	// Coalesced is called when a call piggybacked on an identical one
+	// already in flight instead of fanning out on its own
+	Coalesced(op Op)
+}
+
+// ReadMetrics is Metrics that also want to know which driver a read went
+// with: the first one to answer successfully
+type ReadMetrics interface {
+	ReadWon(driver string, op Op)
+}
+
+// HTTPMetrics is Metrics that also want to know about HTTP requests,
+// NewHandler reports every request with the route it matched
+type HTTPMetrics interface {
+	ObserveHTTP(route, method string, status int, elapsed time.Duration)
+}
+
+// Clock tells the time, swap it out to control time in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Consistency is how many drivers must succeed for an operation to succeed
+type Consistency int
+
+// Consistency levels
+const (
+	// One is happy with the first driver to succeed
+	One Consistency = iota
+
+	// Quorum waits for a majority of drivers
+	Quorum
+
+	// All waits for every driver
+	All
+)
+
+// required returns how many of n drivers have to succeed
+func (c Consistency) required(n int) int {
+	switch c {
+	case Quorum:
+		return n/2 + 1
+	case All:
+		return n
+	}
+	return 1
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case Quorum:
+		return "quorum"
+	case All:
+		return "all"
+	}
+	return "one"
+}
+
+// ParseConsistency reads "one", "quorum" or "all"
+func ParseConsistency(s string) (Consistency, error) {
+	for _, c := range []Consistency{One, Quorum, All} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return One, fmt.Errorf("gostorm: unknown consistency %q", s)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveDriver(string, Op, time.Duration, error) {}
+func (nopMetrics) Coalesced(Op)                                   {}
+
+// WithDriver adds a driver, configured by opts
+func WithDriver(drv Driver, opts ...DriverOption) Option {
+	return func(gs *Gostorm) {
+		b := &backend{driver: drv, retry: make(map[Op]RetryPolicy)}
+		for _, op := range []Op{OpGet, OpSet, OpDelete, OpList, OpExpire, OpTTL} {
+			b.retry[op] = DefaultRetryPolicy
+		}
+		b.status = DriverStatus{
+			Index:        len(gs.drivers),
+			Name:         driverName(drv),
+			State:        DriverActive,
+			Capabilities: capabilities(drv),
+		}
+		for _, opt := range opts {
+			opt(b)
+		}
+		gs.drivers = append(gs.drivers, b)
+	}
+}
+
+// WithDrivers adds drivers with default settings
+func WithDrivers(drivers ...Driver) Option {
+	return func(gs *Gostorm) {
+		for _, drv := range drivers {
+			WithDriver(drv)(gs)
+		}
+	}
+}
+
+// WithRetry sets how failed op calls to the driver are retried,
+// DefaultRetryPolicy otherwise. RetryPolicy{} turns retries off.
+func WithRetry(op Op, policy RetryPolicy) DriverOption {
+	return func(b *backend) {
+		b.retry[op] = policy
+	}
+}
+
+// WithDriverTimeout caps the time the driver gets to answer a single
+// request, retries included. Zero means it may use the whole budget.
+func WithDriverTimeout(timeout time.Duration) DriverOption {
+	return func(b *backend) {
+		b.timeout = timeout
+	}
+}
+
+// WithTimeout sets the overall budget for Get, Set and Delete
+func WithTimeout(timeout time.Duration) Option {
+	return func(gs *Gostorm) {
+		gs.timeout = timeout
+	}
+}
+
+// WithReadPolicy sets how many drivers must answer a Get
+func WithReadPolicy(c Consistency) Option {
+	return func(gs *Gostorm) {
+		gs.readPolicy = c
+	}
+}
+
+// WithWritePolicy sets how many drivers must ack a Set or Delete
+func WithWritePolicy(c Consistency) Option {
+	return func(gs *Gostorm) {
+		gs.writePolicy = c
+	}
+}
+
+// WithLogger sets where Gostorm logs to, a NewLogger on stderr by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(gs *Gostorm) {
+		gs.logger = logger
+	}
+}
+
+// WithDebug makes the default logger log at debug level, every driver
+// outcome included. Loggers set with WithLogger have their own level.
+func WithDebug(debug bool) Option {
+	return func(gs *Gostorm) {
+		gs.debug = debug
+	}
+}
+
+// WithMetrics sets what driver calls get reported to
+func WithMetrics(metrics Metrics) Option {
+	return func(gs *Gostorm) {
+		gs.metrics = metrics
+	}
+}
+
+// WithTracer sets what starts the spans of operations and driver calls
+func WithTracer(tracer Tracer) Option {
+	return func(gs *Gostorm) {
+		gs.tracer = tracer
+	}
+}
+
+// WithCoalescing turns sharing a fan-out between concurrent Gets of the
+// same key on or off, it's on by default
+func WithCoalescing(coalesce bool) Option {
+	return func(gs *Gostorm) {
+		gs.coalesce = coalesce
+	}
+}
+
+// WithClock sets the clock used for timeouts and backoff
+func WithClock(clock Clock) Option {
+	return func(gs *Gostorm) {
+		gs.clock = clock
+	}
+}
+
+// defaultLogger is used unless WithLogger says otherwise
+func defaultLogger(debug bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	return NewLogger(os.Stderr, LogConfig{Level: level})
+}
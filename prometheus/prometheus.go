@@ -0,0 +1,321 @@
+// Package prometheus collects what a Gostorm does and serves it in the
+// Prometheus text format:
+//
+//	reg := prometheus.NewRegistry()
+//	gs := gostorm.New(gostorm.WithMetrics(reg), ...)
+//	http.Handle("/metrics", reg.Handler(gs))
+//
+// Driver calls, read wins and coalesced calls are counted as they happen,
+// driver states and calls in flight are read off the Gostorm when scraped.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+// Buckets are the upper bounds of the latency histograms, in seconds
+var Buckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations per bucket, not cumulatively, the last
+// count being +Inf
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(Buckets)+1)
+	}
+
+	i := sort.SearchFloat64s(Buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// series are keyed by their rendered labels, e.g. `driver="mem",op="get"`
+type (
+	counters   map[string]float64
+	histograms map[string]*histogram
+)
+
+// Registry is a gostorm.Metrics, gostorm.ReadMetrics and
+// gostorm.HTTPMetrics. It's safe for concurrent use.
+type Registry struct {
+	mu sync.Mutex
+
+	driverCalls   counters
+	driverErrors  counters
+	driverLatency histograms
+	readWins      counters
+	coalesced     counters
+	httpRequests  counters
+	httpLatency   histograms
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		driverCalls:   make(counters),
+		driverErrors:  make(counters),
+		driverLatency: make(histograms),
+		readWins:      make(counters),
+		coalesced:     make(counters),
+		httpRequests:  make(counters),
+		httpLatency:   make(histograms),
+	}
+}
+
+// labels renders label pairs, given as name, value, name, value...
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escape(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+// ObserveDriver counts a driver call and its error, if any
+func (reg *Registry) ObserveDriver(driver string, op gostorm.Op, elapsed time.Duration, err error) {
+	key := labels("driver", driver, "op", string(op))
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.driverCalls[key]++
+	if err != nil {
+		reg.driverErrors[labels("driver", driver, "op", string(op), "class", gostorm.ErrorClass(err))]++
+	}
+
+	h, ok := reg.driverLatency[key]
+	if !ok {
+		h = &histogram{}
+		reg.driverLatency[key] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// Coalesced counts a call that piggybacked on another
+func (reg *Registry) Coalesced(op gostorm.Op) {
+	reg.mu.Lock()
+	reg.coalesced[labels("op", string(op))]++
+	reg.mu.Unlock()
+}
+
+// ReadWon counts a read answered by driver
+func (reg *Registry) ReadWon(driver string, op gostorm.Op) {
+	reg.mu.Lock()
+	reg.readWins[labels("driver", driver, "op", string(op))]++
+	reg.mu.Unlock()
+}
+
+// ObserveHTTP counts an HTTP request
+func (reg *Registry) ObserveHTTP(route, method string, status int, elapsed time.Duration) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.httpRequests[labels("route", route, "method", method, "code", strconv.Itoa(status))]++
+
+	key := labels("route", route, "method", method)
+	h, ok := reg.httpLatency[key]
+	if !ok {
+		h = &histogram{}
+		reg.httpLatency[key] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// Handler serves everything collected so far, along with the state of gs's
+// drivers, gs may be nil
+func (reg *Registry) Handler(gs *gostorm.Gostorm) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.Write(w, gs)
+	})
+}
+
+// Write writes everything in the text format
+func (reg *Registry) Write(w io.Writer, gs *gostorm.Gostorm) error {
+	out := bufio.NewWriter(w)
+
+	reg.mu.Lock()
+	writeCounters(out, "gostorm_driver_calls_total", "Driver calls, retries included.", reg.driverCalls)
+	writeCounters(out, "gostorm_driver_errors_total", "Driver calls that returned an error, misses included, by class: timeout, not_found, unsupported, transient or other.", reg.driverErrors)
+	writeHistograms(out, "gostorm_driver_call_duration_seconds", "How long driver calls took.", reg.driverLatency)
+	writeCounters(out, "gostorm_read_wins_total", "Reads answered with a driver's value, the first driver to answer wins.", reg.readWins)
+	writeCounters(out, "gostorm_coalesced_total", "Calls that piggybacked on an identical one in flight.", reg.coalesced)
+	writeCounters(out, "gostorm_http_requests_total", "HTTP requests by route, method and status code.", reg.httpRequests)
+	writeHistograms(out, "gostorm_http_request_duration_seconds", "How long HTTP requests took.", reg.httpLatency)
+	reg.mu.Unlock()
+
+	if gs != nil {
+		writeDrivers(out, gs.Drivers())
+		writeTenants(out, gs.Tenants())
+	}
+
+	header(out, "go_goroutines", "gauge", "Goroutines that currently exist.")
+	sample(out, "go_goroutines", "", float64(runtime.NumGoroutine()))
+
+	return out.Flush()
+}
+
+func writeDrivers(w io.Writer, drivers []gostorm.DriverStatus) {
+	states := []gostorm.DriverState{gostorm.DriverActive, gostorm.DriverWriteOnly, gostorm.DriverDisabled}
+
+	header(w, "gostorm_driver_state", "gauge", "1 for the state each driver is in, 0 for the others.")
+	for _, d := range drivers {
+		for _, state := range states {
+			value := 0.0
+			if d.State == state {
+				value = 1
+			}
+			sample(w, "gostorm_driver_state", labels("index", strconv.Itoa(d.Index), "driver", d.Name, "state", string(state)), value)
+		}
+	}
+
+	gauges := []struct {
+		name, help string
+		value      func(gostorm.DriverStatus) float64
+	}{
+		{"gostorm_driver_healthy", "1 if the driver's last call went fine.", func(d gostorm.DriverStatus) float64 {
+			if d.Healthy() {
+				return 1
+			}
+			return 0
+		}},
+		{"gostorm_driver_consecutive_errors", "Driver calls failed in a row.", func(d gostorm.DriverStatus) float64 {
+			return float64(d.ConsecutiveErrors)
+		}},
+		{"gostorm_driver_in_flight", "Driver calls not answered yet, abandoned ones included.", func(d gostorm.DriverStatus) float64 {
+			return float64(d.InFlight)
+		}},
+	}
+
+	for _, g := range gauges {
+		header(w, g.name, "gauge", g.help)
+		for _, d := range drivers {
+			sample(w, g.name, labels("index", strconv.Itoa(d.Index), "driver", d.Name), g.value(d))
+		}
+	}
+}
+
+func writeTenants(w io.Writer, tenants []gostorm.TenantStatus) {
+	if len(tenants) == 0 {
+		return
+	}
+
+	metrics := []struct {
+		name, typ, help string
+		value           func(gostorm.TenantStatus) float64
+	}{
+		{"gostorm_tenant_keys", "gauge", "Keys the tenant has, as counted by this instance.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.Keys)
+		}},
+		{"gostorm_tenant_bytes", "gauge", "Bytes of keys and values the tenant stores, as counted by this instance.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.Bytes)
+		}},
+		{"gostorm_tenant_max_keys", "gauge", "The tenant's key quota, 0 for none.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.Quota.MaxKeys)
+		}},
+		{"gostorm_tenant_max_bytes", "gauge", "The tenant's byte quota, 0 for none.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.Quota.MaxBytes)
+		}},
+		{"gostorm_tenant_requests_total", "counter", "HTTP requests made for the tenant.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.Requests)
+		}},
+		{"gostorm_tenant_throttled_total", "counter", "HTTP requests turned down for the tenant's rate.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.Throttled)
+		}},
+		{"gostorm_tenant_over_quota_total", "counter", "Writes turned down for the tenant's key or byte quota.", func(t gostorm.TenantStatus) float64 {
+			return float64(t.OverQuota)
+		}},
+	}
+
+	for _, m := range metrics {
+		header(w, m.name, m.typ, m.help)
+		for _, t := range tenants {
+			sample(w, m.name, labels("tenant", t.Name), m.value(t))
+		}
+	}
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w io.Writer, name, labels string, value float64) {
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(value))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeCounters(w io.Writer, name, help string, c counters) {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	header(w, name, "counter", help)
+	for _, key := range keys {
+		sample(w, name, key, c[key])
+	}
+}
+
+func writeHistograms(w io.Writer, name, help string, hs histograms) {
+	keys := make([]string, 0, len(hs))
+	for key := range hs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	header(w, name, "histogram", help)
+	for _, key := range keys {
+		h := hs[key]
+
+		prefix := key
+		if len(prefix) > 0 {
+			prefix += ","
+		}
+
+		var cumulative uint64
+		for i, bound := range Buckets {
+			cumulative += h.counts[i]
+			sample(w, name+"_bucket", prefix+labels("le", formatFloat(bound)), float64(cumulative))
+		}
+		sample(w, name+"_bucket", prefix+`le="+Inf"`, float64(h.count))
+		sample(w, name+"_sum", key, h.sum)
+		sample(w, name+"_count", key, float64(h.count))
+	}
+}
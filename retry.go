@@ -0,0 +1,170 @@
+package gostorm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Op names a Gostorm operation, so policies can differ between reads and writes
+type Op string
+
+// Operations Gostorm fans out to its drivers
+const (
+	OpGet    Op = "get"
+	OpSet    Op = "set"
+	OpDelete Op = "delete"
+	OpList   Op = "list"
+	OpExpire Op = "expire"
+	OpTTL    Op = "ttl"
+)
+
+// RetryPolicy describes how a failed driver call is retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of calls, the first one included.
+	// Zero or one means no retries at all.
+	MaxAttempts int
+
+	// BaseDelay is the wait before the first retry, doubled on every
+	// following attempt.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the backoff, zero means no cap.
+	MaxDelay time.Duration
+
+	// Jitter randomizes each delay by up to this fraction of it (0..1).
+	Jitter float64
+
+	// Retryable picks the errors worth another attempt, IsTransient if nil.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is a sane policy for network-backed drivers, and what
+// every driver gets unless told otherwise with WithRetry
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    time.Second,
+	Jitter:      0.2,
+}
+
+// shouldRetry tells whether attempt number attempt, which failed with err,
+// deserves another go. Every Op is safe to repeat, sets and expires
+// landing twice leave the key as landing once does.
+func (p RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+
+	return retryable(err)
+}
+
+// Backoff returns how long to wait after attempt number attempt failed
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 && delay > 0 {
+		spread := float64(delay) * p.Jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+
+	return delay
+}
+
+// IsTransient tells whether err looks like a hiccup that may go away on retry:
+// dropped connections, network timeouts and the like
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	// Errors from net/http and friends come wrapped, so dig
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno == syscall.ECONNRESET || errno == syscall.ECONNREFUSED || errno == syscall.EPIPE
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	return false
+}
+
+// ParseRetryPolicy reads a policy from a spec like
+// "attempts=3,base=10ms,max=1s,jitter=0.2"
+func ParseRetryPolicy(spec string) (RetryPolicy, error) {
+	policy := RetryPolicy{}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return policy, fmt.Errorf("retry: bad field %q", field)
+		}
+
+		var err error
+		switch kv[0] {
+		case "attempts":
+			policy.MaxAttempts, err = strconv.Atoi(kv[1])
+		case "base":
+			policy.BaseDelay, err = time.ParseDuration(kv[1])
+		case "max":
+			policy.MaxDelay, err = time.ParseDuration(kv[1])
+		case "jitter":
+			policy.Jitter, err = strconv.ParseFloat(kv[1], 64)
+		default:
+			err = fmt.Errorf("unknown field %q", kv[0])
+		}
+
+		if err != nil {
+			return policy, fmt.Errorf("retry: %s", err)
+		}
+	}
+
+	switch {
+	case policy.MaxAttempts < 0:
+		return policy, fmt.Errorf("retry: attempts can't be negative")
+	case policy.BaseDelay < 0 || policy.MaxDelay < 0:
+		return policy, fmt.Errorf("retry: delays can't be negative")
+	case policy.Jitter < 0 || policy.Jitter > 1:
+		return policy, fmt.Errorf("retry: jitter must be between 0 and 1")
+	}
+
+	return policy, nil
+}
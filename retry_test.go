@@ -0,0 +1,138 @@
+package gostorm
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryPolicy(t *testing.T) {
+	tests := []struct {
+		spec string
+		want RetryPolicy
+		err  bool
+	}{
+		{"", RetryPolicy{}, false},
+		{"attempts=3, base=10ms,max=1s,jitter=0.2", RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.2}, false},
+		{"jitter=0", RetryPolicy{}, false},
+		{"jitter=1", RetryPolicy{Jitter: 1}, false},
+		{"attempts=-1", RetryPolicy{}, true},
+		{"jitter=-0.1", RetryPolicy{}, true},
+		{"jitter=1.5", RetryPolicy{}, true},
+		{"base=-1s", RetryPolicy{}, true},
+		{"max=-1s", RetryPolicy{}, true},
+		{"attempts=three", RetryPolicy{}, true},
+		{"attempts", RetryPolicy{}, true},
+		{"tries=3", RetryPolicy{}, true},
+		{"nonidempotent=true", RetryPolicy{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseRetryPolicy(test.spec)
+		if (err != nil) != test.err {
+			t.Errorf("%q: err %v, want error %v", test.spec, err, test.err)
+			continue
+		}
+		if !test.err && (got.MaxAttempts != test.want.MaxAttempts || got.BaseDelay != test.want.BaseDelay ||
+			got.MaxDelay != test.want.MaxDelay || got.Jitter != test.want.Jitter) {
+			t.Errorf("%q: got %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+
+	for attempt, want := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	} {
+		if got := p.Backoff(attempt); got != want {
+			t.Errorf("attempt %d: got %s, want %s", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(1); got < 5*time.Millisecond || got > 15*time.Millisecond {
+			t.Fatalf("jittered backoff %s out of 5ms..15ms", got)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3}
+
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		err     error
+		want    bool
+	}{
+		{"transient", p, 1, io.EOF, true},
+		{"last attempt", p, 3, io.EOF, false},
+		{"not transient", p, 1, errors.New("boom"), false},
+		{"miss", p, 1, ErrNotFound, false},
+		{"no retries", RetryPolicy{}, 1, io.EOF, false},
+		{"own retryable", RetryPolicy{MaxAttempts: 3, Retryable: func(error) bool { return true }}, 1, errors.New("boom"), true},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.shouldRetry(test.attempt, test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// flakyDriver fails the first gets with io.EOF
+type flakyDriver struct {
+	plainDriver
+
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (d *flakyDriver) Get(key string, retChan chan string, errChan chan error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls++
+	if d.calls <= d.failures {
+		errChan <- io.EOF
+		return
+	}
+	retChan <- "v"
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []DriverOption
+		calls  int
+		failed bool
+	}{
+		{"default", nil, 2, false},
+		{"turned off", []DriverOption{WithRetry(OpGet, RetryPolicy{})}, 1, true},
+	}
+
+	for _, test := range tests {
+		drv := &flakyDriver{failures: 1}
+		gs := New(WithDriver(drv, test.opts...))
+
+		_, err := gs.GetWithTimeout("k", time.Second)
+		gs.Shutdown(time.Second)
+		if (err != nil) != test.failed {
+			t.Errorf("%s: err %v", test.name, err)
+		}
+		if drv.calls != test.calls {
+			t.Errorf("%s: %d calls, want %d", test.name, drv.calls, test.calls)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package gostorm
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// TimeoutHeader lets clients shrink the request budget
+const TimeoutHeader = "X-Request-Timeout"
+
+// server serves a Gostorm over HTTP
+type server struct {
+	gs *Gostorm
+}
+
+// NewHandler returns an http.Handler serving gs over HTTP, ready to be
+// mounted in any router
+func NewHandler(gs *Gostorm) http.Handler {
+	srv := &server{gs: gs}
+
+	router := mux.NewRouter()
+
+	router.HandleFunc("/", srv.instrument("/", srv.homeHandler)).Methods("GET")
+	router.HandleFunc("/get/{key:[a-zA-Z0-9:.]+}/", srv.instrument("/get/{key}/", srv.getHandler)).Methods("GET")
+	router.HandleFunc("/set/", srv.instrument("/set/", srv.setHandler)).Methods("POST")
+
+	router.HandleFunc("/healthz", srv.instrument("/healthz", srv.healthzHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", srv.instrument("/readyz", srv.readyzHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/status", srv.instrument("/status", srv.statusHandler)).Methods("GET")
+
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/keys/{key:.+}", srv.instrument("/v1/keys/{key}", srv.getKeyHandler)).Methods("GET", "HEAD")
+	v1.HandleFunc("/keys/{key:.+}", srv.instrument("/v1/keys/{key}", srv.putKeyHandler)).Methods("PUT")
+	v1.HandleFunc("/keys/{key:.+}", srv.instrument("/v1/keys/{key}", srv.deleteKeyHandler)).Methods("DELETE")
+	v1.HandleFunc("/keys", srv.instrument("/v1/keys", srv.listKeysHandler)).Methods("GET")
+	v1.HandleFunc("/mget", srv.instrument("/v1/mget", srv.mgetHandler)).Methods("POST")
+	v1.HandleFunc("/mset", srv.instrument("/v1/mset", srv.msetHandler)).Methods("POST")
+	v1.HandleFunc("/ttl/{key:.+}", srv.instrument("/v1/ttl/{key}", srv.getTTLHandler)).Methods("GET")
+	v1.HandleFunc("/ttl/{key:.+}", srv.instrument("/v1/ttl/{key}", srv.putTTLHandler)).Methods("PUT")
+	v1.HandleFunc("/inspect/{key:.+}", srv.instrument("/v1/inspect/{key}", srv.inspectHandler)).Methods("GET")
+	v1.HandleFunc("/drivers", srv.instrument("/v1/drivers", srv.driversHandler)).Methods("GET")
+	v1.HandleFunc("/drivers/{index:[0-9]+}", srv.instrument("/v1/drivers/{index}", srv.putDriverHandler)).Methods("PUT")
+	v1.HandleFunc("/tenants", srv.instrument("/v1/tenants", srv.tenantsHandler)).Methods("GET")
+
+	router.NotFoundHandler = srv.instrument("unmatched", http.NotFound)
+
+	return router
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers, like gRPC's, through
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// originKey is where instrument puts the request's origin, next to mux's
+// vars
+type originKey struct{}
+
+// originOf returns the trace and ID of the request r is
+func originOf(r *http.Request) origin {
+	o, _ := context.Get(r, originKey{}).(origin)
+	return o
+}
+
+// log returns a logger saying which request, and tenant, it's about
+func (srv *server) log(r *http.Request) *slog.Logger {
+	o := originOf(r)
+
+	log := srv.gs.logger
+	if len(o.requestID) > 0 {
+		log = log.With("request_id", o.requestID)
+	}
+	if o.tenant != nil {
+		log = log.With("tenant", o.tenant.Name)
+	}
+	return log
+}
+
+// requestID returns the ID the client gave the request, if it's sane, or
+// a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if len(id) > 0 && len(id) <= 64 && isPrintable(id) {
+		return id
+	}
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], rand.Uint64())
+	return hex.EncodeToString(b[:])
+}
+
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// instrument is trace for the API's routes, turning requests for unknown
+// or throttled tenants away
+func (srv *server) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return srv.trace(route, func(w http.ResponseWriter, r *http.Request) {
+		err, _ := context.Get(r, admissionKey{}).(error)
+
+		switch {
+		case errors.Is(err, ErrThrottled):
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "throttled", err)
+		case err != nil:
+			writeError(w, http.StatusBadRequest, "unknown_tenant", err)
+		default:
+			h(w, r)
+		}
+	})
+}
+
+// admissionKey is where trace puts why the request's tenant can't have it,
+// if it can't
+type admissionKey struct{}
+
+// trace traces requests to h, picking up the caller's traceparent, tags
+// them with a request ID, logs them and reports them to the Gostorm's
+// metrics if they're HTTPMetrics. They go by route so keys don't end up in
+// labels. It works out the tenant of requests, see TenantHeader, and holds
+// them to its rate, leaving it to h to turn them away.
+func (srv *server) trace(route string, h http.HandlerFunc) http.HandlerFunc {
+	m, _ := srv.gs.metrics.(HTTPMetrics)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		parent, _ := ParseTraceparent(r.Header.Get(TraceparentHeader))
+		span := srv.gs.tracer.StartSpan(parent, r.Method+" "+route, map[string]string{
+			"http.method": r.Method,
+			"http.route":  route,
+		})
+
+		id := requestID(r)
+		w.Header().Set(RequestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+
+		t, refused := srv.gs.tenant(r.Header.Get(TenantHeader))
+		if refused == nil && !t.allow(srv.gs.clock.Now()) {
+			refused = ErrThrottled
+		}
+		context.Set(r, originKey{}, origin{span: span.Context(), requestID: id, tenant: t})
+		context.Set(r, admissionKey{}, refused)
+
+		h(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		var err error
+		if rec.status >= 500 {
+			err = errors.New(http.StatusText(rec.status))
+		}
+		span.SetAttr("http.status_code", strconv.Itoa(rec.status))
+		span.SetAttr("request_id", id)
+		span.End(err)
+
+		srv.log(r).Info("request", "method", r.Method, "route", route, "status", rec.status, "elapsed_ms", float64(time.Since(start))/float64(time.Millisecond))
+
+		if m != nil {
+			m.ObserveHTTP(route, r.Method, rec.status, time.Since(start))
+		}
+	}
+}
+
+// Instrument serves h, mounted next to NewHandler's routes, the way they
+// are: traced, logged and measured as route, and with the tenant worked
+// out and held to its rate. h runs operations for the request through
+// CallerFor, which turns it away if its tenant can't have it.
+func Instrument(gs *Gostorm, route string, h http.Handler) http.Handler {
+	srv := &server{gs: gs}
+	traced := srv.trace(route, h.ServeHTTP)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer context.Clear(r)
+		traced(w, r)
+	})
+}
+
+// timeout returns the budget a client asked for in the timeout header, as
+// a Go duration ("250ms") or plain milliseconds ("250"). It never exceeds
+// the Gostorm's own timeout, which is also the default.
+func (srv *server) timeout(r *http.Request) time.Duration {
+	max := srv.gs.Timeout()
+
+	header := r.Header.Get(TimeoutHeader)
+	if len(header) == 0 {
+		return max
+	}
+
+	timeout, err := time.ParseDuration(header)
+	if err != nil {
+		ms, err := strconv.Atoi(header)
+		if err != nil {
+			srv.log(r).Warn("ignoring bad timeout header", "header", header)
+			return max
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	if timeout <= 0 || timeout > max {
+		return max
+	}
+
+	return timeout
+}
+
+func (srv *server) homeHandler(w http.ResponseWriter, r *http.Request) {
+	ret := "Go, baby, go!"
+	srv.log(r).Debug("home")
+	fmt.Fprintf(w, "%s\n", ret)
+}
+
+func (srv *server) getHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	ret, err := srv.gs.get(originOf(r), key, srv.timeout(r))
+	if err != nil {
+		ret = err.Error()
+	}
+
+	srv.log(r).Debug("get", "key", key, "err", err)
+
+	fmt.Fprintf(w, "%s\n", ret)
+}
+
+func (srv *server) setHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+
+	key := "?"
+	value := "?"
+	ret := "?"
+
+	if err != nil {
+		ret = err.Error()
+	} else {
+		if len(r.PostForm["key"]) == 0 || len(r.PostForm["value"]) == 0 {
+			ret = "Missing key or value?"
+		} else {
+
+			key = r.PostForm["key"][0]
+			value = r.PostForm["value"][0]
+
+			ret = "SUCCESS"
+			err = srv.gs.set(originOf(r), key, value, srv.timeout(r))
+			if err != nil {
+				ret = err.Error()
+			}
+		}
+	}
+
+	srv.log(r).Debug("set", "key", key, "result", ret)
+
+	fmt.Fprintf(w, "%s\n", ret)
+}
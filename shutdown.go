@@ -0,0 +1,75 @@
+package gostorm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// enter counts n goroutines in as pending, unless Shutdown was called
+func (gs *Gostorm) enter(n int) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.shuttingDown {
+		return ErrShutdown
+	}
+	gs.pending.Add(n)
+	return nil
+}
+
+// StopWatchers stops every watcher, C is closed with Err ErrShutdown. Hook
+// it up with http.Server.RegisterOnShutdown so watch streams don't hold up
+// the server's Shutdown.
+func (gs *Gostorm) StopWatchers() {
+	gs.watches.stopAll(ErrShutdown)
+}
+
+// Shutdown stops taking operations, they fail with ErrShutdown and Ready
+// says so, then waits up to timeout for the ones in progress, writes still
+// replicating to drivers the policy didn't wait for included. It closes
+// the tracer and the drivers afterwards if they're io.Closers, gostorm
+// owns what it's given. Stop whatever serves the Gostorm first, so the
+// requests it's serving get to finish.
+func (gs *Gostorm) Shutdown(timeout time.Duration) error {
+	gs.mu.Lock()
+	if gs.shuttingDown {
+		gs.mu.Unlock()
+		return ErrShutdown
+	}
+	gs.shuttingDown = true
+	gs.mu.Unlock()
+
+	gs.StopWatchers()
+
+	var errs []error
+
+	done := make(chan struct{})
+	go func() {
+		gs.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-gs.clock.After(timeout):
+		errs = append(errs, fmt.Errorf("%w waiting for operations in progress", ErrTimeout))
+	}
+
+	if c, ok := gs.tracer.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing tracer: %w", err))
+		}
+	}
+
+	for _, b := range gs.drivers {
+		if c, ok := b.driver.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, b.err("close", err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,321 @@
+package gostorm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DriverState says which calls a driver gets
+type DriverState string
+
+// Driver states
+const (
+	// DriverActive drivers get every call, they're what drivers start as
+	DriverActive DriverState = "active"
+
+	// DriverWriteOnly drivers get writes but don't serve reads, e.g. while
+	// they're being filled up
+	DriverWriteOnly DriverState = "writeonly"
+
+	// DriverDisabled drivers get no calls at all
+	DriverDisabled DriverState = "disabled"
+)
+
+// ParseDriverState reads "active", "writeonly" or "disabled"
+func ParseDriverState(s string) (DriverState, error) {
+	for _, state := range []DriverState{DriverActive, DriverWriteOnly, DriverDisabled} {
+		if s == string(state) {
+			return state, nil
+		}
+	}
+	return DriverActive, fmt.Errorf("gostorm: unknown driver state %q", s)
+}
+
+// ErrNoSuchDriver means there's no driver at the given index
+var ErrNoSuchDriver = errors.New("gostorm: no such driver")
+
+// DriverStatus is how a driver is doing. Misses and unsupported
+// operations are answers, they don't count as errors.
+type DriverStatus struct {
+	// Index is the driver's position, in the order drivers were added
+	Index int
+	Name  string
+	State DriverState
+
+	Calls             uint64
+	Errors            uint64
+	ConsecutiveErrors uint64
+
+	// InFlight is the number of calls the driver hasn't answered yet,
+	// abandoned ones included
+	InFlight int64
+
+	// Latency is of the last latencyWindow calls
+	Latency Percentiles
+
+	// Capabilities are what the driver can do besides get, set and
+	// delete: "list", "ttl" and "trace"
+	Capabilities []string
+
+	LastError     string
+	LastErrorAt   time.Time
+	LastSuccessAt time.Time
+}
+
+// Healthy tells whether the driver's last call went fine
+func (s DriverStatus) Healthy() bool {
+	return s.ConsecutiveErrors == 0
+}
+
+// Percentiles of the latency of calls
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// latencyWindow is how many of a driver's latest calls its percentiles
+// are worked out from
+const latencyWindow = 1024
+
+// latencies keeps the latest latencyWindow latencies, oldest overwritten
+type latencies struct {
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) add(d time.Duration) {
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencyWindow
+}
+
+func (l *latencies) percentiles() Percentiles {
+	if len(l.samples) == 0 {
+		return Percentiles{}
+	}
+
+	sorted := append([]time.Duration(nil), l.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	at := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return Percentiles{P50: at(50), P90: at(90), P99: at(99)}
+}
+
+// capabilities lists what drv can do besides get, set and delete. Listing
+// and TTLs are up to the driver under any middleware, which takes every
+// call but fails the ones the driver can't make.
+func capabilities(drv Driver) []string {
+	inner := innermost(drv)
+
+	caps := []string{}
+	if _, ok := inner.(Lister); ok {
+		caps = append(caps, "list")
+	}
+	if _, ok := inner.(Expirer); ok {
+		caps = append(caps, "ttl")
+	}
+	if _, ok := drv.(Propagator); ok {
+		caps = append(caps, "trace")
+	}
+	return caps
+}
+
+// read tells whether op is a read, which DriverWriteOnly drivers don't get
+func (op Op) read() bool {
+	switch op {
+	case OpGet, OpList, OpTTL:
+		return true
+	}
+	return false
+}
+
+// takes tells whether the driver gets op calls in its current state
+func (b *backend) takes(op Op) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.status.State {
+	case DriverDisabled:
+		return false
+	case DriverWriteOnly:
+		return !op.read()
+	}
+	return true
+}
+
+// started records a call going out
+func (b *backend) started() {
+	b.mu.Lock()
+	b.status.InFlight++
+	b.mu.Unlock()
+}
+
+// finished records a call coming back
+func (b *backend) finished() {
+	b.mu.Lock()
+	b.status.InFlight--
+	b.mu.Unlock()
+}
+
+// observe records the outcome of a call
+func (b *backend) observe(err error, elapsed time.Duration, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.status.Calls++
+	b.latencies.add(elapsed)
+
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnsupported) {
+		b.status.ConsecutiveErrors = 0
+		b.status.LastSuccessAt = now
+		return
+	}
+
+	b.status.Errors++
+	b.status.ConsecutiveErrors++
+	b.status.LastError = err.Error()
+	b.status.LastErrorAt = now
+}
+
+// targets returns the drivers getting op calls
+func (gs *Gostorm) targets(op Op) []*backend {
+	var targets []*backend
+	for _, b := range gs.drivers {
+		if b.takes(op) {
+			targets = append(targets, b)
+		}
+	}
+	return targets
+}
+
+// Drivers returns the status of every driver, in the order they were added
+func (gs *Gostorm) Drivers() []DriverStatus {
+	statuses := make([]DriverStatus, len(gs.drivers))
+	for i, b := range gs.drivers {
+		b.mu.Lock()
+		statuses[i] = b.status
+		statuses[i].Latency = b.latencies.percentiles()
+		b.mu.Unlock()
+	}
+	return statuses
+}
+
+// ErrNotReady means too few drivers are healthy to meet the consistency
+// policies
+var ErrNotReady = errors.New("gostorm: not enough healthy drivers")
+
+// Ready tells whether enough drivers are healthy, by the last call they
+// got, to meet the read and write policies. It returns an error wrapping
+// ErrNotReady saying which isn't met if not.
+func (gs *Gostorm) Ready() error {
+	gs.mu.Lock()
+	shuttingDown := gs.shuttingDown
+	gs.mu.Unlock()
+
+	if shuttingDown {
+		return fmt.Errorf("%w: shutting down", ErrNotReady)
+	}
+
+	check := func(op Op, policy Consistency) error {
+		targets := gs.targets(op)
+		if len(targets) == 0 {
+			return fmt.Errorf("%w: no drivers to %s with", ErrNotReady, op)
+		}
+
+		healthy := 0
+		for _, b := range targets {
+			b.mu.Lock()
+			if b.status.Healthy() {
+				healthy++
+			}
+			b.mu.Unlock()
+		}
+
+		if required := policy.required(len(targets)); healthy < required {
+			return fmt.Errorf("%w: %d healthy %s drivers, %s needs %d", ErrNotReady, healthy, op, policy, required)
+		}
+		return nil
+	}
+
+	if err := check(OpGet, gs.readPolicy); err != nil {
+		return err
+	}
+	return check(OpSet, gs.writePolicy)
+}
+
+// SetDriverState changes which calls the driver at index gets
+func (gs *Gostorm) SetDriverState(index int, state DriverState) error {
+	if index < 0 || index >= len(gs.drivers) {
+		return ErrNoSuchDriver
+	}
+
+	b := gs.drivers[index]
+
+	b.mu.Lock()
+	old := b.status.State
+	b.status.State = state
+	b.mu.Unlock()
+
+	gs.logger.Info("driver state changed", "index", index, "driver", b.status.Name, "from", old, "to", state)
+	return nil
+}
+
+// DriverValue is what a single driver has for a key, see Inspect
+type DriverValue struct {
+	Index int
+	Name  string
+	Value string
+	Err   error
+}
+
+// InspectWithTimeout asks every driver that isn't disabled for key, on its
+// own and without retries, to see whether they agree
+func (gs *Gostorm) InspectWithTimeout(key string, timeout time.Duration) []DriverValue {
+	return gs.inspect(origin{}, key, timeout)
+}
+
+func (gs *Gostorm) inspect(o origin, key string, timeout time.Duration) []DriverValue {
+	key = o.tenant.key(key)
+	span, p := gs.startOp(o, "inspect", key)
+	defer span.End(nil)
+
+	deadline := gs.clock.Now().Add(timeout)
+	targets := p.tenant.only(gs.targets(OpSet))
+	values := make([]DriverValue, len(targets))
+
+	var wg sync.WaitGroup
+	for i, b := range targets {
+		values[i] = DriverValue{Index: b.status.Index, Name: b.status.Name}
+
+		if err := gs.enter(1); err != nil {
+			values[i].Err = err
+			continue
+		}
+
+		wg.Add(1)
+		go func(v *DriverValue, b *backend) {
+			defer wg.Done()
+			defer gs.pending.Done()
+			v.Value, v.Err = gs.invoke(p, b, OpGet, 1, func(drv Driver, retChan chan string, errChan chan error) {
+				drv.Get(key, retChan, errChan)
+			}, deadline)
+		}(&values[i], b)
+	}
+	wg.Wait()
+
+	return values
+}
+
+// Inspect asks every driver that isn't disabled for key
+func (gs *Gostorm) Inspect(key string) []DriverValue {
+	return gs.InspectWithTimeout(key, gs.timeout)
+}
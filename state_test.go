@@ -0,0 +1,58 @@
+package gostorm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// plainDriver can only get, set and delete
+type plainDriver struct{}
+
+func (plainDriver) Get(key string, retChan chan string, errChan chan error) {
+	errChan <- ErrNotFound
+}
+
+func (plainDriver) Set(key, value string, retChan chan string, errChan chan error) {
+	retChan <- value
+}
+
+func (plainDriver) Delete(key string, retChan chan string, errChan chan error) {
+	retChan <- ""
+}
+
+// expiringDriver can expire keys too
+type expiringDriver struct{ plainDriver }
+
+func (expiringDriver) SetWithTTL(key, value string, ttl time.Duration, retChan chan string, errChan chan error) {
+	retChan <- value
+}
+
+func (expiringDriver) Expire(key string, ttl time.Duration, retChan chan string, errChan chan error) {
+	retChan <- ""
+}
+
+func (expiringDriver) TTL(key string, retChan chan time.Duration, errChan chan error) {
+	retChan <- 0
+}
+
+func TestCapabilities(t *testing.T) {
+	pass := func(c Call, next Handler) (Reply, error) { return next(c) }
+
+	tests := []struct {
+		name string
+		drv  Driver
+		want []string
+	}{
+		{"plain", plainDriver{}, []string{}},
+		{"expiring", expiringDriver{}, []string{"ttl"}},
+		{"plain behind middleware", Wrap(plainDriver{}, pass), []string{}},
+		{"expiring behind middleware", Wrap(Wrap(expiringDriver{}, pass), pass), []string{"ttl"}},
+	}
+
+	for _, test := range tests {
+		if got := capabilities(test.drv); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
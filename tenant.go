@@ -0,0 +1,505 @@
+package gostorm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantHeader says which tenant an HTTP request is for, without it keys
+// are taken as they are. It's taken on trust, so with tenants the handler
+// needs something in front, like auth.Handler, setting it from credentials
+// and never letting the client's through.
+const TenantHeader = "X-Gostorm-Tenant"
+
+// Errors of tenants
+var (
+	// ErrUnknownTenant means no tenant goes by the name a request gave
+	ErrUnknownTenant = errors.New("gostorm: unknown tenant")
+
+	// ErrQuotaExceeded means a write would take a tenant over MaxKeys or
+	// MaxBytes
+	ErrQuotaExceeded = errors.New("gostorm: quota exceeded")
+
+	// ErrThrottled means a request went over its tenant's rate
+	ErrThrottled = errors.New("gostorm: too many requests for the tenant, slow down")
+)
+
+// Tenant is a namespace in a Gostorm shared by several teams. Its keys are
+// stored under Prefix, out of the others' sight, on its own drivers, with
+// its own policies and within its Quota.
+type Tenant struct {
+	Name string
+
+	// Prefix goes in front of every key, Name + "/" if empty
+	Prefix string
+
+	// Drivers are the names of the drivers it uses, every one if empty
+	Drivers []string
+
+	// ReadPolicy and WritePolicy, the Gostorm's when nil
+	ReadPolicy  *Consistency
+	WritePolicy *Consistency
+
+	Quota Quota
+}
+
+// Quota caps what a tenant may use, zero meaning no cap. Keys and bytes
+// are counted by each Gostorm from the writes it made, see CountUsage for
+// the ones it didn't.
+type Quota struct {
+	MaxKeys int64
+
+	// MaxBytes caps the size of the keys and values stored
+	MaxBytes int64
+
+	// Rate caps the HTTP requests a second, Burst is how many may come at
+	// once, Rate rounded up if zero
+	Rate  float64
+	Burst int
+}
+
+// TenantStatus is how much a tenant uses
+type TenantStatus struct {
+	Tenant
+
+	Keys  int64
+	Bytes int64
+
+	// Requests counts the HTTP requests made for the tenant, Throttled the
+	// ones of them turned down for Rate
+	Requests  uint64
+	Throttled uint64
+
+	// OverQuota counts the writes turned down for MaxKeys or MaxBytes
+	OverQuota uint64
+}
+
+// tenant is a Tenant along with what it uses
+type tenant struct {
+	Tenant
+	drivers map[string]bool
+
+	// mu guards everything below
+	mu        sync.Mutex
+	keys      map[string]usage
+	bytes     int64
+	tokens    float64
+	refilled  time.Time
+	requests  uint64
+	throttled uint64
+	overQuota uint64
+}
+
+// usage is what a key takes up and when it goes away, zero for never
+type usage struct {
+	size    int64
+	expires time.Time
+}
+
+// WithTenant adds a tenant, see TenantHeader for how HTTP requests pick it
+func WithTenant(t Tenant) Option {
+	return func(gs *Gostorm) {
+		if len(t.Prefix) == 0 {
+			t.Prefix = t.Name + "/"
+		}
+
+		tt := &tenant{Tenant: t, keys: make(map[string]usage), tokens: float64(t.Quota.burst())}
+		if len(t.Drivers) > 0 {
+			tt.drivers = make(map[string]bool)
+			for _, name := range t.Drivers {
+				tt.drivers[name] = true
+			}
+		}
+
+		if gs.tenants == nil {
+			gs.tenants = make(map[string]*tenant)
+		}
+		gs.tenants[t.Name] = tt
+	}
+}
+
+// checkTenants warns about tenants routed to drivers that don't exist,
+// their calls would fail with ErrNoDrivers
+func (gs *Gostorm) checkTenants() {
+	names := make(map[string]bool)
+	for _, b := range gs.drivers {
+		names[b.status.Name] = true
+	}
+
+	for _, t := range gs.tenants {
+		for _, name := range t.Drivers {
+			if !names[name] {
+				gs.logger.Warn("tenant uses an unknown driver", "tenant", t.Name, "driver", name)
+			}
+		}
+	}
+}
+
+// tenant returns the tenant called name, nil for ""
+func (gs *Gostorm) tenant(name string) (*tenant, error) {
+	if len(name) == 0 {
+		return nil, nil
+	}
+	if t, ok := gs.tenants[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownTenant, name)
+}
+
+// key returns where key is stored, the methods of tenant all take a nil
+// one to mean no tenant
+func (t *tenant) key(key string) string {
+	if t == nil {
+		return key
+	}
+	return t.Prefix + key
+}
+
+// strip undoes key
+func (t *tenant) strip(key string) string {
+	if t == nil {
+		return key
+	}
+	return strings.TrimPrefix(key, t.Prefix)
+}
+
+// only keeps the targets the tenant uses
+func (t *tenant) only(targets []*backend) []*backend {
+	if t == nil || t.drivers == nil {
+		return targets
+	}
+
+	var ours []*backend
+	for _, b := range targets {
+		if t.drivers[b.status.Name] {
+			ours = append(ours, b)
+		}
+	}
+	return ours
+}
+
+func (t *tenant) readPolicy(def Consistency) Consistency {
+	if t == nil || t.ReadPolicy == nil {
+		return def
+	}
+	return *t.ReadPolicy
+}
+
+func (t *tenant) writePolicy(def Consistency) Consistency {
+	if t == nil || t.WritePolicy == nil {
+		return def
+	}
+	return *t.WritePolicy
+}
+
+// burst is how many requests may come at once
+func (q Quota) burst() int {
+	if q.Burst > 0 {
+		return q.Burst
+	}
+	return int(math.Ceil(q.Rate))
+}
+
+// allow counts a request in, telling whether Rate lets it through. The
+// bucket holds Burst tokens and gets Rate of them back a second.
+func (t *tenant) allow(now time.Time) bool {
+	if t == nil {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests++
+	if t.Quota.Rate <= 0 {
+		return true
+	}
+
+	if !t.refilled.IsZero() {
+		t.tokens += now.Sub(t.refilled).Seconds() * t.Quota.Rate
+		if burst := float64(t.Quota.burst()); t.tokens > burst {
+			t.tokens = burst
+		}
+	}
+	t.refilled = now
+
+	if t.tokens < 1 {
+		t.throttled++
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// live returns key's usage unless it expired by now
+func (t *tenant) live(key string, now time.Time) (usage, bool) {
+	u, ok := t.keys[key]
+	if ok && !u.expires.IsZero() && !now.Before(u.expires) {
+		return usage{}, false
+	}
+	return u, ok
+}
+
+// prune forgets the keys that expired by now
+func (t *tenant) prune(now time.Time) {
+	for key, u := range t.keys {
+		if !u.expires.IsZero() && !now.Before(u.expires) {
+			t.bytes -= u.size
+			delete(t.keys, key)
+		}
+	}
+}
+
+// admit tells whether storing size bytes at key keeps the tenant within
+// MaxKeys and MaxBytes. An admitted key counts in right away, so writes
+// racing it and the rest of its batch are held to what's left. A write
+// that then fails calls release to take it back out.
+func (t *tenant) admit(key string, size int64, now time.Time) (release func(), err error) {
+	if t == nil || (t.Quota.MaxKeys <= 0 && t.Quota.MaxBytes <= 0) {
+		return func() {}, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	over := func() error {
+		keys, bytes := int64(len(t.keys)), t.bytes+size
+		if u, ok := t.live(key, now); ok {
+			bytes -= u.size
+		} else {
+			keys++
+		}
+
+		switch {
+		case t.Quota.MaxKeys > 0 && keys > t.Quota.MaxKeys:
+			return fmt.Errorf("%w: %s may have %d keys", ErrQuotaExceeded, t.Name, t.Quota.MaxKeys)
+		case t.Quota.MaxBytes > 0 && bytes > t.Quota.MaxBytes:
+			return fmt.Errorf("%w: %s may store %d bytes", ErrQuotaExceeded, t.Name, t.Quota.MaxBytes)
+		}
+		return nil
+	}
+
+	// Expired keys are only forgotten when they'd make a difference
+	if over() != nil {
+		t.prune(now)
+		if err := over(); err != nil {
+			t.overQuota++
+			return nil, err
+		}
+	}
+
+	prev, had := t.keys[key]
+	reserved := usage{size: size}
+	t.bytes += size - prev.size
+	t.keys[key] = reserved
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		// Unless another write got to key since
+		if t.keys[key] != reserved {
+			return
+		}
+		t.bytes -= size - prev.size
+		if had {
+			t.keys[key] = prev
+		} else {
+			delete(t.keys, key)
+		}
+	}, nil
+}
+
+// stored counts key in at size bytes, expiring at expires unless it's zero
+func (t *tenant) stored(key string, size int64, expires time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bytes += size - t.keys[key].size
+	t.keys[key] = usage{size: size, expires: expires}
+}
+
+// removed counts key out
+func (t *tenant) removed(key string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bytes -= t.keys[key].size
+	delete(t.keys, key)
+}
+
+// expiring changes when key goes away, if it's counted in
+func (t *tenant) expiring(key string, expires time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if u, ok := t.keys[key]; ok {
+		u.expires = expires
+		t.keys[key] = u
+	}
+}
+
+// size is what storing value at key counts for
+func size(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// expiry is when a key given ttl now goes away, zero for never
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// Tenants returns how much each tenant uses, by name
+func (gs *Gostorm) Tenants() []TenantStatus {
+	now := gs.clock.Now()
+
+	statuses := make([]TenantStatus, 0, len(gs.tenants))
+	for _, t := range gs.tenants {
+		t.mu.Lock()
+		t.prune(now)
+		statuses = append(statuses, TenantStatus{
+			Tenant:    t.Tenant,
+			Keys:      int64(len(t.keys)),
+			Bytes:     t.bytes,
+			Requests:  t.requests,
+			Throttled: t.throttled,
+			OverQuota: t.overQuota,
+		})
+		t.mu.Unlock()
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// CountUsage counts in the keys tenants already have on their drivers,
+// which Tenants knows nothing of otherwise: those written before the
+// Gostorm started or through another one. It lists and gets every key, so
+// it takes a while on big tenants. Their TTLs aren't looked up, those
+// keys count until they're deleted or written again.
+func (gs *Gostorm) CountUsage(timeout time.Duration) error {
+	var errs []error
+
+	for _, t := range gs.tenants {
+		o := origin{tenant: t}
+
+		keys, err := gs.list(o, "", timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+			continue
+		}
+
+		values, _ := gs.getMulti(o, keys, timeout)
+
+		t.mu.Lock()
+		for key, value := range values {
+			key = t.key(key)
+			if _, ok := t.keys[key]; !ok {
+				t.keys[key] = usage{size: size(key, value)}
+				t.bytes += size(key, value)
+			}
+		}
+		t.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// tenantConfig is a tenant in LoadTenants' file
+type tenantConfig struct {
+	Name        string   `json:"name"`
+	Prefix      string   `json:"prefix"`
+	Drivers     []string `json:"drivers"`
+	ReadPolicy  string   `json:"read_policy"`
+	WritePolicy string   `json:"write_policy"`
+	MaxKeys     int64    `json:"max_keys"`
+	MaxBytes    int64    `json:"max_bytes"`
+	Rate        float64  `json:"rate"`
+	Burst       int      `json:"burst"`
+}
+
+// LoadTenants reads tenants from a JSON file like
+//
+//	{"tenants": [{"name": "search", "drivers": ["redis"], "write_policy": "all",
+//	  "max_keys": 100000, "max_bytes": 104857600, "rate": 200, "burst": 400}]}
+//
+// Prefixes must not start one another, or tenants would see each other's keys.
+func LoadTenants(path string) ([]Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		Tenants []tenantConfig `json:"tenants"`
+	}{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("gostorm: %s: %s", path, err)
+	}
+
+	var tenants []Tenant
+	for _, c := range file.Tenants {
+		if len(c.Name) == 0 {
+			return nil, fmt.Errorf("gostorm: %s: tenant without a name", path)
+		}
+
+		t := Tenant{
+			Name:    c.Name,
+			Prefix:  c.Prefix,
+			Drivers: c.Drivers,
+			Quota:   Quota{MaxKeys: c.MaxKeys, MaxBytes: c.MaxBytes, Rate: c.Rate, Burst: c.Burst},
+		}
+		if len(t.Prefix) == 0 {
+			t.Prefix = t.Name + "/"
+		}
+
+		for _, p := range []struct {
+			s      string
+			policy **Consistency
+		}{{c.ReadPolicy, &t.ReadPolicy}, {c.WritePolicy, &t.WritePolicy}} {
+			if len(p.s) == 0 {
+				continue
+			}
+			policy, err := ParseConsistency(p.s)
+			if err != nil {
+				return nil, fmt.Errorf("gostorm: %s: tenant %s: %s", path, c.Name, err)
+			}
+			*p.policy = &policy
+		}
+
+		for _, other := range tenants {
+			if other.Name == t.Name {
+				return nil, fmt.Errorf("gostorm: %s: tenant %s twice", path, t.Name)
+			}
+			if strings.HasPrefix(t.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, t.Prefix) {
+				return nil, fmt.Errorf("gostorm: %s: tenants %s and %s have overlapping prefixes", path, other.Name, t.Name)
+			}
+		}
+
+		tenants = append(tenants, t)
+	}
+
+	return tenants, nil
+}
@@ -0,0 +1,220 @@
+package gostorm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTenantAllow(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name  string
+		quota Quota
+		// at are the request times, in ms from start
+		at   []int
+		want []bool
+	}{
+		{"no rate", Quota{}, []int{0, 0, 0}, []bool{true, true, true}},
+		{"burst of rate", Quota{Rate: 2}, []int{0, 0, 0}, []bool{true, true, false}},
+		{"own burst", Quota{Rate: 1, Burst: 3}, []int{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refills", Quota{Rate: 2}, []int{0, 0, 0, 500, 500}, []bool{true, true, false, true, false}},
+		{"refills up to burst", Quota{Rate: 2}, []int{0, 0, 10000, 10000, 10000}, []bool{true, true, true, true, false}},
+		{"fractional rate", Quota{Rate: 0.5}, []int{0, 0, 1000, 2000}, []bool{true, false, false, true}},
+	}
+
+	for _, test := range tests {
+		gs := New(WithTenant(Tenant{Name: "t", Quota: test.quota}))
+		tt := gs.tenants["t"]
+
+		for i, ms := range test.at {
+			if got := tt.allow(start.Add(time.Duration(ms) * time.Millisecond)); got != test.want[i] {
+				t.Errorf("%s: request %d at %dms: got %v, want %v", test.name, i, ms, got, test.want[i])
+			}
+		}
+	}
+
+	var nilTenant *tenant
+	if !nilTenant.allow(start) {
+		t.Error("no tenant was throttled")
+	}
+}
+
+func TestTenantAdmit(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	type write struct {
+		key     string
+		size    int64
+		expires time.Duration
+	}
+
+	tests := []struct {
+		name   string
+		quota  Quota
+		stored []write
+		key    string
+		size   int64
+		ok     bool
+	}{
+		{"no quota", Quota{}, nil, "k", 1 << 30, true},
+		{"within keys", Quota{MaxKeys: 2}, []write{{"a", 1, 0}}, "b", 1, true},
+		{"over keys", Quota{MaxKeys: 2}, []write{{"a", 1, 0}, {"b", 1, 0}}, "c", 1, false},
+		{"overwrite at max keys", Quota{MaxKeys: 2}, []write{{"a", 1, 0}, {"b", 1, 0}}, "b", 1, true},
+		{"within bytes", Quota{MaxBytes: 10}, []write{{"a", 6, 0}}, "b", 4, true},
+		{"over bytes", Quota{MaxBytes: 10}, []write{{"a", 6, 0}}, "b", 5, false},
+		{"overwrite counts the new size only", Quota{MaxBytes: 10}, []write{{"a", 6, 0}}, "a", 10, true},
+		{"expired keys don't count", Quota{MaxKeys: 1}, []write{{"a", 1, -time.Second}}, "b", 1, true},
+		{"expiring keys still count", Quota{MaxKeys: 1}, []write{{"a", 1, time.Second}}, "b", 1, false},
+	}
+
+	for _, test := range tests {
+		gs := New(WithTenant(Tenant{Name: "t", Quota: test.quota}))
+		tt := gs.tenants["t"]
+
+		for _, w := range test.stored {
+			var expires time.Time
+			if w.expires != 0 {
+				expires = now.Add(w.expires)
+			}
+			tt.stored(w.key, w.size, expires)
+		}
+
+		_, err := tt.admit(test.key, test.size, now)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.ok && !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%s: got %v, want ErrQuotaExceeded", test.name, err)
+		}
+	}
+}
+
+func TestTenantUsage(t *testing.T) {
+	gs := New(WithTenant(Tenant{Name: "t"}))
+	tt := gs.tenants["t"]
+
+	tt.stored("a", 5, time.Time{})
+	tt.stored("b", 3, time.Time{})
+	tt.stored("a", 2, time.Time{})
+	tt.removed("b")
+	tt.removed("missing")
+
+	if len(tt.keys) != 1 || tt.bytes != 2 {
+		t.Errorf("got %d keys and %d bytes, want 1 and 2", len(tt.keys), tt.bytes)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		names []string
+		err   bool
+	}{
+		{"default prefixes", `{"tenants": [{"name": "a"}, {"name": "b"}]}`, []string{"a", "b"}, false},
+		{"own prefix", `{"tenants": [{"name": "a", "prefix": "x:"}, {"name": "b", "read_policy": "quorum"}]}`, []string{"a", "b"}, false},
+		{"no name", `{"tenants": [{"prefix": "a/"}]}`, nil, true},
+		{"twice", `{"tenants": [{"name": "a", "prefix": "a/"}, {"name": "a", "prefix": "b/"}]}`, nil, true},
+		{"overlapping prefixes", `{"tenants": [{"name": "a", "prefix": "ab"}, {"name": "b", "prefix": "a"}]}`, nil, true},
+		{"same prefix", `{"tenants": [{"name": "a", "prefix": "x/"}, {"name": "b", "prefix": "x/"}]}`, nil, true},
+		{"bad policy", `{"tenants": [{"name": "a", "write_policy": "most"}]}`, nil, true},
+		{"bad json", `{"tenants": [`, nil, true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "tenants.json")
+		if err := os.WriteFile(path, []byte(test.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		tenants, err := LoadTenants(path)
+		if (err != nil) != test.err {
+			t.Errorf("%s: err %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		for i, name := range test.names {
+			if tenants[i].Name != name || len(tenants[i].Prefix) == 0 {
+				t.Errorf("%s: tenant %d is %+v", test.name, i, tenants[i])
+			}
+		}
+	}
+}
+
+func TestTenantKeys(t *testing.T) {
+	drv := &stubDriver{value: "v"}
+	gs := New(WithDriver(drv), WithTenant(Tenant{Name: "t", Quota: Quota{MaxKeys: 1}}))
+	o := origin{tenant: gs.tenants["t"]}
+
+	if err := gs.set(o, "a", "v", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.set(o, "a", "w", time.Second); err != nil {
+		t.Errorf("overwriting the only key: %v", err)
+	}
+	if err := gs.set(o, "b", "v", time.Second); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("a second key: got %v, want ErrQuotaExceeded", err)
+	}
+	if err := gs.delete(o, "a", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.set(o, "b", "v", time.Second); err != nil {
+		t.Errorf("a key after deleting the other: %v", err)
+	}
+
+	if _, ok := gs.tenants["t"].keys["t/b"]; !ok {
+		t.Errorf("keys are counted as %v, want them under the tenant's prefix", gs.tenants["t"].keys)
+	}
+}
+
+func TestTenantQuotaBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		drv  Driver
+	}{
+		{"batched", &batchSetter{batchDriver{values: map[string]string{}}}},
+		{"a key at a time", &stubDriver{}},
+	}
+
+	for _, test := range tests {
+		gs := New(WithDriver(test.drv), WithTenant(Tenant{Name: "t", Quota: Quota{MaxKeys: 3}}))
+		tt := gs.tenants["t"]
+		o := origin{tenant: tt}
+
+		if err := gs.set(o, "a", "v", time.Second); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// Every key fits next to a, only two of them together
+		errs := gs.setMulti(o, map[string]string{"a": "w", "b": "v", "c": "v", "d": "v"}, time.Second)
+		if len(errs) != 1 {
+			t.Errorf("%s: %d keys failed, want 1: %v", test.name, len(errs), errs)
+		}
+		for key, err := range errs {
+			if key == "a" || !errors.Is(err, ErrQuotaExceeded) {
+				t.Errorf("%s: %s failed with %v, want a new key over quota", test.name, key, err)
+			}
+		}
+		if len(tt.keys) != 3 {
+			t.Errorf("%s: %d keys counted, want 3", test.name, len(tt.keys))
+		}
+	}
+}
+
+func TestTenantQuotaFailedWrite(t *testing.T) {
+	gs := New(WithDriver(&stubDriver{err: errors.New("boom")}, WithRetry(OpSet, RetryPolicy{})), WithTenant(Tenant{Name: "t", Quota: Quota{MaxKeys: 1}}))
+	tt := gs.tenants["t"]
+	o := origin{tenant: tt}
+
+	for _, key := range []string{"a", "b"} {
+		if err := gs.set(o, key, "v", time.Second); err == nil || errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%s: got %v, want the driver's error", key, err)
+		}
+	}
+	if len(tt.keys) != 0 || tt.bytes != 0 {
+		t.Errorf("failed writes still count: %v, %d bytes", tt.keys, tt.bytes)
+	}
+}
@@ -0,0 +1,223 @@
+// Package tlsconfig builds the TLS configs of gostorm's listener and of
+// its connections to backends. Certificates are reloaded when their files
+// change, so renewing them needs no restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// CheckInterval is how often a Reloader looks at its files, at most
+const CheckInterval = 10 * time.Second
+
+// Reloader serves a certificate, and optionally a CA pool, from files,
+// loading them again once they change. A bad reload keeps the old ones.
+type Reloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+	checked time.Time
+}
+
+// NewReloader loads the key pair in certFile and keyFile and the CA
+// certificates in caFile. Either the pair or caFile may be empty.
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if (len(certFile) == 0) != (len(keyFile) == 0) {
+		return nil, errors.New("tlsconfig: need both a cert and a key")
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified is when the newest of the files changed
+func (r *Reloader) lastModified() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if len(name) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// Reload loads the files again now
+func (r *Reloader) Reload() error {
+	modTime := r.lastModified()
+
+	var cert *tls.Certificate
+	if len(r.certFile) > 0 {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("tlsconfig: %s", err)
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if len(r.caFile) > 0 {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("tlsconfig: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tlsconfig: no certificates in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.modTime = cert, pool, modTime
+	r.mu.Unlock()
+
+	return nil
+}
+
+// current returns the certificate and pool, reloading them first if the
+// files changed since
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	stale := time.Since(r.checked) >= CheckInterval
+	if stale {
+		r.checked = time.Now()
+	}
+	cert, pool, modTime := r.cert, r.pool, r.modTime
+	r.mu.Unlock()
+
+	if stale && r.lastModified().After(modTime) {
+		if err := r.Reload(); err != nil {
+			slog.Error("keeping the old certificates", "err", err)
+		} else {
+			slog.Info("reloaded certificates", "cert", r.certFile, "ca", r.caFile)
+		}
+
+		r.mu.Lock()
+		cert, pool = r.cert, r.pool
+		r.mu.Unlock()
+	}
+
+	return cert, pool
+}
+
+// GetCertificate is for tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		return nil, errors.New("tlsconfig: no certificate")
+	}
+	return cert, nil
+}
+
+// GetClientCertificate is for tls.Config.GetClientCertificate
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		// No certificate is an answer too, the server decides
+		return &tls.Certificate{}, nil
+	}
+	return cert, nil
+}
+
+// ParseClientAuth reads "none", "request", "require", "verify-if-given"
+// or "verify"
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("tlsconfig: bad client auth %q", s)
+}
+
+// Server returns the config of an HTTP/2 and HTTP/1.1 listener serving the
+// key pair in certFile and keyFile, asking for client certificates as
+// clientAuth says and checking them against the CAs in clientCAFile
+func Server(certFile, keyFile, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, *Reloader, error) {
+	if len(certFile) == 0 {
+		return nil, nil, errors.New("tlsconfig: need a cert and a key")
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && len(clientCAFile) == 0 {
+		return nil, nil, errors.New("tlsconfig: verifying client certificates needs a CA")
+	}
+
+	r, err := NewReloader(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		ClientAuth:     clientAuth,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	// The CAs can change too, so every handshake gets the latest ones
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		_, pool := r.current()
+
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = pool
+		return c, nil
+	}
+
+	return config, r, nil
+}
+
+// FromQuery returns the config of a connection to a backend from the query
+// of its URL: "ca" the CA certificates to check it against, the system's
+// otherwise, "cert" and "key" a client certificate, "server_name" the name
+// to check if it's not the host and "insecure=true" to check nothing
+func FromQuery(q url.Values) (*tls.Config, error) {
+	r, err := NewReloader(q.Get("cert"), q.Get("key"), q.Get("ca"))
+	if err != nil {
+		return nil, err
+	}
+
+	_, pool := r.current()
+
+	config := &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              pool,
+		ServerName:           q.Get("server_name"),
+		InsecureSkipVerify:   q.Get("insecure") == "true",
+		GetClientCertificate: r.GetClientCertificate,
+	}
+
+	return config, nil
+}
+
+// HasParams tells whether q has any of FromQuery's parameters
+func HasParams(q url.Values) bool {
+	for _, name := range []string{"ca", "cert", "key", "server_name", "insecure"} {
+		if _, ok := q[name]; ok {
+			return true
+		}
+	}
+	return false
+}
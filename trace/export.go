@@ -0,0 +1,244 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLPExporter posts spans to an OpenTelemetry collector, OTLP/HTTP with
+// JSON encoding
+type OTLPExporter struct {
+	url     string
+	service string
+	http    *http.Client
+}
+
+// NewOTLPExporter returns an OTLPExporter posting to url, usually
+// "http://localhost:4318/v1/traces", as service
+func NewOTLPExporter(url, service string) *OTLPExporter {
+	return &OTLPExporter{
+		url:     url,
+		service: service,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// The bits of the OTLP JSON encoding spans need, see
+// https://github.com/open-telemetry/opentelemetry-proto
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// OTLP span kinds and status codes
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+
+	statusOK    = 1
+	statusError = 2
+)
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		out[i] = otlpAttribute{Key: key, Value: otlpValue{StringValue: attrs[key]}}
+	}
+	return out
+}
+
+// kindOf tells request spans and driver calls apart by their attributes
+func kindOf(data *SpanData) int {
+	if _, ok := data.Attrs["http.route"]; ok {
+		return kindServer
+	}
+	if _, ok := data.Attrs["driver"]; ok {
+		return kindClient
+	}
+	return kindInternal
+}
+
+// Export posts spans in a single request
+func (e *OTLPExporter) Export(spans []*SpanData) error {
+	out := make([]otlpSpan, len(spans))
+	for i, data := range spans {
+		out[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(data.TraceID[:]),
+			SpanID:            hex.EncodeToString(data.SpanID[:]),
+			Name:              data.Name,
+			Kind:              kindOf(data),
+			StartTimeUnixNano: strconv.FormatInt(data.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(data.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(data.Attrs),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if data.ParentID != [8]byte{} {
+			out[i].ParentSpanID = hex.EncodeToString(data.ParentID[:])
+		}
+		if len(data.Err) > 0 {
+			out[i].Status = otlpStatus{Code: statusError, Message: data.Err}
+		}
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]string{
+			"service.name": e.service,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/wmgaca/gostorm"},
+			Spans: out,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.http.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("trace: collector said %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Close does nothing, there's no connection to close
+func (e *OTLPExporter) Close() error {
+	return nil
+}
+
+// FileExporter appends spans to a file, a JSON object a line
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	out  *bufio.Writer
+}
+
+// fileSpan is a line of a FileExporter's file
+type fileSpan struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_span_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	DurationMS float64           `json:"duration_ms"`
+	Attrs      map[string]string `json:"attrs"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// NewFileExporter returns a FileExporter appending to the file at path,
+// created if need be
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file, out: bufio.NewWriter(file)}, nil
+}
+
+// Export writes spans, flushing them to the file
+func (e *FileExporter) Export(spans []*SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.out)
+	for _, data := range spans {
+		line := fileSpan{
+			TraceID:    hex.EncodeToString(data.TraceID[:]),
+			SpanID:     hex.EncodeToString(data.SpanID[:]),
+			Name:       data.Name,
+			Start:      data.Start,
+			DurationMS: float64(data.End.Sub(data.Start)) / float64(time.Millisecond),
+			Attrs:      data.Attrs,
+			Error:      data.Err,
+		}
+		if data.ParentID != [8]byte{} {
+			line.ParentID = hex.EncodeToString(data.ParentID[:])
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return e.out.Flush()
+}
+
+// Close closes the file
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.out.Flush(); err != nil {
+		e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
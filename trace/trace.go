@@ -0,0 +1,302 @@
+// Package trace records the spans of a Gostorm's requests and driver calls
+// and ships them off in batches, over OTLP/HTTP to a collector or to a
+// file:
+//
+//	tracer, err := trace.FromURL("http://localhost:4318/v1/traces?sample=0.1")
+//	gs := gostorm.New(gostorm.WithTracer(tracer), ...)
+//	defer tracer.Close()
+package trace
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wmgaca/gostorm"
+)
+
+const (
+	// queueSize is how many ended spans wait for export, more are dropped
+	queueSize = 4096
+
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+// SpanData is an ended span, as exported
+type SpanData struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+
+	// Err is the error the span ended with, if it's a failure: misses and
+	// unsupported operations aren't
+	Err string
+}
+
+// Exporter ships spans somewhere
+type Exporter interface {
+	Export(spans []*SpanData) error
+	Close() error
+}
+
+// Tracer is a gostorm.Tracer, sampling traces as they start and exporting
+// their spans in the background
+type Tracer struct {
+	exporter   Exporter
+	sampleRate float64
+	logger     *slog.Logger
+
+	// mu guards closed, spans ending after Close are dropped
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan *SpanData
+	done    chan struct{}
+	dropped uint64
+}
+
+// Option configures a Tracer, pass them to New
+type Option func(*Tracer)
+
+// WithSampleRate sets the fraction (0..1) of traces starting here that are
+// recorded, 1 by default. Traces coming in keep the caller's decision.
+func WithSampleRate(rate float64) Option {
+	return func(t *Tracer) {
+		t.sampleRate = rate
+	}
+}
+
+// WithLogger sets where failed exports are logged, slog.Default() if not
+func WithLogger(logger *slog.Logger) Option {
+	return func(t *Tracer) {
+		t.logger = logger
+	}
+}
+
+// New returns a Tracer exporting to exporter, Close it to flush what's left
+func New(exporter Exporter, opts ...Option) *Tracer {
+	t := &Tracer{
+		exporter:   exporter,
+		sampleRate: 1,
+		logger:     slog.Default(),
+		queue:      make(chan *SpanData, queueSize),
+		done:       make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	go t.run()
+
+	return t
+}
+
+// FromURL returns a Tracer for a conn string: an OTLP/HTTP endpoint like
+// "http://localhost:4318/v1/traces" or a file like
+// "file:///var/log/gostorm/traces.jsonl", JSON lines, with "?sample=0.1"
+// setting the sample rate and "&service=name" the service name.
+func FromURL(connString string) (*Tracer, error) {
+	u, err := url.Parse(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	u.RawQuery = ""
+
+	var opts []Option
+	if s := query.Get("sample"); len(s) > 0 {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("trace: bad sample rate %q", s)
+		}
+		opts = append(opts, WithSampleRate(rate))
+	}
+
+	service := query.Get("service")
+	if len(service) == 0 {
+		service = "gostorm"
+	}
+
+	var exporter Exporter
+	switch u.Scheme {
+	case "http", "https":
+		exporter = NewOTLPExporter(u.String(), service)
+	case "file":
+		exporter, err = NewFileExporter(u.Path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("trace: unknown scheme " + u.Scheme)
+	}
+
+	return New(exporter, opts...), nil
+}
+
+// StartSpan starts a span, a child of parent if it's valid
+func (t *Tracer) StartSpan(parent gostorm.SpanContext, name string, attrs map[string]string) gostorm.Span {
+	sc := gostorm.SpanContext{Sampled: rand.Float64() < t.sampleRate}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		randomBytes(sc.TraceID[:])
+	}
+	randomBytes(sc.SpanID[:])
+
+	s := &span{tracer: t, sc: sc}
+	if !sc.Sampled {
+		return s
+	}
+
+	s.data = &SpanData{
+		TraceID:  sc.TraceID,
+		SpanID:   sc.SpanID,
+		ParentID: parent.SpanID,
+		Name:     name,
+		Start:    time.Now(),
+		Attrs:    make(map[string]string, len(attrs)+1),
+	}
+	for key, value := range attrs {
+		s.data.Attrs[key] = value
+	}
+
+	return s
+}
+
+func randomBytes(b []byte) {
+	for i := 0; i < len(b); i += 8 {
+		binary.BigEndian.PutUint64(b[i:], rand.Uint64())
+	}
+}
+
+// Dropped returns how many spans didn't make it into the export queue
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Close exports what's left and closes the exporter
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	<-t.done
+	return t.exporter.Close()
+}
+
+// run exports spans in batches, every flushInterval at the latest
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			t.logger.Error("trace: dropping spans", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// span is a gostorm.Span, data being nil if it's not sampled
+type span struct {
+	tracer *Tracer
+	sc     gostorm.SpanContext
+
+	mu   sync.Mutex
+	data *SpanData
+}
+
+func (s *span) Context() gostorm.SpanContext {
+	return s.sc
+}
+
+func (s *span) SetAttr(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data != nil {
+		s.data.Attrs[key] = value
+	}
+}
+
+// End records the outcome, "ok" or the error's gostorm.ErrorClass, and
+// queues the span for export
+func (s *span) End(err error) {
+	s.mu.Lock()
+	data := s.data
+	s.data = nil
+	s.mu.Unlock()
+
+	if data == nil {
+		return
+	}
+
+	data.End = time.Now()
+	data.Attrs["outcome"] = "ok"
+	if err != nil {
+		class := gostorm.ErrorClass(err)
+		data.Attrs["outcome"] = class
+		if class != "not_found" && class != "unsupported" {
+			data.Err = err.Error()
+		}
+	}
+
+	s.tracer.enqueue(data)
+}
+
+func (t *Tracer) enqueue(data *SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	}
+
+	select {
+	case t.queue <- data:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
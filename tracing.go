@@ -0,0 +1,174 @@
+package gostorm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+)
+
+// TraceparentHeader carries the trace a request is part of, see
+// https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "Traceparent"
+
+// SpanContext identifies a span across processes, the zero value is no span
+// at all
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid tells whether sc identifies a span
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats sc for the traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ErrBadTraceparent means a traceparent header couldn't be parsed
+var ErrBadTraceparent = errors.New("gostorm: bad traceparent")
+
+// ParseTraceparent reads a traceparent header like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Versions past
+// 00 are read the same way, as the spec asks.
+func ParseTraceparent(header string) (SpanContext, error) {
+	var sc SpanContext
+
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return sc, ErrBadTraceparent
+	}
+	if len(header) > 55 && (header[:2] == "00" || header[55] != '-') {
+		return sc, ErrBadTraceparent
+	}
+	if header[:2] == "ff" {
+		return sc, ErrBadTraceparent
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(header[3:35])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(header[36:52])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+
+	flags, err := strconv.ParseUint(header[53:55], 16, 8)
+	if err != nil {
+		return sc, ErrBadTraceparent
+	}
+	sc.Sampled = flags&1 == 1
+
+	if !sc.IsValid() {
+		return sc, ErrBadTraceparent
+	}
+
+	return sc, nil
+}
+
+// Tracer starts spans, see WithTracer and TraceCalls
+type Tracer interface {
+	// StartSpan starts a span, a child of parent if it's valid
+	StartSpan(parent SpanContext, name string, attrs map[string]string) Span
+}
+
+// Span is a unit of traced work, ended exactly once
+type Span interface {
+	Context() SpanContext
+	SetAttr(key, value string)
+	End(err error)
+}
+
+// Propagator is a Driver that can pass the trace on to its backend, e.g.
+// another gostorm. WithSpan returns a copy of the driver making its calls
+// as part of the span sc.
+type Propagator interface {
+	WithSpan(sc SpanContext) Driver
+}
+
+// nopTracer traces nothing, passing the parent on so it still propagates
+type nopTracer struct{}
+
+func (nopTracer) StartSpan(parent SpanContext, name string, attrs map[string]string) Span {
+	return nopSpan{parent}
+}
+
+type nopSpan struct {
+	sc SpanContext
+}
+
+func (s nopSpan) Context() SpanContext { return s.sc }
+func (nopSpan) SetAttr(string, string) {}
+func (nopSpan) End(error)              {}
+
+// keyHash identifies a key in spans without giving it away
+func keyHash(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// origin is where an operation comes from: the trace and the request it's
+// part of and the tenant it's for, all empty when it's called through the
+// exported methods
+type origin struct {
+	span      SpanContext
+	requestID string
+	tenant    *tenant
+}
+
+// scope is what an operation's driver calls share: its span, the hash of
+// the key it's about, its tenant and a logger saying which request it's for
+type scope struct {
+	sc      SpanContext
+	keyHash string
+	tenant  *tenant
+	log     *slog.Logger
+}
+
+// startOp starts the span of an operation
+func (gs *Gostorm) startOp(o origin, op Op, key string) (Span, scope) {
+	hash := keyHash(key)
+	span := gs.tracer.StartSpan(o.span, "gostorm."+string(op), map[string]string{
+		"op":       string(op),
+		"key.hash": hash,
+	})
+
+	log := gs.logger
+	if len(o.requestID) > 0 {
+		log = log.With("request_id", o.requestID)
+	}
+	if o.tenant != nil {
+		span.SetAttr("tenant", o.tenant.Name)
+		log = log.With("tenant", o.tenant.Name)
+	}
+
+	return span, scope{sc: span.Context(), keyHash: hash, tenant: o.tenant, log: log}
+}
+
+// startCall starts the span of a single driver call, returning the driver
+// to make it with
+func (gs *Gostorm) startCall(parent scope, b *backend, op Op, attempt int) (Span, Driver) {
+	span := gs.tracer.StartSpan(parent.sc, b.status.Name+"."+string(op), map[string]string{
+		"driver":       b.status.Name,
+		"driver.index": strconv.Itoa(b.status.Index),
+		"op":           string(op),
+		"key.hash":     parent.keyHash,
+		"attempt":      strconv.Itoa(attempt),
+	})
+
+	drv := b.driver
+	if p, ok := drv.(Propagator); ok && span.Context().IsValid() {
+		drv = p.WithSpan(span.Context())
+	}
+
+	return span, drv
+}
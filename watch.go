@@ -0,0 +1,125 @@
+package gostorm
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchBuffer is how many events a watcher may fall behind before it's
+// dropped
+const watchBuffer = 256
+
+// ErrWatcherLagged means a watcher didn't keep up with the changes and was
+// stopped, it has missed events
+var ErrWatcherLagged = errors.New("gostorm: watcher fell behind")
+
+// Event is a change made through a Gostorm: OpSet, OpDelete or OpExpire.
+// TTL is set when the key expires.
+type Event struct {
+	Op    Op
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// Watcher gets the changes made to keys starting with a prefix, see Watch
+type Watcher struct {
+	// C delivers the events, it's closed once the watcher stops
+	C <-chan Event
+
+	events chan Event
+	prefix string
+	tenant *tenant
+	hub    *watchHub
+	err    error
+}
+
+// Err tells why C was closed: nil after Stop, ErrWatcherLagged if the
+// watcher fell behind, ErrShutdown if the Gostorm was shut down
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+// Stop stops the watcher and closes C, it's fine to call it more than once
+func (w *Watcher) Stop() {
+	w.hub.remove(w, nil)
+}
+
+// watchHub hands events out to watchers
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]bool
+}
+
+// add starts a watcher on the keys of t starting with prefix, events give
+// the keys the way t sees them
+func (h *watchHub) add(t *tenant, prefix string) *Watcher {
+	events := make(chan Event, watchBuffer)
+	w := &Watcher{C: events, events: events, prefix: t.key(prefix), tenant: t, hub: h}
+
+	h.mu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[*Watcher]bool)
+	}
+	h.watchers[w] = true
+	h.mu.Unlock()
+
+	return w
+}
+
+func (h *watchHub) remove(w *Watcher, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(w, err)
+}
+
+func (h *watchHub) removeLocked(w *Watcher, err error) {
+	if !h.watchers[w] {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.events)
+}
+
+// stopAll stops every watcher with err
+func (h *watchHub) stopAll(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		h.removeLocked(w, err)
+	}
+}
+
+// publish never blocks, a watcher with a full buffer is dropped instead
+func (h *watchHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+
+		event := e
+		event.Key = w.tenant.strip(e.Key)
+
+		select {
+		case w.events <- event:
+		default:
+			h.removeLocked(w, ErrWatcherLagged)
+		}
+	}
+}
+
+// Watch returns a Watcher getting every successful Set, Delete and Expire
+// of keys starting with prefix made through this Gostorm. Changes made
+// straight to the datastores, or through another Gostorm, aren't seen.
+func (gs *Gostorm) Watch(prefix string) *Watcher {
+	return gs.watches.add(nil, prefix)
+}